@@ -26,11 +26,18 @@ const (
 )
 
 const (
-	BaseConfigFile         = "app.toml"
-	DefaultHttpPort        = 9500
-	DefaultAppName         = "community-metadata"
-	DefaultInterval        = 60
+	BaseConfigFile  = "app.toml"
+	DefaultHttpPort = 9500
+	DefaultAppName  = "community-metadata"
+	DefaultInterval = 60
+	//Bounds of repo sync interval in seconds, cron schedules are bounded as well
+	DefaultMinSyncInterval = 10
+	DefaultMaxSyncInterval = 86400
 	DefaultSyncChannelSize = 100
+	//Seconds to wait for in-flight requests and plugin loads when shutting down gracefully
+	DefaultShutdownTimeout = 30
+	//Seconds to wait for git sync processes when shutting down quickly
+	QuickShutdownTimeout = 5
 )
 
 var (
@@ -42,8 +49,12 @@ var (
 	Hostname string
 	//App port listen to
 	HttpPort = DefaultHttpPort
+	//Port of plain http listener reachable from loopback, used by git sync webhook, HttpPort if 0
+	TriggerPort int
 	//Env name
 	EnvName = EnvDev
 	//App git info
 	GitInfo AppInfo
+	//Graceful shutdown timeout in seconds
+	ShutdownTimeout = DefaultShutdownTimeout
 )
@@ -52,6 +52,9 @@ func initAppInfo() {
 	if httpPort := config.Int("httpPort", 0); httpPort != 0 {
 		HttpPort = httpPort
 	}
+	if shutdownTimeout := config.Int("shutdownTimeout", 0); shutdownTimeout > 0 {
+		ShutdownTimeout = shutdownTimeout
+	}
 
 	// git repo info
 	//TODO: update dockerfile to publish git information to app.json
@@ -14,7 +14,10 @@ limitations under the License.
 package application
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gookit/color"
@@ -23,27 +26,144 @@ import (
 )
 
 var server *gin.Engine
+var httpServers []*http.Server
+var serverMutex sync.Mutex
+var listeners []ListenerConfig
 
 func Server() *gin.Engine {
 	return server
 }
 
-func InitServer() {
+func InitServer() error {
+	var err error
+	if listeners, err = LoadListenerConfigs(); err != nil {
+		return err
+	}
+	if port := triggerPort(listeners); port != 0 {
+		app.TriggerPort = port
+	} else {
+		color.Warn.Printf("no plain http listener reachable from loopback, git sync triggers won't work\n")
+	}
+	resolver, err := middleware.LoadClientIPResolver()
+	if err != nil {
+		return err
+	}
 	server = gin.New()
 	//TODO: figure out why
 	if app.EnvName == app.EnvDev {
 		server.Use(gin.Logger(), gin.Recovery())
 	}
+	//forwarded headers are only trusted from trusted proxies, handlers read client ip with middleware.ClientIP
+	server.Use(middleware.ResolveClientIP(resolver))
 	server.Use(middleware.RequestLog())
+	security, err := middleware.LoadSecurityConfig()
+	if err != nil {
+		return err
+	}
+	if security != nil {
+		server.Use(middleware.SecurityHeaders(security))
+	}
+	cors, err := middleware.LoadCORSConfig()
+	if err != nil {
+		return err
+	}
+	if cors != nil {
+		server.Use(middleware.CORS(cors))
+	}
+	conf, err := middleware.LoadRateLimitConfig()
+	if err != nil {
+		return err
+	}
+	if conf != nil {
+		rateLimit, err := middleware.RateLimit(conf)
+		if err != nil {
+			return err
+		}
+		server.Use(rateLimit)
+		color.Info.Printf("rate limiting enabled with %s store\n", conf.Store)
+	}
 
 	AddRoutes(server)
-
+	return nil
 }
 
-func Run() {
+// Run serves http requests on all listeners until server shutdown, it returns nil when server is shutdown or closed,
+// all listeners are closed if any of them fails
+func Run() error {
 	//NOTE: application will use loopback address 127.0.0.1 for internal usage, please don't remove 127.0.0.1 address
-	err := server.Run(fmt.Sprintf("0.0.0.0:%d", app.HttpPort))
-	if err != nil {
-		color.Error.Println(err)
+	servers := make([]*http.Server, 0, len(listeners))
+	for _, l := range listeners {
+		s := &http.Server{
+			Addr:    l.Address,
+			Handler: server,
+		}
+		if l.Internal {
+			s.Handler = middleware.MarkInternal(server)
+		}
+		if l.TLS {
+			reloader, err := NewCertReloader(l.CertFile, l.KeyFile)
+			if err != nil {
+				color.Error.Println(err)
+				return err
+			}
+			s.TLSConfig = &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: reloader.GetCertificate,
+			}
+		}
+		servers = append(servers, s)
+	}
+	serverMutex.Lock()
+	httpServers = servers
+	serverMutex.Unlock()
+	errs := make(chan error, len(servers))
+	for i, s := range servers {
+		go func(s *http.Server, l ListenerConfig) {
+			color.Info.Printf("listening on %s (tls: %v, internal: %v)\n", l.Address, l.TLS, l.Internal)
+			var err error
+			if l.TLS {
+				err = s.ListenAndServeTLS("", "")
+			} else {
+				err = s.ListenAndServe()
+			}
+			errs <- err
+		}(s, listeners[i])
+	}
+	var result error
+	for range servers {
+		if err := <-errs; err != nil && err != http.ErrServerClosed && result == nil {
+			color.Error.Println(err)
+			result = err
+			_ = Close()
+		}
+	}
+	return result
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests until context done
+func Shutdown(ctx context.Context) error {
+	var result error
+	for _, s := range getServers() {
+		if err := s.Shutdown(ctx); err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Close closes all connections immediately
+func Close() error {
+	var result error
+	for _, s := range getServers() {
+		if err := s.Close(); err != nil {
+			result = err
+		}
 	}
+	return result
+}
+
+func getServers() []*http.Server {
+	serverMutex.Lock()
+	defer serverMutex.Unlock()
+	return httpServers
 }
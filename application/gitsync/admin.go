@@ -0,0 +1,559 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gookit/color"
+	"github.com/gookit/goutil/fsutil"
+	"github.com/opensourceways/app-community-metadata/app"
+	"github.com/opensourceways/app-community-metadata/application/middleware"
+)
+
+const PluginStateFile = ".plugin-state.json"
+const PinFolder = ".pins"
+const AdminLoadTimeout = 60
+
+// revisionPattern matches full or abbreviated commit ids, revisions are passed to git and used as folder names
+var revisionPattern = regexp.MustCompile("^[0-9a-f]{7,40}$")
+
+const (
+	EnableAction  = "enable"
+	DisableAction = "disable"
+	ReloadAction  = "reload"
+	PinAction     = "pin"
+	UnpinAction   = "unpin"
+)
+
+// PluginState is the runtime state of plugin changed by admin, it's persisted in baseFolder
+type PluginState struct {
+	Disabled bool `json:"disabled"`
+	//Pinned revision of every repo, plugin is not pinned if empty
+	Pins      map[string]string `json:"pins,omitempty"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	UpdatedBy string            `json:"updatedBy"`
+}
+
+type AdminConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	//internal(internal listener or loopback only), apikey or jwt, credentials are configured in [auth]
+	Policy string            `mapstructure:"policy"`
+	Keys   []string          `mapstructure:"keys"`
+	Claims map[string]string `mapstructure:"claims"`
+}
+
+type pinRequest struct {
+	//Revision of every repo, current revisions are used if empty
+	Revisions map[string]string `json:"revisions"`
+}
+
+func (s *SyncManager) stateFile() string {
+	return filepath.Join(s.baseFolder, PluginStateFile)
+}
+
+// loadPluginStates restores runtime state of plugins, plugins pinned are loaded from pins when initialized
+func (s *SyncManager) loadPluginStates() error {
+	s.states = make(map[string]*PluginState)
+	content, err := ioutil.ReadFile(s.stateFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, &s.states); err != nil {
+		return errors.New(fmt.Sprintf("failed to decode plugin state file %s %v", s.stateFile(), err))
+	}
+	for name, state := range s.states {
+		container, ok := s.GetEnabledPlugins()[name]
+		if !ok {
+			s.logger.Warn(fmt.Sprintf("state of plugin %s ignored since plugin not enabled", name))
+			continue
+		}
+		container.SetDisabled(state.Disabled)
+		for repo, revision := range state.Pins {
+			if !revisionPattern.MatchString(revision) {
+				s.logger.Warn(fmt.Sprintf("pins of plugin %s ignored since revision %s of repo %s is invalid", name,
+					revision, repo))
+				state.Pins = nil
+				break
+			}
+		}
+		if len(state.Pins) != 0 {
+			container.SetPins(state.Pins)
+		}
+		s.logger.Info(fmt.Sprintf("plugin %s restored with disabled %v pins %v", name, state.Disabled, state.Pins))
+	}
+	return nil
+}
+
+// savePluginState persists the state of plugin, state in memory is kept unchanged if failed. State file is written
+// to a unique temporary file first since base folder may be shared by replicas
+func (s *SyncManager) savePluginState(name, caller string, disabled bool, pins map[string]string) error {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	previous, existed := s.states[name]
+	s.states[name] = &PluginState{
+		Disabled:  disabled,
+		Pins:      pins,
+		UpdatedAt: time.Now(),
+		UpdatedBy: caller,
+	}
+	err := s.writeStateFile()
+	if err != nil {
+		if existed {
+			s.states[name] = previous
+		} else {
+			delete(s.states, name)
+		}
+	}
+	return err
+}
+
+func (s *SyncManager) writeStateFile() error {
+	content, err := json.MarshalIndent(s.states, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.baseFolder, fmt.Sprintf("%s.*.tmp", PluginStateFile))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.stateFile())
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// audit records admin action in journal
+func (s *SyncManager) audit(entry *AuditEntry) {
+	entry.Kind = AdminAudit
+	s.logger.Info(fmt.Sprintf("admin action %s on plugin %s by %s, detail: %s, error: %s", entry.Action,
+		entry.Plugin, entry.Caller, entry.Detail, entry.Error))
+	if err := s.journal.Append(entry); err != nil {
+		s.logger.Error(fmt.Sprintf("failed to record admin action %v", err))
+	}
+}
+
+// pluginStateMiddleware rejects requests of plugin disabled at runtime
+func pluginStateMiddleware(container *PluginContainer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if container.Disabled() {
+			c.Data(503, "text/plain", []byte("plugin disabled"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkoutFiles returns all watch files of plugin in current checkouts
+func (s *SyncManager) checkoutFiles(container *PluginContainer) map[string][]string {
+	meta := container.Plugin.GetMeta()
+	files := make(map[string][]string)
+	for _, r := range meta.Repos {
+		localName := GetRepoLocalName(r.Repo)
+		repoPath := filepath.Join(s.baseFolder, meta.Group, localName, localName)
+		if runner, ok := s.getRunner(fmt.Sprintf("%s/%s", meta.Group, localName)); ok {
+			repoPath = runner.RepoPath()
+		}
+		files[r.Repo] = existingWatchFiles(repoPath, r.WatchFiles)
+	}
+	return files
+}
+
+// pinFolder returns the folder where repo files of revision are exported for plugin
+func (s *SyncManager) pinFolder(name, repo, revision string) string {
+	return filepath.Join(s.baseFolder, PinFolder, name, fmt.Sprintf("%s%s%s", GetRepoLocalName(repo), RefSeparator,
+		revision))
+}
+
+// pinnedFiles returns all watch files of plugin exported at pinned revisions, files are exported if not yet
+func (s *SyncManager) pinnedFiles(ctx context.Context, name string, container *PluginContainer,
+	pins map[string]string) (map[string][]string, error) {
+	meta := container.Plugin.GetMeta()
+	files := make(map[string][]string)
+	for _, r := range meta.Repos {
+		revision, ok := pins[r.Repo]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("revision of repo %s not pinned", r.Repo))
+		}
+		folder := s.pinFolder(name, r.Repo, revision)
+		if !fsutil.DirExist(folder) {
+			runner, ok := s.getRunner(fmt.Sprintf("%s/%s", meta.Group, GetRepoLocalName(r.Repo)))
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("repo %s not found", r.Repo))
+			}
+			if err := exportRevision(ctx, runner.RepoPath(), revision, r.WatchFiles, folder); err != nil {
+				return nil, err
+			}
+		}
+		files[r.Repo] = existingWatchFiles(folder, r.WatchFiles)
+	}
+	return files, nil
+}
+
+func existingWatchFiles(folder string, watchFiles []string) []string {
+	var files []string
+	for _, w := range watchFiles {
+		path := filepath.Join(folder, w)
+		if fsutil.PathExists(path) {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// exportRevision exports watch files of revision from git checkout into folder
+func exportRevision(ctx context.Context, repoPath, revision string, watchFiles []string, folder string) error {
+	if !revisionPattern.MatchString(revision) {
+		return errors.New(fmt.Sprintf("invalid revision %s", revision))
+	}
+	if err := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "--verify", "--quiet",
+		fmt.Sprintf("%s^{commit}", revision)).Run(); err != nil {
+		return errors.New(fmt.Sprintf("revision %s not found in checkout %s", revision, repoPath))
+	}
+	tmpFolder := fmt.Sprintf("%s.tmp", folder)
+	_ = os.RemoveAll(tmpFolder)
+	if err := os.MkdirAll(tmpFolder, 0755); err != nil {
+		return err
+	}
+	archive := filepath.Join(tmpFolder, ".export.tar")
+	args := append([]string{"-C", repoPath, "archive", "--format=tar", "-o", archive, revision, "--"}, watchFiles...)
+	if output, err := exec.CommandContext(ctx, "git", args...).CombinedOutput(); err != nil {
+		_ = os.RemoveAll(tmpFolder)
+		return errors.New(fmt.Sprintf("failed to export revision %s %v %s", revision, err, output))
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	err = extractTar(tar.NewReader(f), tmpFolder, 0)
+	f.Close()
+	_ = os.Remove(archive)
+	if err != nil {
+		_ = os.RemoveAll(tmpFolder)
+		return err
+	}
+	return os.Rename(tmpFolder, folder)
+}
+
+// stateFiles returns the files plugin should serve with pins, from pins if pinned or from checkouts otherwise
+func (s *SyncManager) stateFiles(ctx context.Context, name string, container *PluginContainer,
+	pins map[string]string) (map[string][]string, error) {
+	if pins != nil {
+		return s.pinnedFiles(ctx, name, container, pins)
+	}
+	return s.checkoutFiles(container), nil
+}
+
+// loadPinnedPlugin loads plugin from its pins when it's initialized
+func (s *SyncManager) loadPinnedPlugin(name string, container *PluginContainer) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*AdminLoadTimeout)
+	defer cancel()
+	files, err := s.pinnedFiles(ctx, name, container, container.Pins())
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("failed to load pinned plugin %s %v", name, err))
+		return
+	}
+	container.ScheduleLoad(files, "startup")
+}
+
+// waitLoad waits for the result of load scheduled in plugin container
+func waitLoad(ctx context.Context, result <-chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.New("load scheduled but not finished in time, check log for the result")
+	}
+}
+
+// RegisterAdminEndpoints registers audit endpoint, and plugin admin endpoints if admin enabled in config
+func (s *SyncManager) RegisterAdminEndpoints(group *gin.RouterGroup) error {
+	conf := AdminConfig{Policy: "internal"}
+	if app.Config.Exists("admin") {
+		if err := app.Config.MapStruct("admin", &conf); err != nil {
+			return errors.New(fmt.Sprintf("failed to decode admin config %v", err))
+		}
+	}
+	guard, err := s.accessGuard("admin", conf.Policy, conf.Keys, conf.Claims)
+	if err != nil {
+		return err
+	}
+	group.Use(guard)
+	group.GET("/audit", s.adminListAudit)
+	if !conf.Enabled {
+		return nil
+	}
+	group.GET("/plugins", s.adminListPlugins)
+	group.GET("/plugins/:name", s.adminGetPlugin)
+	group.POST("/plugins/:name/:action", s.adminPluginAction)
+	color.Info.Printf("============ Admin endpoints enabled(policy: %s) ============\n", conf.Policy)
+	return nil
+}
+
+// accessGuard checks requests of endpoints which are not public, requests from internal listener or loopback are
+// trusted, others are checked against apikey or jwt policy if configured
+func (s *SyncManager) accessGuard(name, policy string, keys []string, claims map[string]string) (gin.HandlerFunc, error) {
+	switch policy {
+	case "internal":
+	case middleware.APIKeyPolicy, middleware.JWTPolicy:
+		if s.authenticator == nil {
+			return nil, errors.New(fmt.Sprintf("%s policy %s requires auth enabled", name, policy))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown %s policy '%s'", name, policy))
+	}
+	authPolicy := &middleware.AuthPolicy{Policy: policy, Keys: keys, Claims: claims}
+	return func(c *gin.Context) {
+		if middleware.IsInternalRequest(c) || middleware.IsLoopbackPeer(c) {
+			c.Next()
+			return
+		}
+		if policy == "internal" {
+			c.Data(403, "text/plain", []byte(fmt.Sprintf("%s endpoints are only served internally", name)))
+			c.Abort()
+			return
+		}
+		s.authenticator.Check(c, authPolicy)
+		if !c.IsAborted() {
+			c.Next()
+		}
+	}, nil
+}
+
+func adminCaller(c *gin.Context) string {
+	if caller := c.GetString(middleware.CallerKey); caller != "" {
+		return caller
+	}
+	return fmt.Sprintf("internal:%s", middleware.ClientIP(c))
+}
+
+func (s *SyncManager) pluginDetail(name string, container *PluginContainer) map[string]interface{} {
+	detail := map[string]interface{}{
+		"name":     name,
+		"group":    container.Plugin.GetMeta().Group,
+		"ready":    container.Ready,
+		"disabled": container.Disabled(),
+		"pins":     container.Pins(),
+	}
+	s.stateMutex.Lock()
+	if state, ok := s.states[name]; ok {
+		detail["updatedAt"] = state.UpdatedAt
+		detail["updatedBy"] = state.UpdatedBy
+	}
+	s.stateMutex.Unlock()
+	return detail
+}
+
+func (s *SyncManager) adminListPlugins(c *gin.Context) {
+	names, _ := RegisteredPlugins()
+	data := make([]map[string]interface{}, 0)
+	for _, name := range names {
+		if container, ok := s.GetEnabledPlugins()[name]; ok {
+			data = append(data, s.pluginDetail(name, container))
+		} else {
+			data = append(data, map[string]interface{}{"name": name, "enabled": false})
+		}
+	}
+	c.JSON(200, data)
+}
+
+func (s *SyncManager) adminGetPlugin(c *gin.Context) {
+	name := c.Param("name")
+	container, ok := s.GetEnabledPlugins()[name]
+	if !ok {
+		c.Data(404, "text/plain", []byte(fmt.Sprintf("plugin %s not enabled", name)))
+		return
+	}
+	c.JSON(200, s.pluginDetail(name, container))
+}
+
+func (s *SyncManager) adminPluginAction(c *gin.Context) {
+	name := c.Param("name")
+	action := c.Param("action")
+	entry := &AuditEntry{Caller: adminCaller(c), Action: action, Plugin: name}
+	status, err := s.pluginAction(c, name, action, entry)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if status != 404 {
+		s.audit(entry)
+	}
+	if err != nil {
+		c.Data(status, "text/plain", []byte(err.Error()))
+		return
+	}
+	c.JSON(status, s.pluginDetail(name, s.GetEnabledPlugins()[name]))
+}
+
+// pluginAction performs admin action on plugin, http status is returned
+func (s *SyncManager) pluginAction(c *gin.Context, name, action string, entry *AuditEntry) (int, error) {
+	if _, registered := RegisteredPlugins(); registered[name] == nil {
+		return 404, errors.New(fmt.Sprintf("plugin %s not registered", name))
+	}
+	container, ok := s.GetEnabledPlugins()[name]
+	if !ok {
+		return 409, errors.New(fmt.Sprintf("plugin %s disabled by config, enable it in config and restart", name))
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*AdminLoadTimeout)
+	defer cancel()
+	previousDisabled, previousPins := container.Disabled(), container.Pins()
+	disabled, pins := previousDisabled, previousPins
+	reload := true
+	var files map[string][]string
+	var err error
+	switch action {
+	case EnableAction:
+		disabled = false
+	case DisableAction:
+		disabled, reload = true, false
+	case ReloadAction:
+	case PinAction:
+		var request pinRequest
+		if c.Request.ContentLength != 0 {
+			if err = c.ShouldBindJSON(&request); err != nil {
+				return 400, errors.New(fmt.Sprintf("invalid pin request %v", err))
+			}
+		}
+		if pins, err = s.resolvePins(container, request.Revisions); err != nil {
+			return 400, err
+		}
+		entry.Detail = fmt.Sprintf("pins %v", pins)
+		if files, err = s.pinnedFiles(ctx, name, container, pins); err != nil {
+			return 400, err
+		}
+	case UnpinAction:
+		pins = nil
+	default:
+		return 404, errors.New(fmt.Sprintf("unknown action %s", action))
+	}
+	//state is changed only if files loaded, and reverted if not persisted
+	if err = s.applyPluginState(ctx, name, container, entry.Caller, disabled, pins, reload, files); err != nil {
+		return 500, err
+	}
+	if err = s.savePluginState(name, entry.Caller, disabled, pins); err != nil {
+		if rollbackErr := s.applyPluginState(ctx, name, container, entry.Caller, previousDisabled, previousPins,
+			reload, nil); rollbackErr != nil {
+			s.logger.Error(fmt.Sprintf("failed to roll back plugin %s %v", name, rollbackErr))
+		}
+		return 500, errors.New(fmt.Sprintf("action reverted since state not persisted %v", err))
+	}
+	if action == UnpinAction && previousPins != nil {
+		_ = os.RemoveAll(filepath.Join(s.baseFolder, PinFolder, name))
+	}
+	return 200, nil
+}
+
+// applyPluginState loads files plugin should serve with state and applies state once loaded, files are resolved from
+// pins if nil. State is applied directly if reload not required or plugin not initialized, which loads files then
+func (s *SyncManager) applyPluginState(ctx context.Context, name string, container *PluginContainer, caller string,
+	disabled bool, pins map[string]string, reload bool, files map[string][]string) error {
+	if !reload || !container.Ready {
+		container.SetState(disabled, pins)
+		return nil
+	}
+	var err error
+	if files == nil {
+		if files, err = s.stateFiles(ctx, name, container, pins); err != nil {
+			return err
+		}
+	}
+	state := &PluginState{Disabled: disabled, Pins: pins}
+	return waitLoad(ctx, container.ScheduleStateLoad(files, caller, state))
+}
+
+// resolvePins returns the revision of every repo of plugin, current revision is used if not specified
+func (s *SyncManager) resolvePins(container *PluginContainer, revisions map[string]string) (map[string]string, error) {
+	meta := container.Plugin.GetMeta()
+	for repo := range revisions {
+		if GetRepo(meta.Repos, repo) == nil {
+			return nil, errors.New(fmt.Sprintf("repo %s not watched by plugin", repo))
+		}
+	}
+	pins := make(map[string]string)
+	for _, r := range meta.Repos {
+		revision := revisions[r.Repo]
+		if revision == "" {
+			runner, ok := s.getRunner(fmt.Sprintf("%s/%s", meta.Group, GetRepoLocalName(r.Repo)))
+			if !ok || runner.Revision() == "" {
+				return nil, errors.New(fmt.Sprintf("repo %s not synced yet", r.Repo))
+			}
+			revision = runner.Revision()
+		}
+		if !revisionPattern.MatchString(revision) {
+			return nil, errors.New(fmt.Sprintf("invalid revision %s", revision))
+		}
+		pins[r.Repo] = revision
+	}
+	return pins, nil
+}
+
+// adminListAudit queries journal with kind, plugin, repo, since, until(RFC3339) and limit, latest first
+func (s *SyncManager) adminListAudit(c *gin.Context) {
+	filter := &AuditFilter{
+		Kind:   c.Query("kind"),
+		Plugin: c.Query("plugin"),
+		Repo:   c.Query("repo"),
+	}
+	var err error
+	if value := c.Query("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			c.Data(400, "text/plain", []byte(fmt.Sprintf("invalid since %v", err)))
+			return
+		}
+	}
+	if value := c.Query("until"); value != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			c.Data(400, "text/plain", []byte(fmt.Sprintf("invalid until %v", err)))
+			return
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit <= 0 {
+			c.Data(400, "text/plain", []byte(fmt.Sprintf("invalid limit %s", value)))
+			return
+		}
+	}
+	entries, err := s.journal.Query(filter)
+	if err != nil {
+		c.Data(500, "text/plain", []byte(err.Error()))
+		return
+	}
+	c.JSON(200, entries)
+}
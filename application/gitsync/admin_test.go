@@ -0,0 +1,342 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gookit/config/v2"
+	"github.com/gookit/config/v2/toml"
+	"github.com/opensourceways/app-community-metadata/app"
+	"github.com/opensourceways/app-community-metadata/application/middleware"
+	"go.uber.org/zap"
+)
+
+const adminTestRepo = "https://gitee.com/test/repo"
+
+func loadTestConfig(t *testing.T, content string) {
+	c := config.New("test")
+	c.AddDriver(toml.Driver)
+	if err := c.LoadStrings(config.Toml, content); err != nil {
+		t.Fatal(err)
+	}
+	app.Config = c
+}
+
+func newTestJournal(t *testing.T, folder string) *AuditJournal {
+	journal, err := newAuditJournal(folder, 1024*1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = journal.Close() })
+	return journal
+}
+
+func adminRequest(engine *gin.Engine, method, path, remoteAddr string, headers map[string]string,
+	body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	engine.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func TestAccessGuard(t *testing.T) {
+	loadTestConfig(t, `
+[auth]
+enabled = true
+[auth.apikeys]
+ci = "ci-key"
+ops = "ops-key"
+[auth.jwt]
+secret = "secret"
+`)
+	authenticator, err := middleware.NewAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SyncManager{authenticator: authenticator}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	for path, policy := range map[string]string{"/internal": "internal", "/apikey": middleware.APIKeyPolicy,
+		"/jwt": middleware.JWTPolicy} {
+		guard, err := s.accessGuard("admin", policy, []string{"ops"}, map[string]string{"role": "admin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		engine.GET(path, guard, func(c *gin.Context) {
+			c.Data(200, "text/plain", []byte(adminCaller(c)))
+		})
+	}
+	internal := gin.New()
+	internal.Any("/*path", func(c *gin.Context) {
+		engine.HandleContext(c)
+	})
+	token := func(role string) string {
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice", "role": role,
+			"exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("secret"))
+		return "Bearer " + signed
+	}
+	cases := []struct {
+		path       string
+		remoteAddr string
+		headers    map[string]string
+		status     int
+		caller     string
+	}{
+		{"/internal", "1.2.3.4:1000", nil, 403, ""},
+		{"/internal", "1.2.3.4:1000", map[string]string{"X-API-Key": "ops-key"}, 403, ""},
+		{"/internal", "127.0.0.1:1000", nil, 200, "internal:127.0.0.1"},
+		//proxied requests are not loopback
+		{"/internal", "127.0.0.1:1000", map[string]string{"X-Forwarded-For": "1.2.3.4"}, 403, ""},
+		{"/apikey", "1.2.3.4:1000", nil, 401, ""},
+		{"/apikey", "1.2.3.4:1000", map[string]string{"X-API-Key": "ci-key"}, 403, ""},
+		{"/apikey", "1.2.3.4:1000", map[string]string{"X-API-Key": "ops-key"}, 200, "apikey:ops"},
+		{"/apikey", "127.0.0.1:1000", nil, 200, "internal:127.0.0.1"},
+		{"/jwt", "1.2.3.4:1000", nil, 401, ""},
+		{"/jwt", "1.2.3.4:1000", map[string]string{"Authorization": token("dev")}, 403, ""},
+		{"/jwt", "1.2.3.4:1000", map[string]string{"Authorization": token("admin")}, 200, "jwt:alice"},
+	}
+	for _, c := range cases {
+		recorder := adminRequest(engine, "GET", c.path, c.remoteAddr, c.headers, "")
+		if recorder.Code != c.status || (c.status == 200 && recorder.Body.String() != c.caller) {
+			t.Errorf("%s from %s with %v returns %d %s, expected %d %s", c.path, c.remoteAddr, c.headers,
+				recorder.Code, recorder.Body.String(), c.status, c.caller)
+		}
+	}
+	//requests served by internal listener are trusted
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/internal", nil)
+	middleware.MarkInternal(internal).ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Errorf("request of internal listener returns %d", recorder.Code)
+	}
+
+	if _, err = s.accessGuard("admin", "unknown", nil, nil); err == nil {
+		t.Error("unknown policy is accepted")
+	}
+	if _, err = (&SyncManager{}).accessGuard("admin", middleware.APIKeyPolicy, nil, nil); err == nil {
+		t.Error("apikey policy is accepted without auth")
+	}
+}
+
+// adminTestRunner serves a local git repo as checkout
+type adminTestRunner struct {
+	repo     *GitMeta
+	path     string
+	revision string
+}
+
+func (r *adminTestRunner) GetRepo() *GitMeta       { return r.repo }
+func (r *adminTestRunner) StartLoop()              {}
+func (r *adminTestRunner) Close() error            { return nil }
+func (r *adminTestRunner) RepoUpdated()            {}
+func (r *adminTestRunner) Revision() string        { return r.revision }
+func (r *adminTestRunner) RepoPath() string        { return r.path }
+func (r *adminTestRunner) Schedule() *SyncSchedule { return nil }
+
+// adminTestPlugin records content of README.md loaded, load fails if fail is set
+type adminTestPlugin struct {
+	lock   sync.Mutex
+	fail   bool
+	loaded string
+}
+
+func (p *adminTestPlugin) GetMeta() *PluginMeta {
+	return &PluginMeta{Name: "admintest", Group: "group",
+		Repos: []GitMeta{{Repo: adminTestRepo, Branch: "master", WatchFiles: []string{"README.md"}}}}
+}
+
+func (p *adminTestPlugin) Load(files map[string][]string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.fail {
+		return errors.New("failed to load")
+	}
+	if len(files[adminTestRepo]) != 1 {
+		return errors.New("README.md not found")
+	}
+	content, err := ioutil.ReadFile(files[adminTestRepo][0])
+	p.loaded = string(content)
+	return err
+}
+
+func (p *adminTestPlugin) RegisterEndpoints(group *gin.RouterGroup) {}
+
+func (p *adminTestPlugin) set(fail bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.fail = fail
+}
+
+func (p *adminTestPlugin) content() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.loaded
+}
+
+func TestAdminPinAndUnpin(t *testing.T) {
+	loadTestConfig(t, `
+[admin]
+enabled = true
+policy = "internal"
+`)
+	baseFolder, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseFolder)
+	origin := filepath.Join(baseFolder, "origin")
+	if err = os.MkdirAll(origin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, origin, "init", "-q")
+	first := commitFile(t, origin, "README.md", "v1")
+	latest := commitFile(t, origin, "README.md", "v2")
+
+	plugin := &adminTestPlugin{}
+	Register("admintest", plugin)
+	container := pluginsContainer["admintest"]
+	container.Ready = true
+	container.Logger = zap.NewNop()
+	go container.StartLoop()
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		container.Close()
+		<-container.Done()
+		pluginMutex.Lock()
+		delete(pluginsContainer, "admintest")
+		pluginMutex.Unlock()
+	}()
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				container.FlushChannel <- 1
+			}
+		}
+	}()
+	s := &SyncManager{
+		baseFolder:     baseFolder,
+		logger:         zap.NewNop(),
+		Runners:        map[string]Runner{"group/repo": &adminTestRunner{path: origin, revision: latest}},
+		enabledplugins: map[string]*PluginContainer{"admintest": container},
+		states:         make(map[string]*PluginState),
+		journal:        newTestJournal(t, filepath.Join(baseFolder, JournalFolder)),
+	}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	if err = s.RegisterAdminEndpoints(engine.Group("/admin")); err != nil {
+		t.Fatal(err)
+	}
+	action := func(name, body string) int {
+		return adminRequest(engine, "POST", "/admin/plugins/admintest/"+name, "127.0.0.1:1000", nil, body).Code
+	}
+	savedPins := func() map[string]string {
+		content, err := ioutil.ReadFile(s.stateFile())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var states map[string]*PluginState
+		if err = json.Unmarshal(content, &states); err != nil {
+			t.Fatal(err)
+		}
+		return states["admintest"].Pins
+	}
+
+	if code := action("pin", `{"revisions": {"`+adminTestRepo+`": "invalid"}}`); code != 400 {
+		t.Fatalf("pin of invalid revision returns %d", code)
+	}
+	if code := action("pin", `{"revisions": {"`+adminTestRepo+`": "`+first+`"}}`); code != 200 {
+		t.Fatalf("pin returns %d", code)
+	}
+	if plugin.content() != "v1" || container.Pins()[adminTestRepo] != first || savedPins()[adminTestRepo] != first {
+		t.Fatalf("plugin not pinned, loaded %s pins %v", plugin.content(), container.Pins())
+	}
+
+	//failed load leaves plugin pinned
+	plugin.set(true)
+	if code := action("unpin", ""); code != 500 {
+		t.Fatalf("unpin with failed load returns %d", code)
+	}
+	if container.Pins()[adminTestRepo] != first || savedPins()[adminTestRepo] != first {
+		t.Fatal("plugin unpinned while load failed")
+	}
+	plugin.set(false)
+
+	//state not persisted, plugin is pinned and loaded from pins again
+	if err = os.Remove(s.stateFile()); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(s.stateFile(), "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if code := action("unpin", ""); code != 500 {
+		t.Fatalf("unpin without state persisted returns %d", code)
+	}
+	if container.Pins()[adminTestRepo] != first || plugin.content() != "v1" {
+		t.Fatalf("unpin not reverted, loaded %s pins %v", plugin.content(), container.Pins())
+	}
+	if err = os.RemoveAll(s.stateFile()); err != nil {
+		t.Fatal(err)
+	}
+	if code := action("pin", `{"revisions": {"`+adminTestRepo+`": "`+first+`"}}`); code != 200 {
+		t.Fatalf("pin returns %d", code)
+	}
+
+	if code := action("unpin", ""); code != 200 {
+		t.Fatalf("unpin returns %d", code)
+	}
+	if plugin.content() != "v2" || container.Pins() != nil || savedPins() != nil {
+		t.Fatalf("plugin not unpinned, loaded %s pins %v", plugin.content(), container.Pins())
+	}
+	if _, err = os.Stat(filepath.Join(baseFolder, PinFolder, "admintest")); !os.IsNotExist(err) {
+		t.Fatal("pins not removed after unpinned")
+	}
+
+	//failed load leaves plugin disabled
+	if code := action("disable", ""); code != 200 || !container.Disabled() {
+		t.Fatalf("disable returns %d", code)
+	}
+	plugin.set(true)
+	if code := action("enable", ""); code != 500 || !container.Disabled() {
+		t.Fatalf("enable with failed load returns %d, disabled %v", code, container.Disabled())
+	}
+	plugin.set(false)
+	if code := action("enable", ""); code != 200 || container.Disabled() {
+		t.Fatalf("enable returns %d, disabled %v", code, container.Disabled())
+	}
+
+	files, _ := filepath.Glob(filepath.Join(baseFolder, PluginStateFile+"*.tmp"))
+	if len(files) != 0 {
+		t.Fatalf("temporary state files %v left", files)
+	}
+}
@@ -0,0 +1,308 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const ArchiveDownloadTimeout = 300
+
+// Archive formats
+const (
+	TarGzFormat = "tar.gz"
+	TarFormat   = "tar"
+	ZipFormat   = "zip"
+)
+
+// ArchiveRunner polls an archive published over http, the archive is downloaded when ETag changes and unpacked into
+// the same folder layout as git sync does.
+//
+// options:
+//
+//	format: tar.gz, tar or zip, detected from url if empty
+//	stripComponents: leading path components removed from entries, 1 for archives generated by code hosting
+//	header.<Name>: extra request header, for instance, header.Authorization
+type ArchiveRunner struct {
+	*BaseRunner
+	URL             string
+	format          string
+	stripComponents int
+	headers         map[string]string
+	client          *http.Client
+	etag            string
+}
+
+func NewArchiveRunner(group, parentFolder string, repo *GitMeta, eventChannel chan<- *GitEvent, interval int, logger *zap.Logger) (*ArchiveRunner, error) {
+	if !strings.HasPrefix(repo.Path, "http://") && !strings.HasPrefix(repo.Path, "https://") {
+		return nil, errors.New(fmt.Sprintf("http url is required for archive source of repo %s, got '%s'", repo.Repo,
+			repo.Path))
+	}
+	format := repo.Options["format"]
+	if format == "" {
+		format = archiveFormat(repo.Path)
+	}
+	if format != TarGzFormat && format != TarFormat && format != ZipFormat {
+		return nil, errors.New(fmt.Sprintf("unsupported archive format '%s' of repo %s", format, repo.Repo))
+	}
+	strip := 0
+	if value, ok := repo.Options["stripComponents"]; ok {
+		var err error
+		if strip, err = strconv.Atoi(value); err != nil || strip < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid stripComponents '%s' of repo %s", value, repo.Repo))
+		}
+	}
+	headers := make(map[string]string)
+	for k, v := range repo.Options {
+		if strings.HasPrefix(k, "header.") {
+			headers[strings.TrimPrefix(k, "header.")] = v
+		}
+	}
+	base, err := NewBaseRunner(group, parentFolder, repo, eventChannel, interval, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveRunner{
+		BaseRunner:      base,
+		URL:             repo.Path,
+		format:          format,
+		stripComponents: strip,
+		headers:         headers,
+		client:          &http.Client{Timeout: time.Second * ArchiveDownloadTimeout},
+	}, nil
+}
+
+func archiveFormat(url string) string {
+	url = strings.SplitN(url, "?", 2)[0]
+	switch {
+	case strings.HasSuffix(url, ".tar.gz"), strings.HasSuffix(url, ".tgz"):
+		return TarGzFormat
+	case strings.HasSuffix(url, ".tar"):
+		return TarFormat
+	case strings.HasSuffix(url, ".zip"):
+		return ZipFormat
+	}
+	return ""
+}
+
+// Pull downloads and unpacks the archive if it's changed
+func (a *ArchiveRunner) Pull(ctx context.Context) error {
+	request, err := http.NewRequest("GET", a.URL, nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	for k, v := range a.headers {
+		request.Header.Set(k, v)
+	}
+	if a.etag != "" {
+		request.Header.Set("If-None-Match", a.etag)
+	}
+	response, err := a.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("unexpected status code %d from %s", response.StatusCode, a.URL))
+	}
+	//zip requires random access, archive is always saved before unpacking
+	archive, err := ioutil.TempFile(a.ParentFolder, ".archive-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(archive, hash), response.Body)
+	if err != nil {
+		return err
+	}
+	revision := fmt.Sprintf("%x", hash.Sum(nil))[:12]
+	etag := response.Header.Get("ETag")
+	if revision == a.Revision() {
+		//server doesn't support ETag and content not changed
+		a.etag = etag
+		return nil
+	}
+	target, err := a.newSnapshotFolder(revision)
+	if err != nil {
+		return err
+	}
+	if err = ExtractArchive(archive, size, a.format, target, a.stripComponents); err != nil {
+		_ = os.RemoveAll(target)
+		return err
+	}
+	if err = a.switchLink(target); err != nil {
+		_ = os.RemoveAll(target)
+		return err
+	}
+	a.etag = etag
+	a.revision.Store(revision)
+	a.logger.Info(fmt.Sprintf("archive of repo %s updated to revision %s", a.Meta.Repo, revision))
+	a.CompareDigestAndNotify()
+	a.cleanSnapshots(target)
+	return nil
+}
+
+func (a *ArchiveRunner) StartLoop() {
+	defer close(a.doneChannel)
+	if !a.markStarted() {
+		return
+	}
+	ctx, cancel := a.closeContext()
+	defer cancel()
+	for {
+		if err := a.Pull(ctx); err != nil && ctx.Err() == nil {
+			a.logger.Error(fmt.Sprintf("failed to pull archive of repo %s from %s %v", a.Meta.Repo, a.URL, err))
+		}
+		if !a.schedule.Wait(ctx) {
+			a.logger.Info(fmt.Sprintf("archive runner for repo [%s] received close event, quiting..", a.Meta.Repo))
+			return
+		}
+	}
+}
+
+// RepoUpdated pulls archive immediately
+func (a *ArchiveRunner) RepoUpdated() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*ArchiveDownloadTimeout)
+	defer cancel()
+	if err := a.Pull(ctx); err != nil {
+		a.logger.Error(fmt.Sprintf("failed to pull archive of repo %s %v", a.Meta.Repo, err))
+	}
+}
+
+// ExtractArchive extracts tar.gz, tar or zip archive into dest folder
+func ExtractArchive(r io.ReaderAt, size int64, format, dest string, stripComponents int) error {
+	switch format {
+	case TarGzFormat:
+		gzipReader, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		return extractTar(tar.NewReader(gzipReader), dest, stripComponents)
+	case TarFormat:
+		return extractTar(tar.NewReader(io.NewSectionReader(r, 0, size)), dest, stripComponents)
+	case ZipFormat:
+		zipReader, err := zip.NewReader(r, size)
+		if err != nil {
+			return err
+		}
+		for _, f := range zipReader.File {
+			target, err := archiveTarget(dest, f.Name, stripComponents)
+			if err != nil {
+				return err
+			}
+			if target == "" {
+				continue
+			}
+			if f.FileInfo().IsDir() {
+				if err = os.MkdirAll(target, 0755); err != nil {
+					return err
+				}
+				continue
+			}
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			reader, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = writeArchiveFile(target, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unsupported archive format '%s'", format))
+}
+
+func extractTar(tarReader *tar.Reader, dest string, stripComponents int) error {
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := archiveTarget(dest, header.Name, stripComponents)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = writeArchiveFile(target, tarReader); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// archiveTarget returns the path of archive entry inside dest, empty if the entry is stripped
+func archiveTarget(dest, name string, stripComponents int) (string, error) {
+	parts := strings.Split(strings.Trim(filepath.ToSlash(name), "/"), "/")
+	if len(parts) <= stripComponents {
+		return "", nil
+	}
+	target := filepath.Join(dest, filepath.FromSlash(strings.Join(parts[stripComponents:], "/")))
+	//reject entries escaping from dest folder
+	if target != filepath.Clean(dest) && !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
+		return "", errors.New(fmt.Sprintf("illegal file %s in archive", name))
+	}
+	return target, nil
+}
+
+func writeArchiveFile(target string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	return err
+}
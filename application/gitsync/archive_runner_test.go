@@ -0,0 +1,213 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func tarGz(t *testing.T, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// archiveServer serves archive with or without ETag, requests answered with 304 are counted
+type archiveServer struct {
+	lock        sync.Mutex
+	content     []byte
+	etag        string
+	notModified int
+}
+
+func (s *archiveServer) set(content []byte, etag string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.content, s.etag = content, etag
+}
+
+func (s *archiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.etag != "" {
+		if r.Header.Get("If-None-Match") == s.etag {
+			s.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", s.etag)
+	}
+	_, _ = w.Write(s.content)
+}
+
+func newTestArchiveRunner(t *testing.T, url string, events chan *GitEvent) *ArchiveRunner {
+	parent, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(parent) })
+	repo := &GitMeta{Repo: "https://gitee.com/test/repo", Path: url, WatchFiles: []string{"README.md"},
+		Options: map[string]string{"stripComponents": "1"}}
+	runner, err := NewArchiveRunner("group", parent, repo, events, 1, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runner
+}
+
+func readRepoFile(t *testing.T, runner *ArchiveRunner, name string) string {
+	content, err := ioutil.ReadFile(filepath.Join(runner.RepoPath(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestArchivePullWithETag(t *testing.T) {
+	server := &archiveServer{}
+	server.set(tarGz(t, map[string]string{"repo-main/README.md": "v1"}), `"v1"`)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	events := make(chan *GitEvent, 10)
+	runner := newTestArchiveRunner(t, httpServer.URL+"/repo.tar.gz", events)
+
+	if err := runner.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || readRepoFile(t, runner, "README.md") != "v1" {
+		t.Fatal("archive not unpacked")
+	}
+	<-events
+	first := runner.Revision()
+	if err := runner.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if server.notModified != 1 || len(events) != 0 || runner.Revision() != first {
+		t.Fatalf("archive downloaded again while ETag not changed, %d not modified", server.notModified)
+	}
+
+	server.set(tarGz(t, map[string]string{"repo-main/README.md": "v2"}), `"v2"`)
+	if err := runner.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || runner.Revision() == first || readRepoFile(t, runner, "README.md") != "v2" {
+		t.Fatal("archive not updated after ETag changed")
+	}
+	snapshots, _ := ioutil.ReadDir(filepath.Join(runner.ParentFolder, SnapshotFolder))
+	if len(snapshots) != 1 {
+		t.Fatalf("%d snapshots left, outdated snapshot not cleaned", len(snapshots))
+	}
+}
+
+func TestArchivePullWithoutETag(t *testing.T) {
+	server := &archiveServer{}
+	content := tarGz(t, map[string]string{"repo-main/README.md": "v1"})
+	server.set(content, "")
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	events := make(chan *GitEvent, 10)
+	runner := newTestArchiveRunner(t, httpServer.URL+"/repo.tar.gz", events)
+
+	if err := runner.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-events
+	first := runner.Revision()
+	target, _ := os.Readlink(runner.RepoPath())
+	//revision is the digest of content, same content doesn't produce a new snapshot
+	if err := runner.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	current, _ := os.Readlink(runner.RepoPath())
+	if len(events) != 0 || runner.Revision() != first || current != target {
+		t.Fatal("archive unpacked again while content not changed")
+	}
+
+	server.set(tarGz(t, map[string]string{"repo-main/README.md": "v2"}), "")
+	if err := runner.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || runner.Revision() == first || readRepoFile(t, runner, "README.md") != "v2" {
+		t.Fatal("archive not updated after content changed")
+	}
+}
+
+func TestArchiveRejectsEscapingEntries(t *testing.T) {
+	dest, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	target := filepath.Join(dest, "a", "target")
+	for _, name := range []string{"repo-main/../../evil", "repo-main/a/../../../evil"} {
+		content := tarGz(t, map[string]string{name: "evil"})
+		err = ExtractArchive(bytes.NewReader(content), int64(len(content)), TarGzFormat, target, 1)
+		if err == nil {
+			t.Fatalf("entry %s escaping from dest is accepted", name)
+		}
+		if _, err = os.Stat(filepath.Join(dest, "evil")); !os.IsNotExist(err) {
+			t.Fatalf("file of entry %s written outside dest", name)
+		}
+	}
+
+	//bad archive never replaces the served snapshot
+	server := &archiveServer{}
+	server.set(tarGz(t, map[string]string{"repo-main/README.md": "v1"}), "")
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	events := make(chan *GitEvent, 10)
+	runner := newTestArchiveRunner(t, httpServer.URL+"/repo.tar.gz", events)
+	if err = runner.Pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	server.set(tarGz(t, map[string]string{"repo-main/../../../evil": "evil"}), "")
+	if err = runner.Pull(context.Background()); err == nil {
+		t.Fatal("archive with escaping entry is accepted")
+	}
+	if readRepoFile(t, runner, "README.md") != "v1" {
+		t.Fatal("served snapshot changed by bad archive")
+	}
+	snapshots, _ := ioutil.ReadDir(filepath.Join(runner.ParentFolder, SnapshotFolder))
+	if len(snapshots) != 1 {
+		t.Fatalf("%d snapshots left, partial snapshot not removed", len(snapshots))
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gookit/goutil/fsutil"
+	"go.uber.org/zap"
+)
+
+// Wait for file changes settled before notifying
+const DirectoryDebounceInterval = 500
+
+// DirectoryRunner serves plain directory on local disk, the directory is linked into repo path and file changes are
+// detected by fsnotify.
+type DirectoryRunner struct {
+	*BaseRunner
+	directory string
+}
+
+func NewDirectoryRunner(group, parentFolder string, repo *GitMeta, eventChannel chan<- *GitEvent, logger *zap.Logger) (*DirectoryRunner, error) {
+	if repo.Path == "" {
+		return nil, errors.New(fmt.Sprintf("path is required for directory source of repo %s", repo.Repo))
+	}
+	directory, err := filepath.Abs(repo.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !fsutil.DirExist(directory) {
+		return nil, errors.New(fmt.Sprintf("directory %s of repo %s not existed", directory, repo.Repo))
+	}
+	base, err := NewBaseRunner(group, parentFolder, repo, eventChannel, 0, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectoryRunner{BaseRunner: base, directory: directory}, nil
+}
+
+// link points repo path to the directory
+func (d *DirectoryRunner) link() error {
+	if target, err := os.Readlink(d.RepoPath()); err == nil && target == d.directory {
+		return nil
+	}
+	if info, err := os.Lstat(d.RepoPath()); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return errors.New(fmt.Sprintf("repo path %s exists and is not a symlink", d.RepoPath()))
+	}
+	_ = os.Remove(d.RepoPath())
+	return os.Symlink(d.directory, d.RepoPath())
+}
+
+// watchRecursively adds all sub directories into watcher, since fsnotify doesn't watch recursively
+func (d *DirectoryRunner) watchRecursively(watcher *fsnotify.Watcher, root string) {
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if err = watcher.Add(path); err != nil {
+				d.logger.Warn(fmt.Sprintf("failed to watch directory %s %v", path, err))
+			}
+		}
+		return nil
+	})
+}
+
+// notify compares the digest of watch files and updates the revision
+func (d *DirectoryRunner) notify() {
+	d.CompareDigestAndNotify()
+	digests := make([]string, 0, len(d.watchFiles))
+	for k, v := range d.watchFiles {
+		digests = append(digests, k+v)
+	}
+	sort.Strings(digests)
+	d.revision.Store(fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(digests, ""))))[:12])
+}
+
+func (d *DirectoryRunner) StartLoop() {
+	defer close(d.doneChannel)
+	if !d.markStarted() {
+		return
+	}
+	if err := d.link(); err != nil {
+		d.logger.Error(fmt.Sprintf("failed to link directory %s for repo %s %v", d.directory, d.Meta.Repo, err))
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		d.logger.Error(fmt.Sprintf("failed to create watcher for directory %s %v", d.directory, err))
+		return
+	}
+	defer watcher.Close()
+	d.watchRecursively(watcher, d.directory)
+	d.notify()
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	defer debounce.Stop()
+	for {
+		select {
+		case <-d.CloseChannel:
+			d.logger.Info(fmt.Sprintf("directory runner for repo [%s] received close event, quiting..", d.Meta.Repo))
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Create == fsnotify.Create && fsutil.IsDir(event.Name) {
+				d.watchRecursively(watcher, event.Name)
+			}
+			debounce.Reset(time.Millisecond * DirectoryDebounceInterval)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			d.logger.Warn(fmt.Sprintf("watcher error for directory %s %v", d.directory, err))
+		case <-debounce.C:
+			d.notify()
+		}
+	}
+}
+
+// RepoUpdated checks the directory immediately
+func (d *DirectoryRunner) RepoUpdated() {
+	d.notify()
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const DefaultLeaseDuration = 15
+
+// LeaderElector elects one leader among replicas by holding the lease in lease store,
+// the lease is renewed every 1/3 lease duration.
+type LeaderElector struct {
+	Identity      string
+	LeaseDuration time.Duration
+	store         LeaseStore
+	logger        *zap.Logger
+	mutex         sync.RWMutex
+	leading       bool
+	//closed when current leadership is lost
+	leadingChannel chan struct{}
+	//notified when leadership changed
+	changedChannel chan struct{}
+}
+
+func NewLeaderElector(identity string, leaseDuration int, store LeaseStore, logger *zap.Logger) *LeaderElector {
+	if leaseDuration <= 0 {
+		leaseDuration = DefaultLeaseDuration
+	}
+	return &LeaderElector{
+		Identity:       identity,
+		LeaseDuration:  time.Duration(leaseDuration) * time.Second,
+		store:          store,
+		logger:         logger,
+		changedChannel: make(chan struct{}),
+	}
+}
+
+func (e *LeaderElector) IsLeader() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.leading
+}
+
+// Leading returns a channel which is closed when current leadership is lost, nil if not leading
+func (e *LeaderElector) Leading() <-chan struct{} {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if !e.leading {
+		return nil
+	}
+	return e.leadingChannel
+}
+
+// Changed returns a channel which is closed when leadership changes next time
+func (e *LeaderElector) Changed() <-chan struct{} {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.changedChannel
+}
+
+// Leader returns the current lease holder
+func (e *LeaderElector) Leader() string {
+	lease, err := e.store.Get()
+	if err != nil || lease == nil || lease.Expire.Before(time.Now()) {
+		return ""
+	}
+	return lease.Holder
+}
+
+func (e *LeaderElector) setLeading(leading bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.leading == leading {
+		return
+	}
+	e.leading = leading
+	if leading {
+		e.leadingChannel = make(chan struct{})
+		e.logger.Info(fmt.Sprintf("replica %s started leading", e.Identity))
+	} else {
+		close(e.leadingChannel)
+		e.logger.Info(fmt.Sprintf("replica %s stopped leading", e.Identity))
+	}
+	close(e.changedChannel)
+	e.changedChannel = make(chan struct{})
+}
+
+func (e *LeaderElector) tryAcquireOrRenew() {
+	acquired, err := e.store.TryAcquire(e.Identity, e.LeaseDuration)
+	if err != nil {
+		e.logger.Error(fmt.Sprintf("replica %s failed to acquire lease %v", e.Identity, err))
+		//step down since we can't make sure the lease is still held
+		acquired = false
+	}
+	e.setLeading(acquired)
+}
+
+// Run performs election until context done, lease is released when quit
+func (e *LeaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.LeaseDuration / 3)
+	defer ticker.Stop()
+	e.tryAcquireOrRenew()
+	for {
+		select {
+		case <-ctx.Done():
+			if e.IsLeader() {
+				if err := e.store.Release(e.Identity); err != nil {
+					e.logger.Error(fmt.Sprintf("replica %s failed to release lease %v", e.Identity, err))
+				}
+			}
+			e.setLeading(false)
+			return
+		case <-ticker.C:
+			e.tryAcquireOrRenew()
+		}
+	}
+}
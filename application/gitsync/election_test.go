@@ -0,0 +1,152 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const electorHelperEnv = "GITSYNC_ELECTOR_HELPER"
+const testLeaseDuration = 2
+
+// TestElectorHelperProcess runs an elector in a child process, it reports whether it's leading in a state file
+func TestElectorHelperProcess(t *testing.T) {
+	if os.Getenv(electorHelperEnv) == "" {
+		return
+	}
+	leaseFile, identity, stateFile := os.Getenv("LEASE_FILE"), os.Getenv("IDENTITY"), os.Getenv("STATE_FILE")
+	store, err := NewFileLeaseStore(map[string]string{"leaseFile": leaseFile})
+	if err != nil {
+		os.Exit(1)
+	}
+	elector := NewLeaderElector(identity, testLeaseDuration, store, zap.NewNop())
+	go elector.Run(context.Background())
+	//quit eventually in case parent is gone
+	deadline := time.Now().Add(time.Minute)
+	for time.Now().Before(deadline) {
+		tmpFile := stateFile + ".tmp"
+		_ = ioutil.WriteFile(tmpFile, []byte(strconv.FormatBool(elector.IsLeader())), 0644)
+		_ = os.Rename(tmpFile, stateFile)
+		time.Sleep(50 * time.Millisecond)
+	}
+	os.Exit(0)
+}
+
+type electorProcess struct {
+	identity  string
+	stateFile string
+	cmd       *exec.Cmd
+}
+
+func (p *electorProcess) leading() bool {
+	content, _ := ioutil.ReadFile(p.stateFile)
+	return string(content) == "true"
+}
+
+func startElectorProcess(t *testing.T, folder, leaseFile, identity string) *electorProcess {
+	p := &electorProcess{identity: identity, stateFile: filepath.Join(folder, identity+".state")}
+	p.cmd = exec.Command(os.Args[0], "-test.run=^TestElectorHelperProcess$")
+	p.cmd.Env = append(os.Environ(), electorHelperEnv+"=1", "LEASE_FILE="+leaseFile, "IDENTITY="+identity,
+		"STATE_FILE="+p.stateFile)
+	if err := p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = p.cmd.Process.Kill()
+		_ = p.cmd.Wait()
+	})
+	return p
+}
+
+// waitForSingleLeader waits until exactly one alive process leads and the others follow
+func waitForSingleLeader(t *testing.T, processes []*electorProcess, timeout time.Duration) *electorProcess {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var leaders []*electorProcess
+		for _, p := range processes {
+			if p.leading() {
+				leaders = append(leaders, p)
+			}
+		}
+		if len(leaders) > 1 {
+			t.Fatalf("%d processes are leading at the same time", len(leaders))
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func TestLeaderElectionAmongProcesses(t *testing.T) {
+	folder, err := ioutil.TempDir("", "election")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	leaseFile := filepath.Join(folder, ".leader.lease")
+	var processes []*electorProcess
+	for i := 0; i < 3; i++ {
+		processes = append(processes, startElectorProcess(t, folder, leaseFile, fmt.Sprintf("replica-%d", i)))
+	}
+	leader := waitForSingleLeader(t, processes, 10*time.Second)
+	//leadership is stable while leader renews the lease
+	deadline := time.Now().Add(testLeaseDuration * 2 * time.Second)
+	for time.Now().Before(deadline) {
+		if waitForSingleLeader(t, processes, time.Second) != leader {
+			t.Fatal("leadership changed while leader is alive")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	store, _ := NewFileLeaseStore(map[string]string{"leaseFile": leaseFile})
+	lease, err := store.Get()
+	if err != nil || lease == nil || lease.Holder != leader.identity {
+		t.Fatalf("lease %v is not held by leader %s, err %v", lease, leader.identity, err)
+	}
+	//leader crashes without releasing the lease, followers take over after it expires
+	if err = leader.cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	_ = leader.cmd.Wait()
+	var alive []*electorProcess
+	for _, p := range processes {
+		if p != leader {
+			alive = append(alive, p)
+		}
+	}
+	newLeader := waitForSingleLeader(t, alive, testLeaseDuration*5*time.Second)
+	current, err := store.Get()
+	if err != nil || current == nil || current.Holder != newLeader.identity {
+		t.Fatalf("lease %v is not held by new leader %s, err %v", current, newLeader.identity, err)
+	}
+	//lease may be renewed after it's read, it expires no earlier than observed
+	if current.RenewTime.Before(lease.Expire) {
+		t.Fatalf("lease taken over at %v before it expired at %v", current.RenewTime, lease.Expire)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+// PluginInstance is one [[plugins.instances]] entry, settings besides the common ones are decoded by factory
+type PluginInstance struct {
+	//Registration name, it's used in logs, admin endpoints and auth policies
+	Name string `mapstructure:"name"`
+	//Plugin type registered with RegisterPluginFactory
+	Type string `mapstructure:"type"`
+	//Instance is enabled unless set to false, [plugins.<name>] is not required
+	Enabled *bool `mapstructure:"enabled"`
+	//Instance is served at /v1/metadata/<group>/<endpoint>, endpoint is name if empty
+	Group       string `mapstructure:"group"`
+	Endpoint    string `mapstructure:"endpoint"`
+	Description string `mapstructure:"description"`
+	Repo        string `mapstructure:"repo"`
+	Branch      string `mapstructure:"branch"`
+	settings    map[string]interface{}
+}
+
+// DecodeSettings decodes the whole instance config into target with mapstructure tags
+func (i *PluginInstance) DecodeSettings(target interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName:          "mapstructure",
+		WeaklyTypedInput: true,
+		Result:           target,
+	})
+	if err != nil {
+		return err
+	}
+	if err = decoder.Decode(i.settings); err != nil {
+		return errors.New(fmt.Sprintf("failed to decode settings of plugin instance %s %v", i.Name, err))
+	}
+	return nil
+}
+
+// PluginFactory creates plugin of instance, meta of plugin should follow the group, endpoint and repo of instance
+type PluginFactory func(instance *PluginInstance) (Plugin, error)
+
+var (
+	pluginFactoryMutex sync.RWMutex
+	pluginFactories    = map[string]PluginFactory{}
+)
+
+// RegisterPluginFactory used to for plugin type registration
+func RegisterPluginFactory(pluginType string, factory PluginFactory) {
+	pluginFactoryMutex.Lock()
+	defer pluginFactoryMutex.Unlock()
+	pluginFactories[pluginType] = factory
+}
+
+// PluginTypes returns all registered plugin types sorted
+func PluginTypes() []string {
+	pluginFactoryMutex.RLock()
+	defer pluginFactoryMutex.RUnlock()
+	types := make([]string, 0, len(pluginFactories))
+	for t := range pluginFactories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// LoadPluginInstances reads [[plugins.instances]] config, it doesn't register the plugins
+func LoadPluginInstances() ([]*PluginInstance, error) {
+	if !app.Config.Exists("plugins.instances") {
+		return nil, nil
+	}
+	entries, ok := app.Config.Get("plugins.instances").([]map[string]interface{})
+	if !ok {
+		return nil, errors.New("plugins.instances should be array of tables")
+	}
+	var instances []*PluginInstance
+	for index, entry := range entries {
+		instance := &PluginInstance{settings: entry}
+		if err := instance.DecodeSettings(instance); err != nil {
+			return nil, err
+		}
+		if instance.Name == "" || instance.Type == "" || instance.Group == "" {
+			return nil, errors.New(fmt.Sprintf("name, type and group are required for plugin instance %d", index))
+		}
+		if instance.Endpoint == "" {
+			instance.Endpoint = instance.Name
+		}
+		if instance.Repo != "" && GetRepoLocalName(instance.Repo) == "" {
+			return nil, errors.New(fmt.Sprintf("invalid repo %s of plugin instance %s", instance.Repo, instance.Name))
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// configurePlugin passes config decoded to plugin if it's configurable
+func configurePlugin(name string, plugin Plugin, decode func(target interface{}) error) error {
+	configurable, ok := plugin.(Configurable)
+	if !ok {
+		return nil
+	}
+	config := configurable.NewConfig()
+	if err := decode(config); err != nil {
+		return errors.New(fmt.Sprintf("failed to decode config of plugin %s %v", name, err))
+	}
+	if err := configurable.Configure(config); err != nil {
+		return errors.New(fmt.Sprintf("invalid config of plugin %s: %v", name, err))
+	}
+	return nil
+}
+
+// LoadConfiguredPlugins configures registered plugins enabled, then creates and registers plugin instances in
+// config, it should be called once after config loaded
+func LoadConfiguredPlugins() error {
+	names, registered := RegisteredPlugins()
+	for _, name := range names {
+		key := fmt.Sprintf("plugins.%s", name)
+		if enabled, _ := strconv.ParseBool(app.Config.StringMap(key)["enabled"]); !enabled {
+			continue
+		}
+		if err := configurePlugin(name, registered[name], func(target interface{}) error {
+			return app.Config.MapStruct(key, target)
+		}); err != nil {
+			return err
+		}
+	}
+	instances, err := LoadPluginInstances()
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if _, ok := registered[instance.Name]; ok {
+			return errors.New(fmt.Sprintf("plugin instance %s conflicts with registered plugin", instance.Name))
+		}
+		pluginFactoryMutex.RLock()
+		factory, ok := pluginFactories[instance.Type]
+		pluginFactoryMutex.RUnlock()
+		if !ok {
+			return errors.New(fmt.Sprintf("plugin type %s of instance %s not registered", instance.Type,
+				instance.Name))
+		}
+		plugin, err := factory(instance)
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to create plugin instance %s %v", instance.Name, err))
+		}
+		if err = configurePlugin(instance.Name, plugin, instance.DecodeSettings); err != nil {
+			return err
+		}
+		enabled := instance.Enabled == nil || *instance.Enabled
+		pluginMutex.Lock()
+		container := NewPluginContainer(plugin)
+		container.Name = instance.Name
+		container.Enabled = &enabled
+		pluginsContainer[instance.Name] = container
+		pluginMutex.Unlock()
+		registered[instance.Name] = plugin
+	}
+	return nil
+}
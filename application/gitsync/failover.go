@@ -0,0 +1,104 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"sync"
+)
+
+const DefaultFailoverThreshold = 3
+
+// remoteFailoverRunner is implemented by runners which sync from remotes with fail over
+type remoteFailoverRunner interface {
+	ActiveRemote() string
+	Failover() *RemoteFailover
+}
+
+// RemoteFailover keeps the ordered remotes of repo, the repo url first and then its mirrors. The next remote is
+// tried after Threshold consecutive failures of the active one.
+type RemoteFailover struct {
+	Remotes   []string
+	Threshold int
+	mutex     sync.Mutex
+	active    int
+	failures  int
+	failovers int
+}
+
+func NewRemoteFailover(repo *GitMeta) *RemoteFailover {
+	threshold := repo.FailoverThreshold
+	if threshold <= 0 {
+		threshold = DefaultFailoverThreshold
+	}
+	return &RemoteFailover{
+		Remotes:   append([]string{repo.RemoteURL()}, repo.Mirrors...),
+		Threshold: threshold,
+	}
+}
+
+// Active returns the remote in use
+func (f *RemoteFailover) Active() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.Remotes[f.active]
+}
+
+// Success resets failures of active remote
+func (f *RemoteFailover) Success() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures = 0
+}
+
+// Failure records a failure of active remote, true is returned if it's time to fail over
+func (f *RemoteFailover) Failure() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures += 1
+	return len(f.Remotes) > 1 && f.failures >= f.Threshold
+}
+
+// Candidates returns the other remotes in order, starting from the one next to active remote, primary repo is
+// tried again after the last mirror
+func (f *RemoteFailover) Candidates() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var candidates []string
+	for i := 1; i < len(f.Remotes); i++ {
+		candidates = append(candidates, f.Remotes[(f.active+i)%len(f.Remotes)])
+	}
+	return candidates
+}
+
+// Switch makes remote active, failures are reset even if remote is unknown so that active one is retried later
+func (f *RemoteFailover) Switch(remote string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures = 0
+	for i, r := range f.Remotes {
+		if r == remote && i != f.active {
+			f.active = i
+			f.failovers += 1
+			return true
+		}
+	}
+	return false
+}
+
+// Stats returns the index of active remote, consecutive failures and total failovers
+func (f *RemoteFailover) Stats() (int, int, int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.active, f.failures, f.failovers
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const SnapshotFolder = ".snapshots"
+const SnapshotDownloadTimeout = 120
+
+// SnapshotFollowerRunner downloads snapshot bundles of repo from primary instance instead of performing git sync,
+// the bundle is extracted and linked into the same folder layout as git sync does.
+type SnapshotFollowerRunner struct {
+	*BaseRunner
+	//snapshot api of repo on primary instance, for instance: http://primary:9500/v1/metadata/snapshots/group/repo
+	SnapshotEndpoint string
+	Headers          map[string]string
+	client           *http.Client
+	lastSynced       atomic.Value
+}
+
+func NewSnapshotFollowerRunner(group, parentFolder string, repo *GitMeta, eventChannel chan<- *GitEvent, interval int, logger *zap.Logger, snapshotEndpoint string, headers map[string]string) (*SnapshotFollowerRunner, error) {
+	base, err := NewBaseRunner(group, parentFolder, repo, eventChannel, interval, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotFollowerRunner{
+		BaseRunner:       base,
+		SnapshotEndpoint: snapshotEndpoint,
+		Headers:          headers,
+		client:           &http.Client{Timeout: time.Second * SnapshotDownloadTimeout},
+	}, nil
+}
+
+// LastSynced returns the last time when snapshot is confirmed to be up to date with primary
+func (f *SnapshotFollowerRunner) LastSynced() time.Time {
+	lastSynced := f.lastSynced.Load()
+	if lastSynced == nil {
+		return time.Time{}
+	}
+	return lastSynced.(time.Time)
+}
+
+// Pull downloads the snapshot if revision changed on primary
+func (f *SnapshotFollowerRunner) Pull(ctx context.Context) error {
+	request, err := http.NewRequest("GET", f.SnapshotEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	for k, v := range f.Headers {
+		request.Header.Set(k, v)
+	}
+	if f.Revision() != "" {
+		request.Header.Set("If-None-Match", fmt.Sprintf("\"%s\"", f.Revision()))
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		f.lastSynced.Store(time.Now())
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("unexpected status code %d from primary", response.StatusCode))
+	}
+	revision := response.Header.Get(SnapshotRevisionHeader)
+	if revision == "" {
+		return errors.New("snapshot revision missing in response")
+	}
+	target, err := f.newSnapshotFolder(revision)
+	if err != nil {
+		return err
+	}
+	if err = ExtractSnapshotBundle(response.Body, target); err != nil {
+		_ = os.RemoveAll(target)
+		return err
+	}
+	if err = f.switchLink(target); err != nil {
+		_ = os.RemoveAll(target)
+		return err
+	}
+	f.revision.Store(revision)
+	f.lastSynced.Store(time.Now())
+	f.logger.Info(fmt.Sprintf("snapshot of repo %s updated to revision %s", f.Meta.Repo, revision))
+	f.CompareDigestAndNotify()
+	f.cleanSnapshots(target)
+	return nil
+}
+
+func (f *SnapshotFollowerRunner) StartLoop() {
+	defer close(f.doneChannel)
+	if !f.markStarted() {
+		return
+	}
+	ctx, cancel := f.closeContext()
+	defer cancel()
+	for {
+		if err := f.Pull(ctx); err != nil && ctx.Err() == nil {
+			f.logger.Error(fmt.Sprintf("failed to pull snapshot of repo %s from %s %v", f.Meta.Repo,
+				f.SnapshotEndpoint, err))
+		}
+		if !f.schedule.Wait(ctx) {
+			f.logger.Info(fmt.Sprintf("follower runner for repo [%s] received close event, quiting..", f.Meta.Repo))
+			return
+		}
+	}
+}
+
+// RepoUpdated pulls snapshot immediately
+func (f *SnapshotFollowerRunner) RepoUpdated() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*SnapshotDownloadTimeout)
+	defer cancel()
+	if err := f.Pull(ctx); err != nil {
+		f.logger.Error(fmt.Sprintf("failed to pull snapshot of repo %s %v", f.Meta.Repo, err))
+	}
+}
@@ -1,139 +1,98 @@
 package gitsync
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"errors"
 	"fmt"
-	"github.com/gookit/goutil/fsutil"
 	"go.uber.org/zap"
-	"io"
+	"io/ioutil"
 	"math/rand"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 const SyncTimeout = 300 //5 minutes at most
-const DirectoryWalkTimeout = 30
-const DefaultSHA256 = "0000000000000000000000000000000000000000000000000000000000000000"
 const MaxDelay = 5
-const MaxCalculateFiles = 100
 
 type GitSyncRunner struct {
-	ParentFolder    string
-	Meta            *GitMeta
-	EventChannel    chan<- *GitEvent
-	CloseChannel    chan bool
-	SyncInterval    int
-	logger          *zap.Logger
-	watchFiles      map[string]string
-	group           string
+	*BaseRunner
 	gitSyncPath     string
 	WebhookEndpoint string
-	closed          bool
-}
-
-type HashResult struct {
-	path string
-	hash string
-	err  error
+	//invoked after repo updated and changes notified
+	updatedHook func()
+	failover    *RemoteFailover
 }
 
 func NewGitSyncRunner(group, parentFolder string, repo *GitMeta, eventChannel chan<- *GitEvent, interval int, logger *zap.Logger, gitSyncPath string, webhookEndpoint string) (*GitSyncRunner, error) {
-	if !fsutil.DirExist(parentFolder) {
-		return nil, errors.New(fmt.Sprintf("parent folder %s doesn't exist", parentFolder))
-	}
-	//convert relative path into abs
-	watchFiles := make(map[string]string)
-	for _, r := range repo.WatchFiles {
-		//NOTE:
-		//git sync will create a nested folder inside and perform file link switch when updated, therefore, the full
-		//file path would be like:
-		//repo: https://github.com/repo.git
-		//watch file: README.md
-		//group name: group1
-		//local repo path: /developing
-		//full file path: /developing/group1/repo/repo/README.md
-		path := filepath.Join(parentFolder, GetRepoLocalName(repo.Repo), r)
-		watchFiles[path] = DefaultSHA256
+	base, err := NewBaseRunner(group, parentFolder, repo, eventChannel, interval, logger)
+	if err != nil {
+		return nil, err
 	}
 	return &GitSyncRunner{
-		ParentFolder:    parentFolder,
-		Meta:            repo,
-		EventChannel:    eventChannel,
-		SyncInterval:    interval,
-		logger:          logger,
-		watchFiles:      watchFiles,
-		group:           group,
+		BaseRunner:      base,
 		gitSyncPath:     gitSyncPath,
-		CloseChannel:    make(chan bool, 1),
 		WebhookEndpoint: webhookEndpoint,
-		closed:          false,
+		failover:        NewRemoteFailover(repo),
 	}, nil
 }
 
 func (g *GitSyncRunner) RepoUpdated() {
 	g.logger.Info(fmt.Sprintf("repo %s commit id changed.", g.Meta.Repo))
+	g.failover.Success()
 	g.CompareDigestAndNotify()
-}
-
-func (g *GitSyncRunner) runCommand(ctx context.Context, cwd, command string, args ...string) (string, error) {
-	return g.runCommandWithStdin(ctx, cwd, "", command, args...)
-}
-
-func cmdForLog(command string, args ...string) string {
-	if strings.ContainsAny(command, " \t\n") {
-		command = fmt.Sprintf("%q", command)
+	g.updateRevision()
+	if g.updatedHook != nil {
+		g.updatedHook()
 	}
-	argsCopy := make([]string, len(args))
-	copy(argsCopy, args)
-	for i := range args {
-		if strings.ContainsAny(args[i], " \t\n") {
-			argsCopy[i] = fmt.Sprintf("%q", args[i])
-		}
-	}
-	return command + " " + strings.Join(argsCopy, " ")
 }
 
-func (g *GitSyncRunner) runCommandWithStdin(ctx context.Context, cwd, stdin, command string, args ...string) (string, error) {
-	cmdStr := cmdForLog(command, args...)
-	g.logger.Info(fmt.Sprintf("running command cwd %s cmd %s", cwd, cmdStr))
-
-	cmd := exec.CommandContext(ctx, command, args...)
-	if cwd != "" {
-		cmd.Dir = cwd
-	}
-	outbuf := bytes.NewBuffer(nil)
-	errbuf := bytes.NewBuffer(nil)
-	cmd.Stdout = outbuf
-	cmd.Stderr = errbuf
-	cmd.Stdin = bytes.NewBufferString(stdin)
-
-	err := cmd.Run()
-	stdout := outbuf.String()
-	stderr := errbuf.String()
-	if ctx.Err() == context.DeadlineExceeded {
-		return "", fmt.Errorf("run(%s): %w: { stdout: %q, stderr: %q }", cmdStr, ctx.Err(), stdout, stderr)
-	}
+func (g *GitSyncRunner) updateRevision() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*DirectoryWalkTimeout)
+	defer cancel()
+	revision, err := g.runCommand(ctx, g.RepoPath(), "git", "rev-parse", "HEAD")
 	if err != nil {
-		return "", fmt.Errorf("run(%s): %w: { stdout: %q, stderr: %q }", cmdStr, err, stdout, stderr)
+		g.logger.Error(fmt.Sprintf("failed to get revision of repo %s %v", g.Meta.Repo, err))
+		return
 	}
-	g.logger.Info(fmt.Sprintf("command result stdout %q, stderr %q", stdout, stderr))
+	g.revision.Store(strings.TrimSpace(revision))
+}
 
-	return stdout, nil
+// writeSparseCheckoutFile writes sparse checkout patterns next to the sync root, since the root is managed by git sync
+func (g *GitSyncRunner) writeSparseCheckoutFile(patterns []string) (string, error) {
+	sparseFile := fmt.Sprintf("%s.sparse-checkout", g.ParentFolder)
+	return sparseFile, ioutil.WriteFile(sparseFile, []byte(strings.Join(patterns, "\n")+"\n"), 0644)
 }
 
 func (g *GitSyncRunner) SyncRepo(ctx context.Context, onetime bool) bool {
-	args := []string{"--repo", g.Meta.Repo, "--root", g.ParentFolder, "--branch", g.Meta.Branch}
+	remote := g.failover.Active()
+	args := []string{"--repo", remote, "--root", g.ParentFolder, "--branch", g.Meta.Branch}
+	if remote != g.Meta.Repo {
+		//checkout folder is named after repo rather than mirror
+		args = append(args, []string{"--dest", GetRepoLocalName(g.Meta.Repo)}...)
+	}
+	if g.Meta.Rev != "" {
+		args = append(args, []string{"--rev", g.Meta.Rev}...)
+	}
 	if len(g.Meta.SubModules) != 0 {
 		args = append(args, []string{"--submodules", g.Meta.SubModules}...)
 	}
+	if g.Meta.Depth > 0 {
+		args = append(args, []string{"--depth", strconv.Itoa(g.Meta.Depth)}...)
+	}
+	if patterns := SparseCheckoutPatterns(g.Meta); len(patterns) != 0 {
+		sparseFile, err := g.writeSparseCheckoutFile(patterns)
+		if err != nil {
+			g.logger.Error(fmt.Sprintf("failed to write sparse checkout file for repo %s %v", g.Meta.Repo, err))
+			return false
+		}
+		args = append(args, []string{"--sparse-checkout-file", sparseFile}...)
+	}
+	if g.Meta.Filter != "" {
+		//fetches of promisor remote honor the partial clone filter
+		args = append(args, []string{"--git-config", fmt.Sprintf(
+			"remote.origin.promisor:true,remote.origin.partialclonefilter:\"%s\"", g.Meta.Filter)}...)
+	}
 	if !onetime {
 		//append webhook related parameters
 		args = append(args, []string{"-webhook-url", g.WebhookEndpoint, "-webhook-method", "GET", "--webhook-timeout", "2s"}...)
@@ -143,210 +102,140 @@ func (g *GitSyncRunner) SyncRepo(ctx context.Context, onetime bool) bool {
 	}
 	_, err := g.runCommand(ctx, "", g.gitSyncPath, args...)
 	if err != nil {
-		g.logger.Error(fmt.Sprintf("failed to perform git sync operation %s %v", g.Meta.Repo, err))
+		g.logger.Error(fmt.Sprintf("failed to perform git sync operation %s from %s %v", g.Meta.Repo, remote, err))
+		if ctx.Err() == nil && g.failover.Failure() {
+			g.failoverRemote(ctx)
+		}
 		return false
 	}
+	g.failover.Success()
 	return true
 }
 
-func (g *GitSyncRunner) CompareDigestAndNotify() {
-	var changedFiles []string
-	var newDigest string
-	var err error
-	for k := range g.watchFiles {
-		if fsutil.IsDir(k) {
-			newDigest = g.CalculateDigestForDirectory(k)
-			if newDigest == "" {
-				g.logger.Error(fmt.Sprintf("directory %s skipping watch", k))
-				continue
-			}
-		}
-		if fsutil.FileExist(k) {
-			newDigest, err = g.CalculateDigestForSingleFile(k)
-			if err != nil {
-				g.logger.Error(fmt.Sprintf("failed to calculate file digest, error %v. skipping watch", err))
-				continue
-			}
-		}
-		if newDigest != g.watchFiles[k] {
-			g.watchFiles[k] = newDigest
-			changedFiles = append(changedFiles, k)
-		}
-	}
-	if len(changedFiles) != 0 {
-		event := GitEvent{
-			RepoName:  g.Meta.Repo,
-			GroupName: g.group,
-			Files:     changedFiles,
-		}
-		g.logger.Info(fmt.Sprintf("new changes detected for repo %s, files %v", g.Meta.Repo, changedFiles))
-		g.EventChannel <- &event
-	}
+// ActiveRemote returns the remote which repo is synced from
+func (g *GitSyncRunner) ActiveRemote() string {
+	return g.failover.Active()
 }
 
-func (g *GitSyncRunner) CalculateDigestForSingleFile(filepath string) (string, error) {
-	f, err := os.Open(filepath)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	h := sha256.New()
-	if _, err = io.Copy(h, f); err != nil {
-		return "", err
-	}
-	return string(h.Sum(nil)), nil
+func (g *GitSyncRunner) Failover() *RemoteFailover {
+	return g.failover
 }
 
-func (g *GitSyncRunner) processFileHash(filePath string, done chan struct{}) (<-chan HashResult, <-chan error) {
-	resultChannel := make(chan HashResult, 20)
-	errorChannel := make(chan error, 1)
-	go func() {
-		var wg sync.WaitGroup
-		var files = 0
-		//NOTE: Improve the performance by calculating top N files only.
-		err := filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.Mode().IsRegular() {
-				return nil
-			}
-			files += 1
-			if files > MaxCalculateFiles {
-				g.logger.Warn(fmt.Sprintf("only %d files will be calculated for directiry digest,"+
-					"rest will be skipped", MaxCalculateFiles))
-				return nil
-			}
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				f, err := os.Open(path)
-				if err != nil {
-					resultChannel <- HashResult{path, "", err}
-					return
-				}
-				defer f.Close()
-				h := sha256.New()
-				if _, err := io.Copy(h, f); err != nil {
-					resultChannel <- HashResult{path, "", err}
-					return
-				}
-				resultChannel <- HashResult{path, string(h.Sum(nil)), nil}
-			}()
-			select {
-			case <-done: // HL
-				return errors.New(fmt.Sprintf("walk directory %s canceled", filePath))
-			default:
-				return nil
-			}
-		})
-		go func() {
-			wg.Wait()
-			close(resultChannel)
-			close(errorChannel)
-		}()
-		if err != nil {
-			errorChannel <- err
+// failoverRemote switches to the first candidate remote whose history is consistent with current checkout
+func (g *GitSyncRunner) failoverRemote(ctx context.Context) {
+	active := g.failover.Active()
+	for _, remote := range g.failover.Candidates() {
+		if err := g.checkHistory(ctx, remote); err != nil {
+			g.logger.Error(fmt.Sprintf("remote %s of repo %s skipped %v", remote, g.Meta.Repo, err))
+			continue
 		}
-	}()
-	return resultChannel, errorChannel
+		g.failover.Switch(remote)
+		g.logger.Warn(fmt.Sprintf("repo %s failed over from %s to %s", g.Meta.Repo, active, remote))
+		return
+	}
+	//retry active remote in next round
+	g.failover.Switch(active)
+	g.logger.Error(fmt.Sprintf("no remote of repo %s available for fail over", g.Meta.Repo))
 }
 
-func (g *GitSyncRunner) CalculateDigestForDirectory(filepath string) string {
-	var hashes []string
-	doneChannel := make(chan struct{})
-	resultChannel, errorChannel := g.processFileHash(filepath, doneChannel)
-	ticker := time.NewTimer(time.Duration(DirectoryWalkTimeout) * time.Second)
-	for {
-		select {
-		case <-ticker.C:
-			g.logger.Error(fmt.Sprintf("calculate directory %s hashes timed out",
-				filepath))
-			close(doneChannel)
-
-			return ""
-		case e, ok := <-errorChannel:
-			if ok {
-				g.logger.Error(fmt.Sprintf("failed to calculate %s hashes, error %v",
-					filepath, e))
-				close(doneChannel)
-				return ""
-			}
-		case result, ok := <-resultChannel:
-			if ok {
-				if result.err != nil {
-					g.logger.Warn(fmt.Sprintf("failed to calculate file digest %s due to error %v",
-						result.path, result.err))
-				} else {
-					//we only care about hash currently
-					hashes = append(hashes, result.hash)
-				}
-			} else {
-				//calculate result
-				sort.Strings(hashes)
-				g.logger.Info(fmt.Sprintf("%d files calculated for digesting directory %s", len(hashes),
-					filepath))
-				h := sha256.New()
-				for _, c := range hashes {
-					h.Write([]byte(c))
-				}
-				return string(h.Sum(nil))
-			}
-		}
+// checkHistory verifies that remote contains the current revision, so that fail over never rewrites history
+func (g *GitSyncRunner) checkHistory(ctx context.Context, remote string) error {
+	revision := g.Revision()
+	if revision == "" {
+		//nothing synced yet
+		return nil
+	}
+	ref := g.Meta.Branch
+	if g.Meta.Rev != "" {
+		ref = g.Meta.Rev
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, time.Second*SyncTimeout)
+	defer cancel()
+	if _, err := g.runCommand(checkCtx, g.RepoPath(), "git", "fetch", "--no-tags", remote, ref); err != nil {
+		return err
 	}
+	if _, err := g.runCommand(checkCtx, g.RepoPath(), "git", "merge-base", "--is-ancestor", revision,
+		"FETCH_HEAD"); err != nil {
+		return errors.New(fmt.Sprintf("history inconsistent, revision %s not found in %s", revision, ref))
+	}
+	return nil
 }
 
 func (g *GitSyncRunner) WatchSync(ctx context.Context) {
+	if g.schedule.Cron != "" {
+		g.watchScheduledSync(ctx)
+		return
+	}
 	retry := 1
 	for {
-		if g.closed {
+		if ctx.Err() != nil {
 			g.logger.Info(fmt.Sprintf("received cancel signal, quit git sync..."))
 			return
 		}
 		g.logger.Info(fmt.Sprintf("loop perform git sync (current: %d) for repo %s", retry, g.Meta.Repo))
-		//basically it won't quit unless program fails
+		//basically it won't quit unless program fails or canceled
 		_ = g.SyncRepo(ctx, false)
+		if ctx.Err() != nil {
+			continue
+		}
 		g.logger.Error(fmt.Sprintf("repo [%s] failed to sync, application will exit, check log for detail",
 			g.Meta.Repo))
 		retry += 1
 		rand.Seed(time.Now().UnixNano())
-		time.Sleep(time.Duration(rand.Intn(MaxDelay)) * time.Second)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(rand.Intn(MaxDelay)) * time.Second):
+		}
 	}
 }
 
-func (g *GitSyncRunner) StartLoop() {
-	//first clone or update
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*SyncTimeout)
-	success := g.SyncRepo(ctx, true)
-	if success {
-		g.logger.Info(fmt.Sprintf("repo [%s] successfully cloned", g.Meta.Repo))
-		g.CompareDigestAndNotify()
-		//start watching with cancel context
-		ctx, cancel := context.WithCancel(context.Background())
-		go g.WatchSync(ctx)
-		for {
-			select {
-			case _, ok := <-g.CloseChannel:
-				if !ok {
-					cancel()
-					time.Sleep(2 * time.Second)
-					g.logger.Info(fmt.Sprintf("git sync runner for repo [%s] received close event, quiting..",
-						g.Meta.Repo))
-					return
-				}
-			}
+// watchScheduledSync performs one time sync at scheduled time rather than keeping git sync running
+func (g *GitSyncRunner) watchScheduledSync(ctx context.Context) {
+	for g.schedule.Wait(ctx) {
+		g.logger.Info(fmt.Sprintf("scheduled git sync (%s) for repo %s", g.schedule, g.Meta.Repo))
+		syncCtx, syncCancel := context.WithTimeout(ctx, time.Second*SyncTimeout)
+		success := g.SyncRepo(syncCtx, true)
+		syncCancel()
+		if success {
+			g.RepoUpdated()
 		}
-	} else {
-		g.logger.Error(fmt.Sprintf("repo [%s] failed to clone", g.Meta.Repo))
 	}
+	g.logger.Info(fmt.Sprintf("received cancel signal, quit scheduled git sync..."))
 }
 
-func (g *GitSyncRunner) Close() error {
-	g.closed = true
-	close(g.CloseChannel)
-	return nil
-}
-
-func (g *GitSyncRunner) GetRepo() *GitMeta {
-	return g.Meta
+func (g *GitSyncRunner) StartLoop() {
+	defer close(g.doneChannel)
+	if !g.markStarted() {
+		return
+	}
+	ctx, cancel := g.closeContext()
+	defer cancel()
+	g.SyncAndWatch(ctx)
+	g.logger.Info(fmt.Sprintf("git sync runner for repo [%s] received close event, quiting..",
+		g.Meta.Repo))
+}
+
+// SyncAndWatch clones or updates repo first, then keeps repo synced until context done,
+// false is returned if repo failed to clone.
+func (g *GitSyncRunner) SyncAndWatch(ctx context.Context) bool {
+	//first clone or update, every remote is tried if repo has mirrors
+	attempts := 1
+	if len(g.failover.Remotes) > 1 {
+		attempts = g.failover.Threshold * len(g.failover.Remotes)
+	}
+	success := false
+	for i := 0; i < attempts && !success && ctx.Err() == nil; i++ {
+		syncCtx, syncCancel := context.WithTimeout(ctx, time.Second*SyncTimeout)
+		success = g.SyncRepo(syncCtx, true)
+		syncCancel()
+	}
+	if !success {
+		g.logger.Error(fmt.Sprintf("repo [%s] failed to clone", g.Meta.Repo))
+		return false
+	}
+	g.logger.Info(fmt.Sprintf("repo [%s] successfully cloned", g.Meta.Repo))
+	g.RepoUpdated()
+	//start watching until closed
+	g.WatchSync(ctx)
+	return true
 }
@@ -0,0 +1,301 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gookit/goutil/fsutil"
+)
+
+const SnapshotFile = "snapshot.json"
+
+// HASnapshotsKept is the number of published snapshots kept, followers may still be loading the previous ones
+const HASnapshotsKept = 3
+
+// Snapshot is published by leader after repo synced, followers load repo when snapshot revision changed
+type Snapshot struct {
+	Revision string `json:"revision"`
+	//Folder in snapshots folder which holds watch files of revision, it's never changed once published
+	Folder      string    `json:"folder"`
+	Publisher   string    `json:"publisher"`
+	PublishedAt time.Time `json:"publishedAt"`
+}
+
+// HARunner performs git sync when the replica is leading, otherwise follows the snapshot published by leader,
+// the repo folder should be shared among replicas.
+type HARunner struct {
+	*GitSyncRunner
+	elector *LeaderElector
+}
+
+func NewHARunner(runner *GitSyncRunner, elector *LeaderElector) *HARunner {
+	h := &HARunner{
+		GitSyncRunner: runner,
+		elector:       elector,
+	}
+	runner.updatedHook = h.publishSnapshot
+	return h
+}
+
+func (h *HARunner) snapshotPath() string {
+	return filepath.Join(h.ParentFolder, SnapshotFile)
+}
+
+// publishSnapshot copies watch files of the revision checked out into a new snapshot folder, followers load files
+// from it, since the checkout is changed by git sync of leader at any time.
+func (h *HARunner) publishSnapshot() {
+	if !h.elector.IsLeader() {
+		return
+	}
+	//resolve checkout once, so that revision and files published are consistent
+	root, err := filepath.EvalSymlinks(h.RepoPath())
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("failed to resolve checkout of repo %s %v", h.Meta.Repo, err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*DirectoryWalkTimeout)
+	defer cancel()
+	revision, err := checkoutRevision(ctx, root)
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("failed to publish snapshot of repo %s %v", h.Meta.Repo, err))
+		return
+	}
+	if published, err := h.ReadSnapshot(); err == nil && published != nil && published.Revision == revision {
+		return
+	}
+	target, err := h.newSnapshotFolder(revision)
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("failed to create snapshot folder for repo %s %v", h.Meta.Repo, err))
+		return
+	}
+	if err = linkWatchFiles(root, target, h.Meta.WatchFiles); err != nil {
+		_ = os.RemoveAll(target)
+		h.logger.Error(fmt.Sprintf("failed to copy watch files of repo %s %v", h.Meta.Repo, err))
+		return
+	}
+	content, err := json.Marshal(&Snapshot{
+		Revision:    revision,
+		Folder:      filepath.Base(target),
+		Publisher:   h.elector.Identity,
+		PublishedAt: time.Now(),
+	})
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("failed to encode snapshot for repo %s %v", h.Meta.Repo, err))
+		return
+	}
+	//write and rename to make sure followers never read partial snapshot
+	tmpFile := fmt.Sprintf("%s.%s", h.snapshotPath(), h.elector.Identity)
+	if err = ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		h.logger.Error(fmt.Sprintf("failed to write snapshot for repo %s %v", h.Meta.Repo, err))
+		return
+	}
+	if err = os.Rename(tmpFile, h.snapshotPath()); err != nil {
+		h.logger.Error(fmt.Sprintf("failed to publish snapshot for repo %s %v", h.Meta.Repo, err))
+		return
+	}
+	h.logger.Info(fmt.Sprintf("snapshot of repo %s published with revision %s", h.Meta.Repo, revision))
+	h.pruneSnapshots(HASnapshotsKept)
+}
+
+// pruneSnapshots removes published snapshots except the latest ones
+func (h *HARunner) pruneSnapshots(kept int) {
+	snapshotsPath := filepath.Join(h.ParentFolder, SnapshotFolder)
+	entries, err := ioutil.ReadDir(snapshotsPath)
+	if err != nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().After(entries[j].ModTime())
+	})
+	for i := kept; i < len(entries); i++ {
+		path := filepath.Join(snapshotsPath, entries[i].Name())
+		if err = os.RemoveAll(path); err != nil {
+			h.logger.Warn(fmt.Sprintf("failed to remove outdated snapshot %s %v", path, err))
+		}
+	}
+}
+
+// checkoutRevision returns commit id of git checkout in root
+func checkoutRevision(ctx context.Context, root string) (string, error) {
+	output, err := exec.CommandContext(ctx, "git", "-C", root, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to get revision of checkout %s %v", root, err))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// linkWatchFiles hard links watch files in root into target with the same layout, files are copied if they can't be
+// linked, watch files not existed are skipped.
+func linkWatchFiles(root, target string, watchFiles []string) error {
+	for _, watchFile := range watchFiles {
+		err := filepath.Walk(filepath.Join(root, watchFile), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			dest := filepath.Join(target, name)
+			if info.IsDir() {
+				return os.MkdirAll(dest, 0755)
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if os.Link(path, dest) == nil {
+				return nil
+			}
+			return copyFile(path, dest)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(source, dest string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ReadSnapshot reads the snapshot published by leader, nil if not published yet
+func (h *HARunner) ReadSnapshot() (*Snapshot, error) {
+	if !fsutil.FileExist(h.snapshotPath()) {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(h.snapshotPath())
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err = json.Unmarshal(content, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// loadSnapshot loads watch files from the snapshot folder published by leader, so that the content served always
+// matches the revision reported
+func (h *HARunner) loadSnapshot() {
+	snapshot, err := h.ReadSnapshot()
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("failed to read snapshot of repo %s %v", h.Meta.Repo, err))
+		return
+	}
+	if snapshot == nil || snapshot.Revision == h.Revision() {
+		return
+	}
+	folder := filepath.Join(h.ParentFolder, SnapshotFolder, snapshot.Folder)
+	if snapshot.Folder == "" || !fsutil.DirExist(folder) {
+		h.logger.Error(fmt.Sprintf("snapshot folder %s of repo %s not found", snapshot.Folder, h.Meta.Repo))
+		return
+	}
+	h.logger.Info(fmt.Sprintf("snapshot of repo %s changed to revision %s, published by %s", h.Meta.Repo,
+		snapshot.Revision, snapshot.Publisher))
+	h.compareDigestAndNotify(folder)
+	h.revision.Store(snapshot.Revision)
+}
+
+// follow loads snapshot periodically until leadership changed or context done
+func (h *HARunner) follow(ctx context.Context) {
+	changed := h.elector.Changed()
+	if h.elector.IsLeader() {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(h.SyncInterval) * time.Second)
+	defer ticker.Stop()
+	h.loadSnapshot()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			return
+		case <-ticker.C:
+			h.loadSnapshot()
+		}
+	}
+}
+
+// lead performs git sync until leadership lost or context done
+func (h *HARunner) lead(ctx context.Context, leading <-chan struct{}) {
+	leadCtx, leadCancel := context.WithCancel(ctx)
+	defer leadCancel()
+	go func() {
+		select {
+		case <-leading:
+		case <-leadCtx.Done():
+		}
+		leadCancel()
+	}()
+	h.logger.Info(fmt.Sprintf("start syncing repo %s as leader", h.Meta.Repo))
+	if !h.SyncAndWatch(leadCtx) {
+		//retry later
+		rand.Seed(time.Now().UnixNano())
+		select {
+		case <-leadCtx.Done():
+		case <-time.After(time.Duration(rand.Intn(MaxDelay)+1) * time.Second):
+		}
+	}
+}
+
+func (h *HARunner) StartLoop() {
+	defer close(h.doneChannel)
+	if !h.markStarted() {
+		return
+	}
+	ctx, cancel := h.closeContext()
+	defer cancel()
+	for ctx.Err() == nil {
+		if leading := h.elector.Leading(); leading != nil {
+			h.lead(ctx, leading)
+		} else {
+			h.follow(ctx)
+		}
+	}
+	h.logger.Info(fmt.Sprintf("ha runner for repo [%s] received close event, quiting..", h.Meta.Repo))
+}
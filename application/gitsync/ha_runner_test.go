@@ -0,0 +1,169 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed %v %s", args, err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func commitFile(t *testing.T, dir, name, content string) string {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", "-A")
+	runGit(t, dir, "commit", "-q", "-m", content)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+func newTestHARunner(t *testing.T, parent string, elector *LeaderElector, events chan *GitEvent) *HARunner {
+	repo := &GitMeta{Repo: "https://gitee.com/test/repo", WatchFiles: []string{"README.md"}}
+	runner, err := NewGitSyncRunner("group", parent, repo, events, 1, zap.NewNop(), "git-sync", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHARunner(runner, elector)
+}
+
+func readEventFile(t *testing.T, events chan *GitEvent) (string, string) {
+	select {
+	case event := <-events:
+		if len(event.Files) != 1 {
+			t.Fatalf("unexpected files %v", event.Files)
+		}
+		content, err := ioutil.ReadFile(event.Files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event.Files[0], string(content)
+	default:
+		t.Fatal("no event notified")
+	}
+	return "", ""
+}
+
+// syncWorktree simulates git sync, which clones revision into a new worktree, switches the link of repo and removes
+// the previous worktree
+func syncWorktree(t *testing.T, parent, origin, name string) {
+	worktree := filepath.Join(parent, name)
+	runGit(t, parent, "clone", "-q", origin, worktree)
+	previous, _ := os.Readlink(filepath.Join(parent, "repo"))
+	tmpLink := filepath.Join(parent, "repo.tmp")
+	if err := os.Symlink(worktree, tmpLink); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpLink, filepath.Join(parent, "repo")); err != nil {
+		t.Fatal(err)
+	}
+	if previous != "" {
+		_ = os.RemoveAll(previous)
+	}
+}
+
+func TestFollowerServesPublishedRevision(t *testing.T) {
+	parent, err := ioutil.TempDir("", "ha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	origin, err := ioutil.TempDir("", "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	runGit(t, origin, "init", "-q")
+	first := commitFile(t, origin, "README.md", "v1")
+	syncWorktree(t, parent, origin, "rev-1")
+	store, _ := NewFileLeaseStore(map[string]string{"leaseFile": filepath.Join(parent, ".leader.lease")})
+	leaderElector := NewLeaderElector("leader", testLeaseDuration, store, zap.NewNop())
+	followerElector := NewLeaderElector("follower", testLeaseDuration, store, zap.NewNop())
+	leaderElector.tryAcquireOrRenew()
+	followerElector.tryAcquireOrRenew()
+	if !leaderElector.IsLeader() || followerElector.IsLeader() {
+		t.Fatal("leader is not elected")
+	}
+	leader := newTestHARunner(t, parent, leaderElector, make(chan *GitEvent, 10))
+	followerEvents := make(chan *GitEvent, 10)
+	follower := newTestHARunner(t, parent, followerElector, followerEvents)
+
+	leader.publishSnapshot()
+	follower.loadSnapshot()
+	if follower.Revision() != first {
+		t.Fatalf("follower reports revision %s, expected %s", follower.Revision(), first)
+	}
+	firstFile, content := readEventFile(t, followerEvents)
+	if content != "v1" {
+		t.Fatalf("follower loads %q of revision %s", content, first)
+	}
+
+	//git sync of leader switches the checkout before the snapshot is published
+	second := commitFile(t, origin, "README.md", "v2")
+	syncWorktree(t, parent, origin, "rev-2")
+	follower.loadSnapshot()
+	if len(followerEvents) != 0 || follower.Revision() != first {
+		t.Fatal("follower loads content not published")
+	}
+	if content, err := ioutil.ReadFile(firstFile); err != nil || string(content) != "v1" {
+		t.Fatalf("content of published revision changed to %q, err %v", content, err)
+	}
+
+	leader.publishSnapshot()
+	follower.loadSnapshot()
+	if follower.Revision() != second {
+		t.Fatalf("follower reports revision %s, expected %s", follower.Revision(), second)
+	}
+	if _, content = readEventFile(t, followerEvents); content != "v2" {
+		t.Fatalf("follower loads %q of revision %s", content, second)
+	}
+
+	//outdated snapshots are pruned
+	for i, c := range []string{"v3", "v4", "v5"} {
+		commitFile(t, origin, "README.md", c)
+		syncWorktree(t, parent, origin, fmt.Sprintf("rev-%d", i+3))
+		leader.publishSnapshot()
+	}
+	snapshots, err := ioutil.ReadDir(filepath.Join(parent, SnapshotFolder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != HASnapshotsKept {
+		t.Fatalf("%d snapshots kept, expected %d", len(snapshots), HASnapshotsKept)
+	}
+	published, err := follower.ReadSnapshot()
+	if err != nil || published == nil {
+		t.Fatalf("snapshot not published %v", err)
+	}
+	if published.Revision != runGit(t, origin, "rev-parse", "HEAD") || published.Publisher != "leader" {
+		t.Fatalf("unexpected snapshot %v", published)
+	}
+}
@@ -60,6 +60,22 @@ func GetRepo(s []GitMeta, name string) *GitMeta {
 	return nil
 }
 
+// SparseCheckoutPatterns returns the sparse checkout patterns of repo, nil if sparse checkout is disabled
+func SparseCheckoutPatterns(meta *GitMeta) []string {
+	if !meta.Sparse {
+		return nil
+	}
+	paths := meta.SparsePaths
+	if len(paths) == 0 {
+		paths = meta.WatchFiles
+	}
+	patterns := make([]string, 0, len(paths))
+	for _, p := range paths {
+		patterns = append(patterns, "/"+strings.Trim(p, "/"))
+	}
+	return patterns
+}
+
 func StringInclude(s []string, name string) bool {
 	for _, a := range s {
 		if a == name {
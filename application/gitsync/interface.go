@@ -13,7 +13,11 @@ limitations under the License.
 
 package gitsync
 
-import "github.com/gin-gonic/gin"
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
 
 type RepoSchema string
 
@@ -26,19 +30,62 @@ type GitEvent struct {
 	GroupName string
 	RepoName  string
 	Files     []string
+	//Branch or tag of the checkout
+	Ref string
 }
 
+// SourceType is the name of registered source
+type SourceType string
+
 type GitMeta struct {
 	//Git repo to watch
 	Repo string
-	//Git branch
+	//Remote url synced instead of Repo, for instance, fork of staging, Repo is still the key of plugin files
+	Remote string
+	//Fallback remote urls of repo in order, for instance, github mirror of gitee repo
+	Mirrors []string
+	//Consecutive failures before failing over to the next remote, DefaultFailoverThreshold if 0
+	FailoverThreshold int
+	//Git branch, it's the default ref of repo
 	Branch string
+	//Extra branches or tags to watch, glob patterns such as v* are supported, every ref has its own checkout
+	Refs []string
+	//Ref watched by runner, set by manager
+	Ref string
+	//Tag to checkout when the ref is tag, set by manager
+	Rev string
+	//Clone depth, full history is fetched if 0
+	Depth int
+	//Whether to check out the sparse paths only
+	Sparse bool
+	//Paths checked out in sparse mode, WatchFiles are used if empty
+	SparsePaths []string
+	//Partial clone filter, for instance, blob:none
+	Filter string
+	//Seconds between syncs, the interval of manager is used if 0
+	SyncInterval int
+	//Cron expression, repo is synced only at scheduled time if set, for instance, "0 2 * * *"
+	Schedule string
 	//Whether to checkout submodules
 	SubModules string
 	//Git repo schema, https or ssh
 	Schema RepoSchema
 	//Files to watch, relatively
 	WatchFiles []string
+	//Where the repo is synced from, git sync is used if empty
+	Source SourceType
+	//Local path of repo or directory, used by local sources, or url of archive and bucket
+	Path string
+	//Extra options of source, for instance, endpoint and credentials of s3
+	Options map[string]string
+}
+
+// RemoteURL returns the url synced, Repo if not overridden
+func (g *GitMeta) RemoteURL() string {
+	if g.Remote != "" {
+		return g.Remote
+	}
+	return g.Repo
 }
 
 type GitMetaContainer struct {
@@ -63,6 +110,73 @@ type Plugin interface {
 	RegisterEndpoints(group *gin.RouterGroup)
 }
 
+type EndpointParameter struct {
+	//Parameter name
+	Name string
+	//Parameter location, query or path
+	In string
+	//Description for this parameter
+	Description string
+	//Whether the parameter is required, path parameters are always required
+	Required bool
+	//Schema type, string by default
+	Type string
+}
+
+type EndpointResponse struct {
+	//Http status code
+	Status int
+	//Description for this response
+	Description string
+	//Response content type, application/json by default
+	ContentType string
+	//JSON schema of the response body
+	Schema map[string]interface{}
+	//Example of the response body
+	Example interface{}
+}
+
+type Endpoint struct {
+	//Http method, GET by default
+	Method string
+	//Endpoint path relative to the plugin router group, gin style parameters(:name, *path) are supported
+	Path string
+	//Summary for this endpoint
+	Summary string
+	//Description for this endpoint
+	Description string
+	//Query and path parameters
+	Parameters []EndpointParameter
+	//Responses
+	Responses []EndpointResponse
+}
+
+// Documented is an optional interface for plugins which describe their endpoints,
+// the described endpoints will be published in the OpenAPI document.
+type Documented interface {
+	GetEndpoints() []Endpoint
+}
+
+// RefLoader is an optional interface for plugins which serve extra refs of repos, files of the default ref are
+// still passed to Load, while changes of every extra ref are passed to LoadRef separately.
+type RefLoader interface {
+	LoadRef(ref string, files map[string][]string) error
+}
+
+// Configurable is an optional interface for plugins which read settings from their config section, [plugins.<name>]
+// or the [[plugins.instances]] entry. The section is decoded into the struct returned by NewConfig with mapstructure
+// tags and passed to Configure before GetMeta is used, startup fails if Configure returns error.
+type Configurable interface {
+	NewConfig() interface{}
+	Configure(config interface{}) error
+}
+
+// Background is an optional interface for plugins which run background tasks, Start is called in a goroutine once
+// plugin is initialized, and ctx is cancelled when manager shuts down
+type Background interface {
+	Start(ctx context.Context)
+}
+
 type EventFilter interface {
 	StartLoop()
 }
@@ -72,4 +186,10 @@ type Runner interface {
 	StartLoop()
 	Close() error
 	RepoUpdated()
+	//Commit id currently served
+	Revision() string
+	//Local path of repo checkout
+	RepoPath() string
+	//Effective sync schedule
+	Schedule() *SyncSchedule
 }
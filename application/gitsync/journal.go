@@ -0,0 +1,388 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+const JournalFolder = ".audit"
+const JournalFile = "journal.log"
+const JournalLockFile = "journal.lock"
+const DefaultJournalMaxSize = 10
+const DefaultJournalMaxFiles = 5
+const DefaultAuditQueryLimit = 100
+
+const (
+	//Load of plugin, triggered by file changes or requested by admin
+	LoadAudit = "load"
+	//Admin action on plugin
+	AdminAudit = "admin"
+	//Sync trigger of repo
+	TriggerAudit = "trigger"
+)
+
+// AuditChange is the change of one repo loaded by plugin
+type AuditChange struct {
+	Repo   string   `json:"repo"`
+	Commit string   `json:"commit,omitempty"`
+	Files  []string `json:"files"`
+	//sha256 of changed files as loaded last time, empty if not loaded before
+	HashBefore string `json:"hashBefore,omitempty"`
+	HashAfter  string `json:"hashAfter"`
+}
+
+// AuditEntry is one record of audit journal
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Caller string    `json:"caller,omitempty"`
+	Action string    `json:"action"`
+	Plugin string    `json:"plugin,omitempty"`
+	//Extra ref loaded, empty for the default branch
+	Ref     string        `json:"ref,omitempty"`
+	Changes []AuditChange `json:"changes,omitempty"`
+	Detail  string        `json:"detail,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// AuditFilter selects entries of journal, empty fields match all
+type AuditFilter struct {
+	Kind   string
+	Plugin string
+	Repo   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (f *AuditFilter) match(entry *AuditEntry) bool {
+	if f.Kind != "" && f.Kind != entry.Kind {
+		return false
+	}
+	if f.Plugin != "" && !strings.EqualFold(f.Plugin, entry.Plugin) {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.Time.After(f.Until) {
+		return false
+	}
+	if f.Repo != "" {
+		for _, c := range entry.Changes {
+			if c.Repo == f.Repo {
+				return true
+			}
+		}
+		return strings.Contains(entry.Detail, f.Repo)
+	}
+	return true
+}
+
+type JournalConfig struct {
+	//Max size of journal file in MB before rotated
+	MaxSize int `mapstructure:"maxSize"`
+	//Max files kept including the current one
+	MaxFiles int `mapstructure:"maxFiles"`
+}
+
+// AuditJournal is an append-only journal of json lines, file is rotated to journal.log.1, journal.log.2... when it
+// exceeds max size. Replicas sharing base folder in HA mode append to the same files, appends and rotations are
+// serialized by lock of journal.lock
+type AuditJournal struct {
+	folder   string
+	maxSize  int64
+	maxFiles int
+	mutex    sync.Mutex
+	file     *os.File
+	lock     *os.File
+}
+
+// NewAuditJournal reads [audit] config and opens journal in folder
+func NewAuditJournal(folder string) (*AuditJournal, error) {
+	conf := JournalConfig{MaxSize: DefaultJournalMaxSize, MaxFiles: DefaultJournalMaxFiles}
+	if app.Config.Exists("audit") {
+		if err := app.Config.MapStruct("audit", &conf); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to decode audit config %v", err))
+		}
+	}
+	if conf.MaxSize <= 0 || conf.MaxFiles <= 0 {
+		return nil, errors.New(fmt.Sprintf("invalid audit journal maxSize %d maxFiles %d", conf.MaxSize,
+			conf.MaxFiles))
+	}
+	return newAuditJournal(folder, int64(conf.MaxSize)*1024*1024, conf.MaxFiles)
+}
+
+func newAuditJournal(folder string, maxSize int64, maxFiles int) (*AuditJournal, error) {
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(folder, JournalLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to open audit journal lock %v", err))
+	}
+	j := &AuditJournal{
+		folder:   folder,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		lock:     lock,
+	}
+	if err = j.open(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *AuditJournal) filename(index int) string {
+	if index == 0 {
+		return filepath.Join(j.folder, JournalFile)
+	}
+	return filepath.Join(j.folder, fmt.Sprintf("%s.%d", JournalFile, index))
+}
+
+func (j *AuditJournal) open() error {
+	f, err := os.OpenFile(j.filename(0), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to open audit journal %v", err))
+	}
+	j.file = f
+	return nil
+}
+
+// locked runs fn with lock of journal folder held, lock is process local only if file lock not supported
+func (j *AuditJournal) locked(fn func() error) error {
+	if fileLockSupported {
+		if err := lockFile(j.lock); err != nil {
+			return errors.New(fmt.Sprintf("failed to lock audit journal %v", err))
+		}
+		defer unlockFile(j.lock)
+	}
+	return fn()
+}
+
+// reopen opens journal file again if it's rotated by another replica since opened
+func (j *AuditJournal) reopen() error {
+	current, err := os.Stat(j.filename(0))
+	opened, openedErr := j.file.Stat()
+	if err == nil && openedErr == nil && os.SameFile(current, opened) {
+		return nil
+	}
+	j.file.Close()
+	return j.open()
+}
+
+// rotate shifts journal files and removes the oldest one
+func (j *AuditJournal) rotate() error {
+	j.file.Close()
+	_ = os.Remove(j.filename(j.maxFiles - 1))
+	for i := j.maxFiles - 2; i >= 0; i-- {
+		if _, err := os.Stat(j.filename(i)); err == nil {
+			if err = os.Rename(j.filename(i), j.filename(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if j.maxFiles == 1 {
+		_ = os.Remove(j.filename(0))
+	}
+	return j.open()
+}
+
+// Append writes entry to journal, entry time is set if empty
+func (j *AuditJournal) Append(entry *AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return errors.New("audit journal closed")
+	}
+	return j.locked(func() error {
+		if err := j.reopen(); err != nil {
+			return err
+		}
+		//size on disk includes entries of other replicas
+		info, err := j.file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() > 0 && info.Size()+int64(len(content)) > j.maxSize {
+			if err = j.rotate(); err != nil {
+				return errors.New(fmt.Sprintf("failed to rotate audit journal %v", err))
+			}
+		}
+		_, err = j.file.Write(content)
+		return err
+	})
+}
+
+// openFiles opens journal files newest first, opened files are read without lock since they survive rotation
+func (j *AuditJournal) openFiles() ([]*os.File, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	var files []*os.File
+	err := j.locked(func() error {
+		for i := 0; i < j.maxFiles; i++ {
+			f, err := os.Open(j.filename(i))
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+		}
+		return nil
+	})
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// Query returns entries matching filter, latest first
+func (j *AuditJournal) Query(filter *AuditFilter) ([]AuditEntry, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultAuditQueryLimit
+	}
+	files, err := j.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	entries := make([]AuditEntry, 0)
+	for _, f := range files {
+		if len(entries) >= limit {
+			break
+		}
+		var matched []AuditEntry
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var entry AuditEntry
+			//the last line may be partially written
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+			if filter.match(&entry) {
+				matched = append(matched, entry)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+		for k := len(matched) - 1; k >= 0 && len(entries) < limit; k-- {
+			entries = append(entries, matched[k])
+		}
+	}
+	return entries, nil
+}
+
+func (j *AuditJournal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	if j.lock != nil {
+		j.lock.Close()
+	}
+	return err
+}
+
+// watchRelativePath returns path of file relative to repo root, or file itself if it's not under any watch file
+func watchRelativePath(file string, watchFiles []string) string {
+	for _, w := range watchFiles {
+		w = strings.Trim(w, "/")
+		if strings.HasSuffix(file, "/"+w) {
+			return w
+		}
+		if index := strings.LastIndex(file, "/"+w+"/"); index >= 0 {
+			return file[index+1:]
+		}
+	}
+	return file
+}
+
+// contentDigests returns sha256 of every file, files in folders are included
+func contentDigests(files []string, watchFiles []string) map[string]string {
+	digests := make(map[string]string)
+	for _, file := range files {
+		_ = filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return nil
+			}
+			defer f.Close()
+			h := sha256.New()
+			if _, err = io.Copy(h, f); err == nil {
+				digests[watchRelativePath(path, watchFiles)] = hex.EncodeToString(h.Sum(nil))
+			}
+			return nil
+		})
+	}
+	return digests
+}
+
+// combinedDigest returns sha256 of the digests of names, empty if none of names has digest
+func combinedDigest(digests map[string]string, names []string) string {
+	sort.Strings(names)
+	h := sha256.New()
+	found := false
+	for _, name := range names {
+		if d, ok := digests[name]; ok {
+			found = true
+			fmt.Fprintf(h, "%s:%s\n", name, d)
+		}
+	}
+	if !found {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
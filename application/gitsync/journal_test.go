@@ -0,0 +1,100 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestJournalSharedByReplicas appends with two journals of the same folder like replicas sharing base folder in HA
+// mode, rotated files must not exceed max size and no entry is lost
+func TestJournalSharedByReplicas(t *testing.T) {
+	folder, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(folder) })
+	const maxSize, maxFiles, count = 512, 1000, 100
+	var journals []*AuditJournal
+	for i := 0; i < 2; i++ {
+		journal, err := newAuditJournal(folder, maxSize, maxFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = journal.Close() })
+		journals = append(journals, journal)
+	}
+	var wg sync.WaitGroup
+	for i, journal := range journals {
+		wg.Add(1)
+		go func(replica int, journal *AuditJournal) {
+			defer wg.Done()
+			for k := 0; k < count; k++ {
+				if err := journal.Append(&AuditEntry{Kind: AdminAudit, Action: "test",
+					Detail: fmt.Sprintf("%d-%d", replica, k)}); err != nil {
+					t.Errorf("replica %d failed to append %v", replica, err)
+					return
+				}
+			}
+		}(i, journal)
+	}
+	//queries don't block or fail appends
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if _, err := journals[0].Query(&AuditFilter{}); err != nil {
+				t.Errorf("failed to query while appending %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	for i := 1; i < maxFiles; i++ {
+		info, err := os.Stat(journals[0].filename(i))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxSize {
+			t.Errorf("rotated file %s has %d bytes, exceeds %d", info.Name(), info.Size(), maxSize)
+		}
+	}
+	entries, err := journals[1].Query(&AuditFilter{Limit: 4 * count})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]int{}
+	for _, entry := range entries {
+		seen[entry.Detail]++
+	}
+	for replica := 0; replica < 2; replica++ {
+		for k := 0; k < count; k++ {
+			if detail := fmt.Sprintf("%d-%d", replica, k); seen[detail] != 1 {
+				t.Errorf("entry %s found %d times, expected once", detail, seen[detail])
+			}
+		}
+	}
+}
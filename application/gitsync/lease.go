@@ -0,0 +1,162 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const FileLeaseStoreName = "file"
+
+type Lease struct {
+	Holder    string    `json:"holder"`
+	RenewTime time.Time `json:"renewTime"`
+	Expire    time.Time `json:"expire"`
+}
+
+type LeaseStore interface {
+	//Acquire or renew the lease for holder, return true if holder owns the lease
+	TryAcquire(holder string, duration time.Duration) (bool, error)
+	//Release the lease if it's owned by holder
+	Release(holder string) error
+	//Get current lease, nil if not existed
+	Get() (*Lease, error)
+}
+
+// LeaseStoreFactory creates lease store with the options in ha config section
+type LeaseStoreFactory func(options map[string]string) (LeaseStore, error)
+
+var (
+	leaseStoreMutex sync.RWMutex
+	leaseStores     = map[string]LeaseStoreFactory{
+		FileLeaseStoreName: NewFileLeaseStore,
+	}
+)
+
+// RegisterLeaseStore used to for lease store registration
+func RegisterLeaseStore(name string, factory LeaseStoreFactory) {
+	leaseStoreMutex.Lock()
+	defer leaseStoreMutex.Unlock()
+	leaseStores[name] = factory
+}
+
+func NewLeaseStore(name string, options map[string]string) (LeaseStore, error) {
+	leaseStoreMutex.RLock()
+	defer leaseStoreMutex.RUnlock()
+	factory, ok := leaseStores[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("lease store %s not registered", name))
+	}
+	return factory(options)
+}
+
+// FileLeaseStore keeps lease in a local file protected by file lock, it can be used by replicas
+// which share the same host or volume.
+type FileLeaseStore struct {
+	path string
+}
+
+func NewFileLeaseStore(options map[string]string) (LeaseStore, error) {
+	if !fileLockSupported {
+		return nil, errors.New("file lease store is not supported on this platform")
+	}
+	path := options["leaseFile"]
+	if path == "" {
+		return nil, errors.New("leaseFile is required for file lease store")
+	}
+	return &FileLeaseStore{path: path}, nil
+}
+
+// withLock opens lease file with exclusive lock and invokes fn with current lease
+func (f *FileLeaseStore) withLock(fn func(file *os.File, lease *Lease) error) error {
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = lockFile(file); err != nil {
+		return err
+	}
+	defer func() {
+		_ = unlockFile(file)
+	}()
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	var lease *Lease
+	if len(content) != 0 {
+		lease = &Lease{}
+		if err = json.Unmarshal(content, lease); err != nil {
+			//corrupted lease is treated as expired
+			lease = nil
+		}
+	}
+	return fn(file, lease)
+}
+
+func (f *FileLeaseStore) write(file *os.File, lease *Lease) error {
+	content, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	if err = file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(content, 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (f *FileLeaseStore) TryAcquire(holder string, duration time.Duration) (bool, error) {
+	acquired := false
+	err := f.withLock(func(file *os.File, lease *Lease) error {
+		now := time.Now()
+		if lease != nil && lease.Holder != holder && lease.Expire.After(now) {
+			return nil
+		}
+		acquired = true
+		return f.write(file, &Lease{
+			Holder:    holder,
+			RenewTime: now,
+			Expire:    now.Add(duration),
+		})
+	})
+	return acquired, err
+}
+
+func (f *FileLeaseStore) Release(holder string) error {
+	return f.withLock(func(file *os.File, lease *Lease) error {
+		if lease == nil || lease.Holder != holder {
+			return nil
+		}
+		return file.Truncate(0)
+	})
+}
+
+func (f *FileLeaseStore) Get() (*Lease, error) {
+	var current *Lease
+	err := f.withLock(func(file *os.File, lease *Lease) error {
+		current = lease
+		return nil
+	})
+	return current, err
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gookit/goutil/fsutil"
+	"go.uber.org/zap"
+)
+
+// LocalGitRunner clones local git repo or file:// bare repo and watches new commits on branch without network
+type LocalGitRunner struct {
+	*BaseRunner
+}
+
+func NewLocalGitRunner(group, parentFolder string, repo *GitMeta, eventChannel chan<- *GitEvent, interval int, logger *zap.Logger) (*LocalGitRunner, error) {
+	if repo.Path == "" {
+		return nil, errors.New(fmt.Sprintf("path is required for local git source of repo %s", repo.Repo))
+	}
+	base, err := NewBaseRunner(group, parentFolder, repo, eventChannel, interval, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalGitRunner{BaseRunner: base}, nil
+}
+
+func (l *LocalGitRunner) git(ctx context.Context, args ...string) (string, error) {
+	output, err := l.runCommand(ctx, l.RepoPath(), "git", args...)
+	return strings.TrimSpace(output), err
+}
+
+// clone local repo if checkout not existed
+func (l *LocalGitRunner) clone(ctx context.Context) error {
+	if fsutil.DirExist(fmt.Sprintf("%s/.git", l.RepoPath())) {
+		return nil
+	}
+	args := []string{"clone", "--no-checkout"}
+	if l.Meta.Branch != "" {
+		args = append(args, "--branch", l.Meta.Branch, "--single-branch")
+	}
+	source := l.Meta.Path
+	if l.Meta.Depth > 0 || l.Meta.Filter != "" {
+		//depth and filter are ignored by local clone unless file protocol is used
+		if abs, err := filepath.Abs(source); err == nil && !strings.Contains(source, "://") {
+			source = fmt.Sprintf("file://%s", abs)
+		}
+		if l.Meta.Depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(l.Meta.Depth))
+		}
+		if l.Meta.Filter != "" {
+			args = append(args, fmt.Sprintf("--filter=%s", l.Meta.Filter))
+		}
+	}
+	args = append(args, source, l.RepoPath())
+	_, err := l.runCommand(ctx, "", "git", args...)
+	return err
+}
+
+// updateSparseCheckout applies sparse checkout patterns before checkout
+func (l *LocalGitRunner) updateSparseCheckout(ctx context.Context) error {
+	patterns := SparseCheckoutPatterns(l.Meta)
+	if len(patterns) == 0 {
+		return nil
+	}
+	if _, err := l.git(ctx, "config", "core.sparseCheckout", "true"); err != nil {
+		return err
+	}
+	sparseFile := filepath.Join(l.RepoPath(), ".git", "info", "sparse-checkout")
+	if err := os.MkdirAll(filepath.Dir(sparseFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sparseFile, []byte(strings.Join(patterns, "\n")+"\n"), 0644)
+}
+
+// Sync fetches the branch from local repo and checks out if commit changed, true is returned if changed
+func (l *LocalGitRunner) Sync(ctx context.Context) (bool, error) {
+	if err := l.clone(ctx); err != nil {
+		return false, err
+	}
+	ref := l.Meta.Branch
+	if l.Meta.Rev != "" {
+		ref = l.Meta.Rev
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	args := []string{"fetch", "--force"}
+	if l.Meta.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(l.Meta.Depth))
+	}
+	if _, err := l.git(ctx, append(args, "origin", ref)...); err != nil {
+		return false, err
+	}
+	fetched, err := l.git(ctx, "rev-parse", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return false, err
+	}
+	if fetched == l.Revision() {
+		return false, nil
+	}
+	if err = l.updateSparseCheckout(ctx); err != nil {
+		return false, err
+	}
+	if _, err = l.git(ctx, "checkout", "--force", "--detach", fetched); err != nil {
+		return false, err
+	}
+	if len(l.Meta.SubModules) != 0 && l.Meta.SubModules != "off" {
+		if _, err = l.git(ctx, "submodule", "update", "--init", "--recursive"); err != nil {
+			return false, err
+		}
+	}
+	l.revision.Store(fetched)
+	return true, nil
+}
+
+func (l *LocalGitRunner) StartLoop() {
+	defer close(l.doneChannel)
+	if !l.markStarted() {
+		return
+	}
+	ctx, cancel := l.closeContext()
+	defer cancel()
+	for {
+		changed, err := l.Sync(ctx)
+		if err != nil && ctx.Err() == nil {
+			l.logger.Error(fmt.Sprintf("failed to sync local repo %s from %s %v", l.Meta.Repo, l.Meta.Path, err))
+		}
+		if changed {
+			l.logger.Info(fmt.Sprintf("local repo %s changed to revision %s", l.Meta.Repo, l.Revision()))
+			l.CompareDigestAndNotify()
+		}
+		if !l.schedule.Wait(ctx) {
+			l.logger.Info(fmt.Sprintf("local git runner for repo [%s] received close event, quiting..", l.Meta.Repo))
+			return
+		}
+	}
+}
+
+// RepoUpdated syncs local repo immediately
+func (l *LocalGitRunner) RepoUpdated() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*SyncTimeout)
+	defer cancel()
+	changed, err := l.Sync(ctx)
+	if err != nil {
+		l.logger.Error(fmt.Sprintf("failed to sync local repo %s %v", l.Meta.Repo, err))
+		return
+	}
+	if changed {
+		l.CompareDigestAndNotify()
+	}
+}
@@ -0,0 +1,30 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"errors"
+	"os"
+)
+
+// fileLockSupported is false since file lock is not implemented, file lease store can't be used on windows
+const fileLockSupported = false
+
+func lockFile(f *os.File) error {
+	return errors.New("file lock is not supported on windows")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
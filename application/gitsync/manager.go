@@ -14,21 +14,25 @@ limitations under the License.
 package gitsync
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/gookit/color"
 	"github.com/gookit/goutil/fsutil"
 	"github.com/opensourceways/app-community-metadata/app"
+	"github.com/opensourceways/app-community-metadata/application/middleware"
 	"go.uber.org/zap"
 	"math"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -59,58 +63,215 @@ type SyncManager struct {
 	gitSyncPath    string
 	validateID     int
 	enabledplugins map[string]*PluginContainer
+	apiDocument    atomic.Value
+	eventsDone     chan struct{}
+	elector        *LeaderElector
+	electionCancel context.CancelFunc
+	follower       *FollowerConfig
+	runnerMutex    sync.RWMutex
+	closing        bool
+	refsCancel     context.CancelFunc
+	//background tasks of plugins are stopped when cancelled
+	tasksCtx    context.Context
+	tasksCancel context.CancelFunc
+	//bounds of repo sync interval
+	minSyncInterval int
+	maxSyncInterval int
+	//authenticates requests of plugin endpoints, nil if auth disabled
+	authenticator *middleware.Authenticator
+	//runtime state of plugins changed by admin
+	stateMutex sync.Mutex
+	states     map[string]*PluginState
+	//journal of plugin loads, admin actions and triggers
+	journal *AuditJournal
+	//extra refs watched per repo at most
+	maxRefs int
+	//[[overrides]] of current env, validated at startup
+	overrides []RepoOverride
+}
+
+// FollowerConfig is used when instance follows the snapshots of primary instance rather than git repos
+type FollowerConfig struct {
+	//Base url of primary manager api, for instance: http://primary:9500/v1/metadata
+	Primary string
+	//Seconds to poll snapshots from primary
+	PollInterval int
+	//Instance is unready if any snapshot is not confirmed in seconds
+	MaxStaleness int
+	//Headers sent to primary, for instance, api key or bearer token required by snapshots policy of primary
+	Headers map[string]string
 }
 
 func NewSyncManager(routerGroup *gin.RouterGroup) (*SyncManager, error) {
 	conf := app.Config.StringMap("manager")
 	syncValue, _ := strconv.Atoi(conf["syncInterval"])
-	syncInterval := math.Min(float64(syncValue), app.DefaultInterval)
+	minSyncInterval, maxSyncInterval, err := syncIntervalBounds(conf)
+	if err != nil {
+		color.Error.Printf("%v\n", err)
+		return nil, err
+	}
+	if syncValue <= 0 {
+		syncValue = app.DefaultInterval
+	}
+	syncInterval := ClampInterval(syncValue, minSyncInterval, maxSyncInterval)
 	baseFolder := conf["baseFolder"]
 	if !fsutil.DirExist(baseFolder) {
 		color.Error.Printf("rsync folder %s not existed", baseFolder)
 		return nil, errors.New("rsync folder not existed")
 	}
 	baseFolder, _ = filepath.Abs(baseFolder)
+	follower, err := newFollowerConfig()
+	if err != nil {
+		color.Error.Printf("failed to initialize follower mode %v\n", err)
+		return nil, err
+	}
 	gitSyncPath, _ := conf["gitSyncPath"]
-	if !fsutil.FileExist(gitSyncPath) {
+	//git sync is not used in follower mode, repos from local sources don't require it as well
+	if follower == nil && !fsutil.FileExist(gitSyncPath) {
 		lookPath, err := exec.LookPath("git-sync")
 		if err != nil {
-			color.Error.Printf("git sync binary %s not found\n", lookPath)
-			return nil, errors.New(fmt.Sprintf("git sync binary %s not found. ", lookPath))
+			color.Warn.Printf("git sync binary not found, only repos of local sources can be synced\n")
+			lookPath = ""
 		}
 		gitSyncPath = lookPath
 	}
+	overrides, err := LoadRepoOverrides()
+	if err != nil {
+		color.Error.Printf("%v\n", err)
+		return nil, err
+	}
+	maxRefs, _ := strconv.Atoi(conf["maxRefs"])
+	if maxRefs <= 0 {
+		maxRefs = DefaultMaxRefs
+	}
 	notifyValue, _ := strconv.Atoi(conf["notifyInterval"])
 	notifyInterval := math.Min(float64(notifyValue), app.DefaultInterval)
 	color.Info.Printf(
-		"============ SyncManager(sync: %d notify: %d baseFolder: %s) ============\n",
-		int(syncInterval), int(notifyInterval), baseFolder)
+		"============ SyncManager(sync: %d[%d, %d] notify: %d baseFolder: %s) ============\n",
+		syncInterval, minSyncInterval, maxSyncInterval, int(notifyInterval), baseFolder)
 
 	//update plugin container's logger
 	for _, v := range pluginsContainer {
 		v.Logger = app.Logger
 	}
 
+	var elector *LeaderElector
+	if follower == nil {
+		elector, err = newLeaderElector(baseFolder)
+		if err != nil {
+			color.Error.Printf("failed to initialize leader election %v\n", err)
+			return nil, err
+		}
+	}
+
+	authenticator, err := middleware.NewAuthenticator()
+	if err != nil {
+		color.Error.Printf("failed to initialize authentication %v\n", err)
+		return nil, err
+	}
+
+	tasksCtx, tasksCancel := context.WithCancel(context.Background())
 	return &SyncManager{
-		SyncInterval:   int(syncInterval),
-		notifyInterval: int(notifyInterval),
-		baseFolder:     baseFolder,
-		eventCh:        make(chan *GitEvent, app.DefaultSyncChannelSize),
-		logger:         app.Logger,
-		Runners:        make(map[string]Runner),
-		events:         make(map[string]*GitEvent),
-		routerGroup:    routerGroup,
-		gitSyncPath:    gitSyncPath,
-		enabledplugins: make(map[string]*PluginContainer, len(pluginsContainer)),
+		SyncInterval:    syncInterval,
+		minSyncInterval: minSyncInterval,
+		maxSyncInterval: maxSyncInterval,
+		notifyInterval:  int(notifyInterval),
+		baseFolder:      baseFolder,
+		eventCh:         make(chan *GitEvent, app.DefaultSyncChannelSize),
+		logger:          app.Logger,
+		Runners:         make(map[string]Runner),
+		events:          make(map[string]*GitEvent),
+		routerGroup:     routerGroup,
+		gitSyncPath:     gitSyncPath,
+		enabledplugins:  make(map[string]*PluginContainer, len(pluginsContainer)),
+		eventsDone:      make(chan struct{}),
+		elector:         elector,
+		follower:        follower,
+		authenticator:   authenticator,
+		tasksCtx:        tasksCtx,
+		tasksCancel:     tasksCancel,
+		maxRefs:         maxRefs,
+		overrides:       overrides,
+	}, nil
+}
+
+// newFollowerConfig reads follower config when follower mode enabled, nil otherwise
+func newFollowerConfig() (*FollowerConfig, error) {
+	conf := app.Config.StringMap("follower")
+	if enabled, _ := strconv.ParseBool(conf["enabled"]); !enabled {
+		return nil, nil
+	}
+	if conf["primary"] == "" {
+		return nil, errors.New("primary is required in follower mode")
+	}
+	pollInterval, _ := strconv.Atoi(conf["pollInterval"])
+	if pollInterval <= 0 {
+		pollInterval = app.DefaultInterval
+	}
+	maxStaleness, _ := strconv.Atoi(conf["maxStaleness"])
+	if maxStaleness <= 0 {
+		maxStaleness = pollInterval * 5
+	}
+	headers := make(map[string]string)
+	if conf["apiKey"] != "" {
+		header := conf["apiKeyHeader"]
+		if header == "" {
+			header = middleware.DefaultAPIKeyHeader
+		}
+		headers[header] = conf["apiKey"]
+	}
+	if conf["token"] != "" {
+		headers["Authorization"] = fmt.Sprintf("Bearer %s", conf["token"])
+	}
+	color.Info.Printf("============ Follower mode enabled(primary: %s) ============\n", conf["primary"])
+	return &FollowerConfig{
+		Primary:      strings.TrimRight(conf["primary"], "/"),
+		PollInterval: pollInterval,
+		MaxStaleness: maxStaleness,
+		Headers:      headers,
 	}, nil
 }
 
+// newLeaderElector creates leader elector when ha mode enabled, nil otherwise
+func newLeaderElector(baseFolder string) (*LeaderElector, error) {
+	conf := app.Config.StringMap("ha")
+	if enabled, _ := strconv.ParseBool(conf["enabled"]); !enabled {
+		return nil, nil
+	}
+	storeName := conf["leaseStore"]
+	if storeName == "" {
+		storeName = FileLeaseStoreName
+	}
+	if conf["leaseFile"] == "" {
+		conf["leaseFile"] = filepath.Join(baseFolder, ".leader.lease")
+	}
+	store, err := NewLeaseStore(storeName, conf)
+	if err != nil {
+		return nil, err
+	}
+	identity := conf["identity"]
+	if identity == "" {
+		identity = fmt.Sprintf("%s-%d", app.Hostname, os.Getpid())
+	}
+	leaseDuration, _ := strconv.Atoi(conf["leaseDuration"])
+	color.Info.Printf("============ HA mode enabled(identity: %s store: %s) ============\n", identity, storeName)
+	return NewLeaderElector(identity, leaseDuration, store, app.Logger), nil
+}
+
 func (s *SyncManager) GetEnabledPlugins() map[string]*PluginContainer {
 	//return if initialized.
 	if len(s.enabledplugins) != 0 {
 		return s.enabledplugins
 	}
 	for name, instance := range pluginsContainer {
+		if instance.Enabled != nil {
+			if !*instance.Enabled {
+				s.logger.Info(fmt.Sprintf("Plugin [%s] disabled by instance config", name))
+				continue
+			}
+			s.enabledplugins[name] = instance
+			continue
+		}
 		cfg := app.Config.StringMap(fmt.Sprintf("plugins.%s", name))
 		if rs, ok := cfg["enabled"]; ok {
 			enabled, _ := strconv.ParseBool(rs)
@@ -136,11 +297,31 @@ func (s *SyncManager) OnePluginInitialized() bool {
 	return false
 }
 
+// IsReady returns true if any plugin is ready, in follower mode, all snapshots should be fresh as well
+func (s *SyncManager) IsReady() bool {
+	if !s.OnePluginInitialized() {
+		return false
+	}
+	if s.follower == nil {
+		return true
+	}
+	for key, r := range s.listRunners() {
+		if f, ok := r.(*SnapshotFollowerRunner); ok {
+			if time.Since(f.LastSynced()) > time.Duration(s.follower.MaxStaleness)*time.Second {
+				s.logger.Warn(fmt.Sprintf("snapshot of %s is stale, last synced at %v", key, f.LastSynced()))
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (s *SyncManager) initializePluginWhenReady(event *GitEvent) {
 	defer repoMutex.Unlock()
 	repoMutex.Lock()
+	initialized := false
 	//check whether plugin container is ready to register endpoint and handle message
-	for _, container := range s.GetEnabledPlugins() {
+	for name, container := range s.GetEnabledPlugins() {
 		if !container.Ready {
 			//filter out mismatch router plugins
 			if event.GroupName == container.Plugin.GetMeta().Group {
@@ -159,14 +340,31 @@ func (s *SyncManager) initializePluginWhenReady(event *GitEvent) {
 				}
 				if readyRepos == len(container.Plugin.GetMeta().Repos) {
 					//Register endpoints
-					container.Plugin.RegisterEndpoints(s.routerGroup.Group(container.Plugin.GetMeta().Group).Group(container.Plugin.GetMeta().Name))
+					pluginGroup := s.routerGroup.Group(container.Plugin.GetMeta().Group).Group(container.Plugin.GetMeta().Name)
+					pluginGroup.Use(pluginStateMiddleware(container))
+					if s.authenticator != nil {
+						pluginGroup.Use(s.authenticator.Middleware(container.Plugin.GetMeta().Group,
+							container.Plugin.GetMeta().Name, pluginGroup.BasePath()))
+					}
+					container.Plugin.RegisterEndpoints(pluginGroup)
 					go container.StartLoop()
+					if background, ok := container.Plugin.(Background); ok {
+						go background.Start(s.tasksCtx)
+					}
 					container.Ready = true
+					if container.Pins() != nil {
+						go s.loadPinnedPlugin(name, container)
+					}
+					initialized = true
 					s.logger.Info(fmt.Sprintf("plugin %s/%s initialized.", container.Plugin.GetMeta().Group, container.Plugin.GetMeta().Name))
 				}
 			}
 		}
 	}
+	//regenerate openapi document for newly registered endpoints
+	if initialized {
+		s.RefreshOpenAPIDocument()
+	}
 }
 
 func (s *SyncManager) dispatchEvents(event *GitEvent) {
@@ -189,7 +387,9 @@ func Register(pluginName string, plugin Plugin) {
 	pluginMutex.Lock()
 	defer pluginMutex.Unlock()
 	//update plugin
-	pluginsContainer[pluginName] = NewPluginContainer(plugin)
+	container := NewPluginContainer(plugin)
+	container.Name = pluginName
+	pluginsContainer[pluginName] = container
 }
 
 // Update repo container to hold all repo and watch files
@@ -206,10 +406,35 @@ func updateRepoContainer(group, localName string, repo GitMeta) {
 			}
 			if !equal {
 				color.Error.Printf(
-					"repo %s skipped due to the existence of same local repo while remote url differs %s and %s",
+					"repo skipped due to the existence of same local repo while remote url differs %s and %s",
 					g.Meta.Repo, repo.Repo)
 			} else {
 				g.Meta.WatchFiles = append(g.Meta.WatchFiles, repo.WatchFiles...)
+				g.Meta.Refs = append(g.Meta.Refs, repo.Refs...)
+				for _, mirror := range repo.Mirrors {
+					if !StringInclude(g.Meta.Mirrors, mirror) {
+						g.Meta.Mirrors = append(g.Meta.Mirrors, mirror)
+					}
+				}
+				if repo.FailoverThreshold > 0 && (g.Meta.FailoverThreshold <= 0 ||
+					repo.FailoverThreshold < g.Meta.FailoverThreshold) {
+					g.Meta.FailoverThreshold = repo.FailoverThreshold
+				}
+				//checkout shared by plugins should satisfy all of them
+				g.Meta.SparsePaths = append(g.Meta.SparsePaths, repo.SparsePaths...)
+				g.Meta.Sparse = g.Meta.Sparse && repo.Sparse
+				if g.Meta.Depth != repo.Depth {
+					g.Meta.Depth = 0
+				}
+				if g.Meta.Filter != repo.Filter {
+					g.Meta.Filter = ""
+				}
+				if repo.SyncInterval > 0 && (g.Meta.SyncInterval <= 0 || repo.SyncInterval < g.Meta.SyncInterval) {
+					g.Meta.SyncInterval = repo.SyncInterval
+				}
+				if g.Meta.Schedule != repo.Schedule {
+					g.Meta.Schedule = ""
+				}
 			}
 		} else {
 			r[localName] = &GitMetaContainer{
@@ -242,18 +467,69 @@ func PluginDetails(c *gin.Context) {
 	c.JSON(200, data)
 }
 
+// Status reports the role of this replica and the revision of each repo it's serving
+func (s *SyncManager) Status(c *gin.Context) {
+	repos := make([]map[string]string, 0)
+	for key, r := range s.listRunners() {
+		repo := map[string]string{
+			"name":       key,
+			"repo":       r.GetRepo().Repo,
+			"url":        r.GetRepo().RemoteURL(),
+			"branch":     r.GetRepo().Branch,
+			"submodules": r.GetRepo().SubModules,
+			"ref":        r.GetRepo().Ref,
+			"revision":   r.Revision(),
+			"schedule":   r.Schedule().String(),
+			"nextSync":   formatTime(r.Schedule().NextSync()),
+		}
+		if f, ok := r.(remoteFailoverRunner); ok {
+			repo["remote"] = f.ActiveRemote()
+		}
+		repos = append(repos, repo)
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i]["name"] < repos[j]["name"]
+	})
+	data := map[string]interface{}{
+		"role":  "standalone",
+		"repos": repos,
+	}
+	if s.follower != nil {
+		data["role"] = "follower"
+		data["primary"] = s.follower.Primary
+	}
+	if s.elector != nil {
+		data["identity"] = s.elector.Identity
+		data["leader"] = s.elector.Leader()
+		if s.elector.IsLeader() {
+			data["role"] = "leader"
+		} else {
+			data["role"] = "follower"
+		}
+	}
+	c.JSON(200, data)
+}
+
 func (s *SyncManager) repoUpdateNotify(c *gin.Context) {
 	validateID := c.Query("validateID")
 	//only allowed from local
-	if c.ClientIP() != loopbackAddress || validateID != strconv.Itoa(s.validateID) {
+	if middleware.ClientIP(c) != loopbackAddress || validateID != strconv.Itoa(s.validateID) {
 		c.JSON(403, nil)
 		return
 	}
 	group := c.Param("group")
 	localName := c.Param("localname")
 
-	if r, ok := s.Runners[fmt.Sprintf("%s/%s", group, localName)]; ok {
+	if r, ok := s.getRunner(fmt.Sprintf("%s/%s", group, localName)); ok {
 		r.RepoUpdated()
+		if err := s.journal.Append(&AuditEntry{
+			Kind:   TriggerAudit,
+			Caller: fmt.Sprintf("internal:%s", middleware.ClientIP(c)),
+			Action: "sync",
+			Detail: fmt.Sprintf("repo %s revision %s", r.GetRepo().Repo, r.Revision()),
+		}); err != nil {
+			s.logger.Error(fmt.Sprintf("failed to record trigger of %s/%s %v", group, localName, err))
+		}
 		c.JSON(200, nil)
 		return
 	} else {
@@ -264,14 +540,35 @@ func (s *SyncManager) repoUpdateNotify(c *gin.Context) {
 }
 
 func (s *SyncManager) getRepoTriggerEndpoint(group, localName string) string {
+	port := app.TriggerPort
+	if port == 0 {
+		port = app.HttpPort
+	}
 	return fmt.Sprintf("http://%s:%d%s/repos/%s/%s/trigger?validateID=%d",
-		loopbackAddress, app.HttpPort, s.routerGroup.BasePath(), group, localName, s.validateID)
+		loopbackAddress, port, s.routerGroup.BasePath(), group, localName, s.validateID)
 }
 
 func (s *SyncManager) Initialize() error {
 	s.validateID = time.Now().Nanosecond()
 	s.routerGroup.GET("/plugins", PluginDetails)
+	s.routerGroup.GET("/status", s.Status)
+	s.routerGroup.GET("/metrics", s.Metrics)
 	s.routerGroup.GET("/repos/:group/:localname/trigger", s.repoUpdateNotify)
+	if err := s.registerSnapshotEndpoints(); err != nil {
+		return err
+	}
+	journal, err := NewAuditJournal(filepath.Join(s.baseFolder, JournalFolder))
+	if err != nil {
+		return err
+	}
+	s.journal = journal
+	for _, container := range s.GetEnabledPlugins() {
+		container.Journal = s.journal
+		container.Revision = s.repoRevision(container.Plugin.GetMeta().Group)
+	}
+	if err = s.loadPluginStates(); err != nil {
+		return err
+	}
 	//update repo container
 	for _, plugin := range s.GetEnabledPlugins() {
 		for _, repo := range plugin.Plugin.GetMeta().Repos {
@@ -279,11 +576,25 @@ func (s *SyncManager) Initialize() error {
 			if localName == "" {
 				color.Error.Printf("Failed to get local name of %s", repo.Repo)
 			}
+			ApplySourceConfig(&repo)
+			ApplyRepoConfig(&repo)
+			ApplyRepoOverride(&repo, s.overrides)
 			updateRepoContainer(plugin.Plugin.GetMeta().Group, localName, repo)
 			s.logger.Info(fmt.Sprintf("Plugin [%s/%s] registered to manager %s", plugin.Plugin.GetMeta().Group, plugin.Plugin.GetMeta().Name,
 				localName))
 		}
 	}
+	//repos synced by git sync can't start without the binary
+	if s.follower == nil && s.gitSyncPath == "" {
+		for group, metas := range repoContainer {
+			for _, meta := range metas {
+				if meta.Meta.Source == "" || meta.Meta.Source == GitSyncSource {
+					return errors.New(fmt.Sprintf("git sync binary not found, it's required by repo %s in group %s",
+						meta.Meta.Repo, group))
+				}
+			}
+		}
+	}
 	//initialize repo container with runner
 	for group, metas := range repoContainer {
 		groupPath := path.Join(s.baseFolder, group)
@@ -296,35 +607,162 @@ func (s *SyncManager) Initialize() error {
 			localPath := filepath.Join(groupPath, localName)
 			err := fsutil.Mkdir(localPath, os.FileMode(0755))
 			if err != nil {
-				s.logger.Error(fmt.Sprintf("failed to create folder for repo: %s", meta.Meta))
+				s.logger.Error(fmt.Sprintf("failed to create folder for repo: %s", meta.Meta.Repo))
 				continue
 			}
-			r, err := NewGitSyncRunner(group, localPath, meta.Meta, s.eventCh, s.SyncInterval, s.logger, s.gitSyncPath,
-				s.getRepoTriggerEndpoint(group, localName))
+			meta.Meta.Ref = meta.Meta.Branch
+			r, err := s.newRunner(group, localName, localPath, meta.Meta)
 			if err != nil {
 				s.logger.Error(fmt.Sprintf("failed to create runner for repo: %s, err: %v", meta.Meta.Repo, err))
 				continue
 			}
-
-			s.Runners[fmt.Sprintf("%s/%s", group, localName)] = r
+			s.addRunner(fmt.Sprintf("%s/%s", group, localName), r, false)
 		}
 	}
-	if len(s.Runners) == 0 {
+	//extra refs found later are added when watching refs
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*RefResolveTimeout)
+	s.syncRefs(ctx, false)
+	cancel()
+	if len(s.listRunners()) == 0 {
 		return errors.New("no plugin configured")
 	}
 	s.logger.Info("sync manager successfully started")
 	return nil
 }
 
+// repoRevision returns the function to get checkout revision of repo in group
+func (s *SyncManager) repoRevision(group string) func(repo string) string {
+	return func(repo string) string {
+		if r, ok := s.getRunner(fmt.Sprintf("%s/%s", group, GetRepoLocalName(repo))); ok {
+			return r.Revision()
+		}
+		return ""
+	}
+}
+
+func (s *SyncManager) getRunner(key string) (Runner, bool) {
+	s.runnerMutex.RLock()
+	defer s.runnerMutex.RUnlock()
+	r, ok := s.Runners[key]
+	return r, ok
+}
+
+// listRunners returns a copy of runners, since runners of new refs can be added at any time
+func (s *SyncManager) listRunners() map[string]Runner {
+	s.runnerMutex.RLock()
+	defer s.runnerMutex.RUnlock()
+	runners := make(map[string]Runner, len(s.Runners))
+	for k, v := range s.Runners {
+		runners[k] = v
+	}
+	return runners
+}
+
+// addRunner adds runner unless manager is shutting down, false is returned if not added
+func (s *SyncManager) addRunner(key string, r Runner, start bool) bool {
+	s.runnerMutex.Lock()
+	defer s.runnerMutex.Unlock()
+	if s.closing {
+		return false
+	}
+	s.Runners[key] = r
+	if start {
+		go r.StartLoop()
+	}
+	return true
+}
+
+// removeRunner removes runner unless manager is shutting down, false is returned if not removed
+func (s *SyncManager) removeRunner(key string) (Runner, bool) {
+	s.runnerMutex.Lock()
+	defer s.runnerMutex.Unlock()
+	r, ok := s.Runners[key]
+	if !ok || s.closing {
+		return nil, false
+	}
+	delete(s.Runners, key)
+	return r, true
+}
+
+func (s *SyncManager) hasRefs() bool {
+	for _, metas := range repoContainer {
+		for _, m := range metas {
+			if len(m.Meta.Refs) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// repoSchedule returns the effective schedule of repo, interval of repo overrides the manager's within bounds
+func (s *SyncManager) repoSchedule(meta *GitMeta) (*SyncSchedule, error) {
+	interval := meta.SyncInterval
+	if interval <= 0 {
+		interval = s.SyncInterval
+	}
+	return NewSyncSchedule(interval, meta.Schedule, s.minSyncInterval, s.maxSyncInterval)
+}
+
+// newRunner creates runner for repo according to the mode of instance
+func (s *SyncManager) newRunner(group, localName, localPath string, meta *GitMeta) (Runner, error) {
+	if s.follower != nil {
+		return NewSnapshotFollowerRunner(group, localPath, meta, s.eventCh, s.follower.PollInterval, s.logger,
+			fmt.Sprintf("%s/snapshots/%s/%s", s.follower.Primary, group, localName), s.follower.Headers)
+	}
+	source, err := GetSource(meta.Source)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := s.repoSchedule(meta)
+	if err != nil {
+		return nil, err
+	}
+	r, err := source.NewRunner(&SourceOptions{
+		Group:           group,
+		LocalName:       localName,
+		ParentFolder:    localPath,
+		Meta:            meta,
+		EventChannel:    s.eventCh,
+		Interval:        schedule.Interval,
+		Logger:          s.logger,
+		GitSyncPath:     s.gitSyncPath,
+		WebhookEndpoint: s.getRepoTriggerEndpoint(group, localName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if scheduled, ok := r.(interface{ SetSchedule(*SyncSchedule) }); ok {
+		scheduled.SetSchedule(schedule)
+	}
+	//only repos synced by git sync are shared among replicas
+	if g, ok := r.(*GitSyncRunner); ok && s.elector != nil {
+		return NewHARunner(g, s.elector), nil
+	}
+	return r, nil
+}
+
 func (s *SyncManager) StartLoop() {
+	//start leader election before runners
+	if s.elector != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.electionCancel = cancel
+		go s.elector.Run(ctx)
+	}
 	//start sync worker
-	for _, r := range s.Runners {
+	runners := s.listRunners()
+	for _, r := range runners {
 		go r.StartLoop()
 	}
-	if len(s.Runners) == 0 {
+	if len(runners) == 0 {
 		s.logger.Error(fmt.Sprintf("no sync runner available"))
 		return
 	}
+	if s.hasRefs() {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.refsCancel = cancel
+		go s.watchRefs(ctx)
+	}
 	// start loop to receive channel event
 	go s.handleEvents()
 }
@@ -333,7 +771,9 @@ func (s *SyncManager) handleEvents() {
 	//1. collect event from worker
 	//2. push events on notify event
 	//3. register endpoint on first ready event
+	defer close(s.eventsDone)
 	ticker := time.NewTicker(time.Duration(s.notifyInterval) * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case event, ok := <-s.eventCh:
@@ -343,7 +783,8 @@ func (s *SyncManager) handleEvents() {
 			eventHandled := false
 			if g, ok := repoContainer[event.GroupName]; ok {
 				if r, ok := g[GetRepoLocalName(event.RepoName)]; ok {
-					if !r.Ready {
+					//repo is ready when its default ref synced
+					if !r.Ready && event.Ref == r.Meta.Ref {
 						s.logger.Info(fmt.Sprintf("repo %s initialized.", r.Meta.Repo))
 						r.Ready = true
 					}
@@ -362,16 +803,71 @@ func (s *SyncManager) handleEvents() {
 	}
 }
 
-func (s *SyncManager) Close() {
-	//close worker
-	for key, runner := range s.Runners {
-		if err := runner.Close(); err != nil {
-			s.logger.Error(fmt.Sprintf("failed to git runner for repo: %s, will be skipped", key))
-		}
+// Shutdown stops all runners and waits for plugin containers to finish their current Load until context done
+func (s *SyncManager) Shutdown(ctx context.Context) error {
+	//close worker, git sync processes are terminated in parallel
+	if s.refsCancel != nil {
+		s.refsCancel()
+	}
+	s.tasksCancel()
+	s.runnerMutex.Lock()
+	s.closing = true
+	s.runnerMutex.Unlock()
+	var wg sync.WaitGroup
+	var alive int32
+	for key, runner := range s.listRunners() {
+		wg.Add(1)
+		go func(key string, runner Runner) {
+			defer wg.Done()
+			if err := runner.Close(); err != nil {
+				atomic.AddInt32(&alive, 1)
+				s.logger.Error(fmt.Sprintf("failed to close git runner for repo: %s, err: %v", key, err))
+			}
+		}(key, runner)
+	}
+	runnersClosed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(runnersClosed)
+	}()
+	select {
+	case <-runnersClosed:
+	case <-ctx.Done():
+		return errors.New("timed out waiting for git runners to quit")
+	}
+	//runners still alive may send events, event channel is left open
+	if alive != 0 {
+		return errors.New(fmt.Sprintf("%d git runners not quit", alive))
+	}
+	//release lease after git sync quit, so that the new leader won't sync with us at the same time
+	if s.electionCancel != nil {
+		s.electionCancel()
+	}
+	//no more events after all runners quit
+	close(s.eventCh)
+	select {
+	case <-s.eventsDone:
+	case <-ctx.Done():
+		return errors.New("timed out waiting for events to be dispatched")
 	}
-	//close plugin container
+	//close plugin container and wait for the running Load
 	for _, plugin := range s.GetEnabledPlugins() {
 		plugin.Close()
 	}
-	close(s.eventCh)
+	for name, plugin := range s.GetEnabledPlugins() {
+		if !plugin.Ready {
+			continue
+		}
+		select {
+		case <-plugin.Done():
+		case <-ctx.Done():
+			return errors.New(fmt.Sprintf("timed out waiting for plugin %s to quit", name))
+		}
+	}
+	//journal is closed after all loads finished
+	if s.journal != nil {
+		_ = s.journal.Close()
+	}
+	s.logger.Info("sync manager successfully stopped")
+	return nil
 }
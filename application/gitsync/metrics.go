@@ -0,0 +1,70 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+const MetricsPrefix = "community_metadata"
+
+// Metrics exposes the state of repos in prometheus text format
+func (s *SyncManager) Metrics(c *gin.Context) {
+	runners := s.listRunners()
+	keys := make([]string, 0, len(runners))
+	for key := range runners {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buffer := bytes.NewBuffer(nil)
+	writeMetricHeader(buffer, "repo_info", "gauge", "Repo watched by runner, value is always 1")
+	for _, key := range keys {
+		r := runners[key]
+		fmt.Fprintf(buffer, "%s_repo_info{name=%q,repo=%q,ref=%q,revision=%q} 1\n", MetricsPrefix, key,
+			r.GetRepo().Repo, r.GetRepo().Ref, r.Revision())
+	}
+	writeMetricHeader(buffer, "repo_active_remote", "gauge",
+		"Remote which repo is synced from, value is the index of remote, 0 for repo url and 1.. for mirrors")
+	for _, key := range keys {
+		if f, ok := runners[key].(remoteFailoverRunner); ok {
+			active, _, _ := f.Failover().Stats()
+			fmt.Fprintf(buffer, "%s_repo_active_remote{name=%q,remote=%q} %d\n", MetricsPrefix, key,
+				f.ActiveRemote(), active)
+		}
+	}
+	writeMetricHeader(buffer, "repo_sync_failures", "gauge", "Consecutive sync failures of active remote")
+	for _, key := range keys {
+		if f, ok := runners[key].(remoteFailoverRunner); ok {
+			_, failures, _ := f.Failover().Stats()
+			fmt.Fprintf(buffer, "%s_repo_sync_failures{name=%q} %d\n", MetricsPrefix, key, failures)
+		}
+	}
+	writeMetricHeader(buffer, "repo_failovers_total", "counter", "Times of failing over to another remote")
+	for _, key := range keys {
+		if f, ok := runners[key].(remoteFailoverRunner); ok {
+			_, _, failovers := f.Failover().Stats()
+			fmt.Fprintf(buffer, "%s_repo_failovers_total{name=%q} %d\n", MetricsPrefix, key, failovers)
+		}
+	}
+	c.Data(200, "text/plain; version=0.0.4; charset=utf-8", buffer.Bytes())
+}
+
+func writeMetricHeader(buffer *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buffer, "# HELP %s_%s %s\n", MetricsPrefix, name, help)
+	fmt.Fprintf(buffer, "# TYPE %s_%s %s\n", MetricsPrefix, name, kind)
+}
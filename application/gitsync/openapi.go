@@ -0,0 +1,293 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opensourceways/app-community-metadata/app"
+	"github.com/opensourceways/app-community-metadata/helper"
+)
+
+const OpenAPIVersion = "3.0.3"
+
+// RedocBundle is the vendored redoc bundle served with api document, it's relative to working folder
+const RedocBundle = "./static/redoc/redoc.standalone.js"
+
+const apiDocsPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <title>%s API</title>
+    <meta charset="utf-8"/>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style>body { margin: 0; padding: 0; }</style>
+  </head>
+  <body>
+    <redoc spec-url="%s"></redoc>
+    <script src="%s"></script>
+  </body>
+</html>
+`
+
+// ConvertGinPath converts gin style path parameters(:name, *path) into OpenAPI style({name})
+func ConvertGinPath(p string) (string, []string) {
+	var params []string
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			params = append(params, seg[1:])
+			segments[i] = fmt.Sprintf("{%s}", seg[1:])
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func buildOperation(tag string, endpoint Endpoint) map[string]interface{} {
+	_, pathParams := ConvertGinPath(endpoint.Path)
+	parameters := make([]map[string]interface{}, 0)
+	declared := make(map[string]bool)
+	for _, p := range endpoint.Parameters {
+		in := p.In
+		if in == "" {
+			in = "query"
+		}
+		paramType := p.Type
+		if paramType == "" {
+			paramType = "string"
+		}
+		declared[p.Name] = true
+		parameters = append(parameters, map[string]interface{}{
+			"name":        p.Name,
+			"in":          in,
+			"description": p.Description,
+			"required":    p.Required || in == "path",
+			"schema":      map[string]interface{}{"type": paramType},
+		})
+	}
+	//path parameters must be declared
+	for _, name := range pathParams {
+		if !declared[name] {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	responses := make(map[string]interface{})
+	for _, r := range endpoint.Responses {
+		contentType := r.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		media := make(map[string]interface{})
+		if r.Schema != nil {
+			media["schema"] = r.Schema
+		}
+		if r.Example != nil {
+			media["example"] = r.Example
+		}
+		responses[fmt.Sprintf("%d", r.Status)] = map[string]interface{}{
+			"description": r.Description,
+			"content":     map[string]interface{}{contentType: media},
+		}
+	}
+	if len(responses) == 0 {
+		responses["200"] = map[string]interface{}{"description": "success"}
+	}
+	return map[string]interface{}{
+		"tags":        []string{tag},
+		"summary":     endpoint.Summary,
+		"description": endpoint.Description,
+		"parameters":  parameters,
+		"responses":   responses,
+	}
+}
+
+// BuildOpenAPIDocument generates the OpenAPI document for all manager and ready plugin endpoints
+func (s *SyncManager) BuildOpenAPIDocument() ([]byte, error) {
+	paths := make(map[string]map[string]interface{})
+	tags := make([]map[string]interface{}, 0)
+	addEndpoint := func(basePath, tag string, endpoint Endpoint) {
+		fullPath, _ := ConvertGinPath(strings.TrimRight(basePath, "/") + endpoint.Path)
+		method := strings.ToLower(endpoint.Method)
+		if method == "" {
+			method = "get"
+		}
+		if _, ok := paths[fullPath]; !ok {
+			paths[fullPath] = make(map[string]interface{})
+		}
+		paths[fullPath][method] = buildOperation(tag, endpoint)
+	}
+	//manager endpoints
+	for _, endpoint := range s.GetEndpoints() {
+		addEndpoint(s.routerGroup.BasePath(), "manager", endpoint)
+	}
+	tags = append(tags, map[string]interface{}{
+		"name":        "manager",
+		"description": "plugin and repo management",
+	})
+	//plugin endpoints
+	var names []string
+	plugins := s.GetEnabledPlugins()
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		container := plugins[name]
+		if !container.Ready {
+			continue
+		}
+		documented, ok := container.Plugin.(Documented)
+		if !ok {
+			continue
+		}
+		meta := container.Plugin.GetMeta()
+		tag := fmt.Sprintf("%s/%s", meta.Group, meta.Name)
+		tags = append(tags, map[string]interface{}{
+			"name":        tag,
+			"description": meta.Description,
+		})
+		basePath := fmt.Sprintf("%s/%s/%s", s.routerGroup.BasePath(), meta.Group, meta.Name)
+		for _, endpoint := range documented.GetEndpoints() {
+			addEndpoint(basePath, tag, endpoint)
+		}
+	}
+	document := map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info": map[string]interface{}{
+			"title":   app.Name,
+			"version": app.GitInfo.Version,
+		},
+		"tags":  tags,
+		"paths": paths,
+	}
+	return helper.JsonEncode(document)
+}
+
+// RefreshOpenAPIDocument regenerates the OpenAPI document, it's invoked when plugin becomes ready
+func (s *SyncManager) RefreshOpenAPIDocument() {
+	document, err := s.BuildOpenAPIDocument()
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("failed to generate openapi document %v", err))
+		return
+	}
+	s.apiDocument.Store(document)
+}
+
+func (s *SyncManager) GetEndpoints() []Endpoint {
+	return []Endpoint{
+		{
+			Path:        "/status",
+			Summary:     "get replica status",
+			Description: "role of this replica and the revision of each repo it's serving",
+			Responses: []EndpointResponse{
+				{
+					Status:      200,
+					Description: "replica status",
+					Schema: map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"role":     map[string]interface{}{"type": "string"},
+							"identity": map[string]interface{}{"type": "string"},
+							"leader":   map[string]interface{}{"type": "string"},
+							"repos": map[string]interface{}{
+								"type":  "array",
+								"items": map[string]interface{}{"type": "object"},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Path:    "/snapshots",
+			Summary: "list the revision of all repos served by this instance",
+			Responses: []EndpointResponse{
+				{
+					Status:      200,
+					Description: "repo revisions, full or abbreviated commit ids",
+					Schema: map[string]interface{}{
+						"type":  "array",
+						"items": map[string]interface{}{"type": "object"},
+					},
+				},
+			},
+		},
+		{
+			Path:        "/snapshots/:group/:localname",
+			Summary:     "export the watched files of repo",
+			Description: "tar.gz bundle of watched files at the revision currently served, revision is used as ETag",
+			Responses: []EndpointResponse{
+				{
+					Status:      200,
+					Description: "snapshot bundle",
+					ContentType: "application/gzip",
+				},
+				{
+					Status:      304,
+					Description: "snapshot not modified",
+				},
+			},
+		},
+		{
+			Path:    "/plugins",
+			Summary: "list all registered plugins",
+			Responses: []EndpointResponse{
+				{
+					Status:      200,
+					Description: "registered plugins",
+					Schema: map[string]interface{}{
+						"type": "array",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"group":       map[string]interface{}{"type": "string"},
+								"name":        map[string]interface{}{"type": "string"},
+								"ready":       map[string]interface{}{"type": "string"},
+								"description": map[string]interface{}{"type": "string"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (s *SyncManager) OpenAPIHandler(c *gin.Context) {
+	document := s.apiDocument.Load()
+	if document == nil {
+		s.RefreshOpenAPIDocument()
+		document = s.apiDocument.Load()
+	}
+	if document == nil {
+		c.Data(500, "text/plain", []byte("failed to generate openapi document"))
+		return
+	}
+	c.Data(200, "application/json", document.([]byte))
+}
+
+// APIDocsHandler renders document of specPath with redoc bundle served at bundlePath
+func (s *SyncManager) APIDocsHandler(specPath, bundlePath string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(fmt.Sprintf(apiDocsPage, app.Name, specPath, bundlePath)))
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+var subModuleModes = []string{"recursive", "shallow", "off"}
+
+// RepoOverride replaces the remote, branch or submodule mode of repo declared by plugin in some envs, for instance,
+// staging follows forks and develop branches
+type RepoOverride struct {
+	//Repo url declared by plugin
+	Repo string `mapstructure:"repo"`
+	//Envs the override applies to, for instance, dev or staging, all envs if empty
+	Envs []string `mapstructure:"envs"`
+	//Remote url synced instead of repo
+	URL        string `mapstructure:"url"`
+	Branch     string `mapstructure:"branch"`
+	SubModules string `mapstructure:"submodules"`
+}
+
+// LoadRepoOverrides reads [[overrides]] config which apply to current env
+func LoadRepoOverrides() ([]RepoOverride, error) {
+	if !app.Config.Exists("overrides") {
+		return nil, nil
+	}
+	var configs []RepoOverride
+	if err := app.Config.MapStruct("overrides", &configs); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode overrides config %v", err))
+	}
+	var overrides []RepoOverride
+	for _, c := range configs {
+		if GetRepoLocalName(c.Repo) == "" {
+			return nil, errors.New(fmt.Sprintf("invalid repo '%s' of override", c.Repo))
+		}
+		if c.URL != "" && GetRepoLocalName(c.URL) == "" {
+			return nil, errors.New(fmt.Sprintf("invalid url '%s' of override of repo %s", c.URL, c.Repo))
+		}
+		if c.SubModules != "" && !StringInclude(subModuleModes, c.SubModules) {
+			return nil, errors.New(fmt.Sprintf("submodules of repo %s should be one of %s, got '%s'", c.Repo,
+				strings.Join(subModuleModes, ","), c.SubModules))
+		}
+		if len(c.Envs) != 0 && !StringInclude(c.Envs, app.EnvName) {
+			continue
+		}
+		overrides = append(overrides, c)
+	}
+	return overrides, nil
+}
+
+// ApplyRepoOverride overrides remote, branch and submodule mode of repo with overrides loaded by LoadRepoOverrides,
+// the last matched wins
+func ApplyRepoOverride(repo *GitMeta, overrides []RepoOverride) {
+	for _, o := range overrides {
+		equal, _ := RepoEqualIgnoreSchemaAndLevel(o.Repo, repo.Repo)
+		if o.Repo != repo.Repo && !equal {
+			continue
+		}
+		if o.URL != "" {
+			repo.Remote = o.URL
+		}
+		if o.Branch != "" {
+			repo.Branch = o.Branch
+		}
+		if o.SubModules != "" {
+			repo.SubModules = o.SubModules
+		}
+		app.Logger.Info(fmt.Sprintf("repo %s overridden in env %s, remote %s branch %s submodules %s", repo.Repo,
+			app.EnvName, repo.RemoteURL(), repo.Branch, repo.SubModules))
+	}
+}
+
+// effectiveBranch returns the branch of repo synced in group, the declared branch if repo not found
+func effectiveBranch(group string, repo *GitMeta) string {
+	repoMutex.RLock()
+	defer repoMutex.RUnlock()
+	if c, ok := repoContainer[group][GetRepoLocalName(repo.Repo)]; ok {
+		return c.Meta.Branch
+	}
+	return repo.Branch
+}
@@ -14,19 +14,47 @@ limitations under the License.
 package gitsync
 
 import (
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"os"
 	"sync"
 )
 
+// pendingLoad is the load requested by admin, result is sent when it's done
+type pendingLoad struct {
+	files  map[string][]string
+	caller string
+	result chan error
+	//runtime state applied once files loaded, nil if unchanged
+	state *PluginState
+}
+
 type PluginContainer struct {
+	//Registration name of plugin
+	Name string
+	//Enabled by instance config, [plugins.<name>] is used if nil
+	Enabled        *bool
 	Plugin         Plugin
 	Ready          bool
 	Channel        chan *GitEvent
 	FlushChannel   chan int
 	Logger         *zap.Logger
 	eventContainer map[string][]string
-	eventMutex     sync.Mutex
+	//events of extra refs, organized by ref and repo
+	refEvents  map[string]map[string][]string
+	eventMutex sync.Mutex
+	done       chan struct{}
+	//runtime state changed by admin, events are dropped if plugin disabled or pinned
+	stateMutex sync.RWMutex
+	disabled   bool
+	pins       map[string]string
+	pending    *pendingLoad
+	//Journal records every load if not nil, Revision returns the checkout revision of repo
+	Journal  *AuditJournal
+	Revision func(repo string) string
+	//digests of files loaded, organized by repo and path relative to repo
+	digests map[string]map[string]string
 }
 
 func NewPluginContainer(p Plugin) *PluginContainer {
@@ -40,6 +68,9 @@ func NewPluginContainer(p Plugin) *PluginContainer {
 		Channel:        make(chan *GitEvent, 50),
 		FlushChannel:   make(chan int, 10),
 		eventContainer: container,
+		refEvents:      make(map[string]map[string][]string),
+		done:           make(chan struct{}),
+		digests:        make(map[string]map[string]string),
 	}
 }
 
@@ -49,6 +80,24 @@ func (p *PluginContainer) AddEvents(repo, filename string) {
 	p.eventContainer[repo] = append(p.eventContainer[repo], filename)
 }
 
+func (p *PluginContainer) AddRefEvents(ref, repo, filename string) {
+	defer p.eventMutex.Unlock()
+	p.eventMutex.Lock()
+	if _, ok := p.refEvents[ref]; !ok {
+		p.refEvents[ref] = make(map[string][]string)
+	}
+	p.refEvents[ref][repo] = append(p.refEvents[ref][repo], filename)
+}
+
+// FlushRefEvents returns and clears the events of extra refs
+func (p *PluginContainer) FlushRefEvents() map[string]map[string][]string {
+	defer p.eventMutex.Unlock()
+	p.eventMutex.Lock()
+	results := p.refEvents
+	p.refEvents = make(map[string]map[string][]string)
+	return results
+}
+
 func (p *PluginContainer) FlushEvents() map[string][]string {
 	defer p.eventMutex.Unlock()
 	p.eventMutex.Lock()
@@ -61,7 +110,160 @@ func (p *PluginContainer) FlushEvents() map[string][]string {
 	return results
 }
 
+// Disabled returns true if plugin disabled at runtime
+func (p *PluginContainer) Disabled() bool {
+	p.stateMutex.RLock()
+	defer p.stateMutex.RUnlock()
+	return p.disabled
+}
+
+func (p *PluginContainer) SetDisabled(disabled bool) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.disabled = disabled
+}
+
+// Pins returns the pinned revision of every repo, nil if plugin not pinned
+func (p *PluginContainer) Pins() map[string]string {
+	p.stateMutex.RLock()
+	defer p.stateMutex.RUnlock()
+	return p.pins
+}
+
+func (p *PluginContainer) SetPins(pins map[string]string) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.pins = pins
+}
+
+// SetState changes disabled and pins together
+func (p *PluginContainer) SetState(disabled bool, pins map[string]string) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.disabled, p.pins = disabled, pins
+}
+
+// ScheduleLoad loads files on next flush even if plugin disabled or pinned, the load scheduled before is superseded
+func (p *PluginContainer) ScheduleLoad(files map[string][]string, caller string) <-chan error {
+	return p.ScheduleStateLoad(files, caller, nil)
+}
+
+// ScheduleStateLoad loads files as ScheduleLoad, disabled and pins of state are applied only if load succeeded, before
+// any change is loaded after it
+func (p *PluginContainer) ScheduleStateLoad(files map[string][]string, caller string, state *PluginState) <-chan error {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	if p.pending != nil {
+		p.pending.result <- errors.New("superseded by another load")
+	}
+	p.pending = &pendingLoad{files: files, caller: caller, result: make(chan error, 1), state: state}
+	return p.pending.result
+}
+
+func (p *PluginContainer) takePendingLoad() *pendingLoad {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	pending := p.pending
+	p.pending = nil
+	return pending
+}
+
+// frozen returns true if events should be dropped
+func (p *PluginContainer) frozen() bool {
+	p.stateMutex.RLock()
+	defer p.stateMutex.RUnlock()
+	return p.disabled || p.pins != nil
+}
+
+// load calls Load of plugin, panic is recovered since plugins may register endpoints when loading
+func (p *PluginContainer) load(files map[string][]string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("plugin panicked when loading %v", r))
+		}
+	}()
+	return p.Plugin.Load(files)
+}
+
+// loadRef calls LoadRef of plugin for extra ref, panic is recovered the same as load
+func (p *PluginContainer) loadRef(loader RefLoader, ref string, files map[string][]string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("plugin panicked when loading ref %s %v", ref, r))
+		}
+	}()
+	return loader.LoadRef(ref, files)
+}
+
+// recordLoad appends the load to journal, digests of files are updated if load succeeded
+func (p *PluginContainer) recordLoad(action, ref, caller string, files map[string][]string, err error) {
+	if p.Journal == nil {
+		return
+	}
+	meta := p.Plugin.GetMeta()
+	entry := &AuditEntry{
+		Kind:   LoadAudit,
+		Caller: caller,
+		Action: action,
+		Plugin: p.Name,
+		Ref:    ref,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	pins := p.Pins()
+	for repo, repoFiles := range files {
+		var watchFiles []string
+		if r := GetRepo(meta.Repos, repo); r != nil {
+			watchFiles = r.WatchFiles
+		}
+		after := contentDigests(repoFiles, watchFiles)
+		names := make([]string, 0)
+		for _, f := range repoFiles {
+			//folders are expanded into files
+			if info, err := os.Stat(f); err == nil && info.IsDir() {
+				continue
+			}
+			names = append(names, watchRelativePath(f, watchFiles))
+		}
+		for name := range after {
+			if !StringInclude(names, name) {
+				names = append(names, name)
+			}
+		}
+		if _, ok := p.digests[repo]; !ok {
+			p.digests[repo] = make(map[string]string)
+		}
+		change := AuditChange{
+			Repo:       repo,
+			Files:      names,
+			HashBefore: combinedDigest(p.digests[repo], names),
+			HashAfter:  combinedDigest(after, names),
+		}
+		if revision, ok := pins[repo]; ok && ref == "" {
+			change.Commit = revision
+		} else if p.Revision != nil {
+			change.Commit = p.Revision(repo)
+		}
+		entry.Changes = append(entry.Changes, change)
+		//the previous content is still served if load failed
+		if err == nil && ref == "" {
+			for _, name := range names {
+				if d, ok := after[name]; ok {
+					p.digests[repo][name] = d
+				} else {
+					delete(p.digests[repo], name)
+				}
+			}
+		}
+	}
+	if err := p.Journal.Append(entry); err != nil {
+		p.Logger.Error(fmt.Sprintf("plugin container[%s/%s] failed to record load %v", meta.Group, meta.Name, err))
+	}
+}
+
 func (p *PluginContainer) StartLoop() {
+	defer close(p.done)
 	for {
 		select {
 		case event, ok := <-p.Channel:
@@ -76,10 +278,19 @@ func (p *PluginContainer) StartLoop() {
 				r := GetRepo(p.Plugin.GetMeta().Repos, event.RepoName)
 				if r != nil {
 					eventCount := 0
+					_, isRefLoader := p.Plugin.(RefLoader)
+					//branch of repo may be overridden in env
+					extraRef := event.Ref != "" && event.Ref != effectiveBranch(event.GroupName, r)
 					for _, f := range event.Files {
-						if PathIncludes(r.WatchFiles, f) {
+						if !PathIncludes(r.WatchFiles, f) {
+							continue
+						}
+						if !extraRef {
 							p.AddEvents(r.Repo, f)
 							eventCount += 1
+						} else if isRefLoader {
+							p.AddRefEvents(event.Ref, r.Repo, f)
+							eventCount += 1
 						}
 					}
 					if eventCount != 0 {
@@ -95,9 +306,25 @@ func (p *PluginContainer) StartLoop() {
 					"plugin container[%s/%s] received close channel event, quiting..", p.Plugin.GetMeta().Group, p.Plugin.GetMeta().Name))
 				return
 			}
+			if pending := p.takePendingLoad(); pending != nil {
+				err := p.load(pending.files)
+				p.Logger.Info(fmt.Sprintf("plugin container[%s/%s] loaded files requested by admin, error %v",
+					p.Plugin.GetMeta().Group, p.Plugin.GetMeta().Name, err))
+				if err == nil && pending.state != nil {
+					p.SetState(pending.state.Disabled, pending.state.Pins)
+				}
+				p.recordLoad(AdminAudit, "", pending.caller, pending.files, err)
+				pending.result <- err
+			}
 			files := p.FlushEvents()
+			if p.frozen() {
+				//changes are dropped, plugin is reloaded from checkout when enabled or unpinned
+				p.FlushRefEvents()
+				continue
+			}
 			if len(files) != 0 {
-				err := p.Plugin.Load(files)
+				err := p.load(files)
+				p.recordLoad("changes", "", "", files, err)
 				if err != nil {
 					p.Logger.Error(fmt.Sprintf("plugin container[%s/%s] triggered LOAD function with error %v",
 						p.Plugin.GetMeta().Group, p.Plugin.GetMeta().Name, err))
@@ -106,6 +333,16 @@ func (p *PluginContainer) StartLoop() {
 						p.Plugin.GetMeta().Group, p.Plugin.GetMeta().Name, len(files)))
 				}
 			}
+			if refLoader, ok := p.Plugin.(RefLoader); ok {
+				for ref, refFiles := range p.FlushRefEvents() {
+					err := p.loadRef(refLoader, ref, refFiles)
+					p.recordLoad("changes", ref, "", refFiles, err)
+					if err != nil {
+						p.Logger.Error(fmt.Sprintf("plugin container[%s/%s] triggered LOAD function of ref %s with error %v",
+							p.Plugin.GetMeta().Group, p.Plugin.GetMeta().Name, ref, err))
+					}
+				}
+			}
 		}
 	}
 }
@@ -114,3 +351,8 @@ func (p *PluginContainer) Close() {
 	close(p.Channel)
 	close(p.FlushChannel)
 }
+
+// Done returns a channel which is closed when the container loop quits, including its current Load
+func (p *PluginContainer) Done() <-chan struct{} {
+	return p.done
+}
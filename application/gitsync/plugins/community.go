@@ -0,0 +1,336 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/opensourceways/app-community-metadata/application/gitsync"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+const CommunityRepo = "https://gitee.com/openeuler/community"
+
+// CommunityConfig describes one community repo, it's decoded from [[plugins.instances]] of type community
+type CommunityConfig struct {
+	//Registration name
+	Name string `mapstructure:"name"`
+	//Community is served at /v1/metadata/<group>/<endpoint>, endpoint is name if empty
+	Group       string `mapstructure:"group"`
+	Endpoint    string `mapstructure:"endpoint"`
+	Description string `mapstructure:"description"`
+	Repo        string `mapstructure:"repo"`
+	Branch      string `mapstructure:"branch"`
+	//Sigs yaml in repo, sig/sigs.yaml by default
+	SigsFile string `mapstructure:"sigsFile"`
+	//Folder of sigs in repo, every sig folder may contain sig-info.yaml and OWNERS, sig by default
+	SigFolder string `mapstructure:"sigFolder"`
+}
+
+func (c *CommunityConfig) setDefaults() {
+	if c.Endpoint == "" {
+		c.Endpoint = c.Name
+	}
+	if c.Branch == "" {
+		c.Branch = "master"
+	}
+	if c.SigsFile == "" {
+		c.SigsFile = "sig/sigs.yaml"
+	}
+	if c.SigFolder == "" {
+		c.SigFolder = "sig"
+	}
+	if c.Description == "" {
+		c.Description = fmt.Sprintf("get %s community information", c.Group)
+	}
+}
+
+// watchFiles returns sig folder, and sigs file if it's out of sig folder
+func (c *CommunityConfig) watchFiles() []string {
+	folder := strings.Trim(c.SigFolder, "/")
+	if strings.HasPrefix(strings.Trim(c.SigsFile, "/"), folder+"/") {
+		return []string{folder}
+	}
+	return []string{c.SigsFile, folder}
+}
+
+// CommunityPlugin serves sig directory of community repo
+type CommunityPlugin struct {
+	Config CommunityConfig
+	//*SigDirectory
+	Sigs atomic.Value
+}
+
+func NewCommunityPlugin(conf CommunityConfig) gitsync.Plugin {
+	conf.setDefaults()
+	return &CommunityPlugin{Config: conf}
+}
+
+// NewCommunityInstance creates community plugin of [[plugins.instances]] entry, settings are passed to Configure
+func NewCommunityInstance(instance *gitsync.PluginInstance) (gitsync.Plugin, error) {
+	return &CommunityPlugin{Config: CommunityConfig{Name: instance.Name, Endpoint: instance.Endpoint}}, nil
+}
+
+// NewConfig returns current config, settings in config section override it
+func (h *CommunityPlugin) NewConfig() interface{} {
+	conf := h.Config
+	return &conf
+}
+
+func (h *CommunityPlugin) Configure(config interface{}) error {
+	conf := config.(*CommunityConfig)
+	//registration name can't be changed
+	conf.Name = h.Config.Name
+	conf.setDefaults()
+	if conf.Group == "" || conf.Repo == "" {
+		return errors.New("group and repo are required")
+	}
+	if gitsync.GetRepoLocalName(conf.Repo) == "" {
+		return errors.New(fmt.Sprintf("invalid repo %s", conf.Repo))
+	}
+	h.Config = *conf
+	return nil
+}
+
+func (h *CommunityPlugin) GetMeta() *gitsync.PluginMeta {
+	return &gitsync.PluginMeta{
+		Name:        h.Config.Endpoint,
+		Group:       h.Config.Group,
+		Description: h.Config.Description,
+		Repos: []gitsync.GitMeta{
+			{
+				Repo:       h.Config.Repo,
+				Branch:     h.Config.Branch,
+				SubModules: "recursive",
+				Schema:     gitsync.Https,
+				//large repo, only the latest sigs file, sig-info.yaml and OWNERS of sigs are checked out
+				Depth:  1,
+				Sparse: true,
+				SparsePaths: []string{
+					h.Config.SigsFile,
+					fmt.Sprintf("%s/*/%s", strings.Trim(h.Config.SigFolder, "/"), SigInfoFile),
+					fmt.Sprintf("%s/*/%s", strings.Trim(h.Config.SigFolder, "/"), SigOwnersFile),
+				},
+				WatchFiles: h.Config.watchFiles(),
+			},
+		},
+	}
+}
+
+func (h *CommunityPlugin) Load(files map[string][]string) error {
+	//sigs file and sig folder are always loaded together, since sigs are merged from both of them
+	for _, f := range files[h.Config.Repo] {
+		for _, w := range h.Config.watchFiles() {
+			if !isWatchFile(f, w) {
+				continue
+			}
+			root := strings.TrimSuffix(filepath.ToSlash(f), "/"+strings.Trim(w, "/"))
+			directory, warnings, err := loadSigDirectory(filepath.Join(root, h.Config.SigsFile),
+				filepath.Join(root, h.Config.SigFolder))
+			if err != nil {
+				return err
+			}
+			for _, w := range warnings {
+				fmt.Println(fmt.Sprintf("community plugin %s: %v", h.Config.Group, w))
+			}
+			h.Sigs.Store(directory)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (h *CommunityPlugin) RegisterEndpoints(group *gin.RouterGroup) {
+	group.GET("/sigs", h.ListSigs)
+	group.GET("/sigs/:name", h.ReadSig)
+	group.GET("/sigs/:name/maintainers", h.ReadSigMaintainers)
+	group.GET("/sigs/:name/repos", h.ReadSigRepos)
+	group.GET("/repos/:org/:repo/sig", h.ReadRepoSig)
+	group.GET("/maintainers/:id/sigs", h.ReadMaintainerSigs)
+}
+
+func (h *CommunityPlugin) getDirectory(c *gin.Context) (*SigDirectory, bool) {
+	directory := h.Sigs.Load()
+	if directory == nil {
+		c.Data(500, "text/html", []byte("server not ready"))
+		return nil, false
+	}
+	return directory.(*SigDirectory), true
+}
+
+func (h *CommunityPlugin) getSig(c *gin.Context) (*Sig, bool) {
+	directory, ok := h.getDirectory(c)
+	if !ok {
+		return nil, false
+	}
+	sig, ok := directory.Get(c.Param("name"))
+	if !ok {
+		c.Data(404, "text/html", []byte(fmt.Sprintf("sig %s not found", c.Param("name"))))
+		return nil, false
+	}
+	return sig, true
+}
+
+// ListSigs returns all sigs, empty if sigs not loaded yet
+func (h *CommunityPlugin) ListSigs(c *gin.Context) {
+	directory := h.Sigs.Load()
+	if directory == nil {
+		c.JSON(200, make([]*Sig, 0))
+		return
+	}
+	c.JSON(200, directory.(*SigDirectory).Sigs)
+}
+
+func (h *CommunityPlugin) ReadSig(c *gin.Context) {
+	if sig, ok := h.getSig(c); ok {
+		c.JSON(200, sig)
+	}
+}
+
+func (h *CommunityPlugin) ReadSigMaintainers(c *gin.Context) {
+	if sig, ok := h.getSig(c); ok {
+		c.JSON(200, sig.Maintainers)
+	}
+}
+
+func (h *CommunityPlugin) ReadSigRepos(c *gin.Context) {
+	if sig, ok := h.getSig(c); ok {
+		c.JSON(200, sig.Repositories)
+	}
+}
+
+// ReadRepoSig returns sig owns repo {org}/{repo}
+func (h *CommunityPlugin) ReadRepoSig(c *gin.Context) {
+	directory, ok := h.getDirectory(c)
+	if !ok {
+		return
+	}
+	repo := fmt.Sprintf("%s/%s", c.Param("org"), c.Param("repo"))
+	sig, ok := directory.SigOfRepo(repo)
+	if !ok {
+		c.Data(404, "text/html", []byte(fmt.Sprintf("sig of repo %s not found", repo)))
+		return
+	}
+	c.JSON(200, sig)
+}
+
+// ReadMaintainerSigs returns names of sigs maintained by gitee id, empty if none
+func (h *CommunityPlugin) ReadMaintainerSigs(c *gin.Context) {
+	directory, ok := h.getDirectory(c)
+	if !ok {
+		return
+	}
+	names := make([]string, 0)
+	for _, sig := range directory.SigsOfMaintainer(c.Param("id")) {
+		names = append(names, sig.Name)
+	}
+	c.JSON(200, names)
+}
+
+func (h *CommunityPlugin) GetEndpoints() []gitsync.Endpoint {
+	sigNotFound := gitsync.EndpointResponse{
+		Status:      404,
+		Description: "sig not found",
+		ContentType: "text/html",
+	}
+	return []gitsync.Endpoint{
+		{
+			Path:    "/sigs",
+			Summary: fmt.Sprintf("get %s sigs", h.Config.Group),
+			Description: fmt.Sprintf("array of sigs of %s merged with %s and %s in sig folders, empty if not "+
+				"loaded yet. NOTE: it was the object converted from %s, read the array rather than its sigs field",
+				h.Config.SigsFile, SigInfoFile, SigOwnersFile, h.Config.SigsFile),
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "sigs",
+					Schema:      map[string]interface{}{"type": "array"},
+				},
+			},
+		},
+		{
+			Path:    "/sigs/:name",
+			Summary: "get sig details",
+			Parameters: []gitsync.EndpointParameter{
+				{
+					Name:        "name",
+					In:          "path",
+					Description: "sig name, case insensitive",
+				},
+			},
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "sig",
+					Schema:      map[string]interface{}{"type": "object"},
+				},
+				sigNotFound,
+			},
+		},
+		{
+			Path:    "/sigs/:name/maintainers",
+			Summary: "get maintainers of sig",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "maintainers",
+					Schema:      map[string]interface{}{"type": "array"},
+				},
+				sigNotFound,
+			},
+		},
+		{
+			Path:    "/sigs/:name/repos",
+			Summary: "get repos of sig",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "repos in org/repo format",
+					Schema:      map[string]interface{}{"type": "array"},
+				},
+				sigNotFound,
+			},
+		},
+		{
+			Path:    "/repos/:org/:repo/sig",
+			Summary: "get sig owns repo",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "sig",
+					Schema:      map[string]interface{}{"type": "object"},
+				},
+				{
+					Status:      404,
+					Description: "repo not owned by any sig",
+					ContentType: "text/html",
+				},
+			},
+		},
+		{
+			Path:    "/maintainers/:id/sigs",
+			Summary: "get names of sigs maintained by gitee id",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "sig names",
+					Schema:      map[string]interface{}{"type": "array"},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const SigInfoFile = "sig-info.yaml"
+const SigOwnersFile = "OWNERS"
+
+// SigMember is maintainer or committer of sig
+type SigMember struct {
+	GiteeID      string `json:"gitee_id"`
+	Name         string `json:"name,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Email        string `json:"email,omitempty"`
+}
+
+// Sig is merged from sigs file, sig-info.yaml and OWNERS of sig folder
+type Sig struct {
+	Name         string      `json:"name"`
+	Description  string      `json:"description,omitempty"`
+	MailingList  string      `json:"mailing_list,omitempty"`
+	MeetingURL   string      `json:"meeting_url,omitempty"`
+	MatureLevel  string      `json:"mature_level,omitempty"`
+	Maintainers  []SigMember `json:"maintainers"`
+	Committers   []SigMember `json:"committers,omitempty"`
+	Repositories []string    `json:"repositories"`
+}
+
+// sigInfo is the content of sig-info.yaml, repositories are either names or entries of {repo: [names]}
+type sigInfo struct {
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	MailingList  string        `json:"mailing_list"`
+	MeetingURL   string        `json:"meeting_url"`
+	MatureLevel  string        `json:"mature_level"`
+	Maintainers  []SigMember   `json:"maintainers"`
+	Committers   []SigMember   `json:"committers"`
+	Repositories []interface{} `json:"repositories"`
+}
+
+type sigOwners struct {
+	Maintainers []string `json:"maintainers"`
+	Committers  []string `json:"committers"`
+}
+
+type sigsFile struct {
+	Sigs []struct {
+		Name         string   `json:"name"`
+		Repositories []string `json:"repositories"`
+	} `json:"sigs"`
+}
+
+// SigDirectory is the sigs of community with indexes, keys of indexes are lower case
+type SigDirectory struct {
+	Sigs         []*Sig
+	byName       map[string]*Sig
+	byRepo       map[string]*Sig
+	byMaintainer map[string][]*Sig
+}
+
+func (d *SigDirectory) Get(name string) (*Sig, bool) {
+	sig, ok := d.byName[strings.ToLower(name)]
+	return sig, ok
+}
+
+// SigOfRepo returns sig owns repo, the first sig in sigs file wins if repo is declared by several sigs
+func (d *SigDirectory) SigOfRepo(repo string) (*Sig, bool) {
+	sig, ok := d.byRepo[strings.ToLower(repo)]
+	return sig, ok
+}
+
+// SigsOfMaintainer returns sigs maintained by gitee id
+func (d *SigDirectory) SigsOfMaintainer(id string) []*Sig {
+	return d.byMaintainer[strings.ToLower(id)]
+}
+
+func readYaml(file string, target interface{}) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err = yaml.Unmarshal(content, target); err != nil {
+		return errors.New(fmt.Sprintf("failed to parse %s %v", filepath.Base(file), err))
+	}
+	return nil
+}
+
+// repositoryNames flattens repositories of sig-info.yaml
+func repositoryNames(entries []interface{}) []string {
+	var names []string
+	for _, e := range entries {
+		switch entry := e.(type) {
+		case string:
+			names = append(names, entry)
+		case map[string]interface{}:
+			switch repo := entry["repo"].(type) {
+			case string:
+				names = append(names, repo)
+			case []interface{}:
+				for _, r := range repo {
+					if name, ok := r.(string); ok {
+						names = append(names, name)
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+func appendRepos(repos []string, names ...string) []string {
+	for _, name := range names {
+		exists := false
+		for _, r := range repos {
+			if strings.EqualFold(r, name) {
+				exists = true
+				break
+			}
+		}
+		if !exists && name != "" {
+			repos = append(repos, name)
+		}
+	}
+	return repos
+}
+
+func ownersMembers(ids []string) []SigMember {
+	members := make([]SigMember, 0, len(ids))
+	for _, id := range ids {
+		members = append(members, SigMember{GiteeID: id})
+	}
+	return members
+}
+
+// loadSigDirectory reads sigs file and sig-info.yaml and OWNERS in every sig folder, details in sig folder take
+// precedence over OWNERS, sigs found only in sig folders are appended in order of name. Sig folders failed to read
+// are skipped and returned as warnings.
+func loadSigDirectory(sigsPath, sigFolder string) (*SigDirectory, []error, error) {
+	directory := &SigDirectory{
+		Sigs:         make([]*Sig, 0),
+		byName:       make(map[string]*Sig),
+		byRepo:       make(map[string]*Sig),
+		byMaintainer: make(map[string][]*Sig),
+	}
+	var declared sigsFile
+	if err := readYaml(sigsPath, &declared); err != nil {
+		return nil, nil, err
+	}
+	for _, s := range declared.Sigs {
+		if s.Name == "" {
+			continue
+		}
+		if sig, ok := directory.byName[strings.ToLower(s.Name)]; ok {
+			sig.Repositories = appendRepos(sig.Repositories, s.Repositories...)
+			continue
+		}
+		sig := &Sig{Name: s.Name, Maintainers: make([]SigMember, 0), Repositories: appendRepos(nil, s.Repositories...)}
+		directory.Sigs = append(directory.Sigs, sig)
+		directory.byName[strings.ToLower(s.Name)] = sig
+	}
+	folders, err := ioutil.ReadDir(sigFolder)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	var found []*Sig
+	var warnings []error
+	for _, f := range folders {
+		if !f.IsDir() {
+			continue
+		}
+		var info sigInfo
+		var owners sigOwners
+		infoFile := filepath.Join(sigFolder, f.Name(), SigInfoFile)
+		ownersFile := filepath.Join(sigFolder, f.Name(), SigOwnersFile)
+		hasInfo, hasOwners := fileExists(infoFile), fileExists(ownersFile)
+		if !hasInfo && !hasOwners {
+			continue
+		}
+		//broken sig folder is skipped rather than failing all sigs
+		if hasInfo {
+			if err = readYaml(infoFile, &info); err != nil {
+				warnings = append(warnings, errors.New(fmt.Sprintf("sig %s skipped: %v", f.Name(), err)))
+				continue
+			}
+		}
+		if hasOwners {
+			if err = readYaml(ownersFile, &owners); err != nil {
+				warnings = append(warnings, errors.New(fmt.Sprintf("sig %s skipped: %v", f.Name(), err)))
+				continue
+			}
+		}
+		//folder is named after sig, name in sig-info.yaml is used if they differ
+		sig, ok := directory.byName[strings.ToLower(f.Name())]
+		if !ok && info.Name != "" {
+			sig, ok = directory.byName[strings.ToLower(info.Name)]
+		}
+		if !ok {
+			sig = &Sig{Name: f.Name(), Maintainers: make([]SigMember, 0)}
+			directory.byName[strings.ToLower(f.Name())] = sig
+			found = append(found, sig)
+		}
+		sig.Description = info.Description
+		sig.MailingList = info.MailingList
+		sig.MeetingURL = info.MeetingURL
+		sig.MatureLevel = info.MatureLevel
+		sig.Repositories = appendRepos(sig.Repositories, repositoryNames(info.Repositories)...)
+		if len(info.Maintainers) != 0 {
+			sig.Maintainers = info.Maintainers
+		} else if len(owners.Maintainers) != 0 {
+			sig.Maintainers = ownersMembers(owners.Maintainers)
+		}
+		if len(info.Committers) != 0 {
+			sig.Committers = info.Committers
+		} else if len(owners.Committers) != 0 {
+			sig.Committers = ownersMembers(owners.Committers)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Name < found[j].Name
+	})
+	directory.Sigs = append(directory.Sigs, found...)
+	for _, sig := range directory.Sigs {
+		if sig.Repositories == nil {
+			sig.Repositories = make([]string, 0)
+		}
+		for _, r := range sig.Repositories {
+			if _, ok := directory.byRepo[strings.ToLower(r)]; !ok {
+				directory.byRepo[strings.ToLower(r)] = sig
+			}
+		}
+		for _, m := range sig.Maintainers {
+			if m.GiteeID != "" {
+				id := strings.ToLower(m.GiteeID)
+				if sigs := directory.byMaintainer[id]; len(sigs) == 0 || sigs[len(sigs)-1] != sig {
+					directory.byMaintainer[id] = append(sigs, sig)
+				}
+			}
+		}
+	}
+	return directory, warnings, nil
+}
+
+func fileExists(file string) bool {
+	info, err := os.Stat(file)
+	return err == nil && info.Mode().IsRegular()
+}
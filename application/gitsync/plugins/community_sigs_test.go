@@ -0,0 +1,173 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sigsFixture = `
+sigs:
+- name: Infrastructure
+  repositories:
+  - openeuler/infrastructure
+- name: Kernel
+  repositories:
+  - openeuler/kernel
+`
+
+const sigInfoFixture = `
+name: Infrastructure
+description: infrastructure of community
+mailing_list: infra@openeuler.org
+maintainers:
+- gitee_id: alice
+  name: Alice
+repositories:
+- repo:
+  - openeuler/infrastructure
+  - openeuler/website
+- openeuler/mirrors
+`
+
+const sigOwnersFixture = `
+maintainers:
+- bob
+committers:
+- carol
+`
+
+// writeSigFixture writes sig folder of community repo, sig-broken has invalid sig-info.yaml
+func writeSigFixture(t *testing.T) string {
+	root, err := ioutil.TempDir("", "community")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	files := map[string]string{
+		"sig/sigs.yaml":                    sigsFixture,
+		"sig/Infrastructure/sig-info.yaml": sigInfoFixture,
+		"sig/Kernel/OWNERS":                sigOwnersFixture,
+		"sig/sig-broken/sig-info.yaml":     "name: [broken",
+		"sig/sig-compliance/OWNERS":        "maintainers:\n- alice\n",
+		"sig/not-a-sig/README.md":          "not a sig",
+	}
+	for name, content := range files {
+		file := filepath.Join(root, name)
+		if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestLoadSigDirectory(t *testing.T) {
+	root := writeSigFixture(t)
+	directory, warnings, err := loadSigDirectory(filepath.Join(root, "sig/sigs.yaml"), filepath.Join(root, "sig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "sig-broken") {
+		t.Fatalf("expected warning of broken sig folder, got %v", warnings)
+	}
+	var names []string
+	for _, sig := range directory.Sigs {
+		names = append(names, sig.Name)
+	}
+	//sigs of sigs file go first, then sigs found only in sig folders
+	if strings.Join(names, ",") != "Infrastructure,Kernel,sig-compliance" {
+		t.Fatalf("unexpected sigs %v", names)
+	}
+	infra, ok := directory.Get("infrastructure")
+	if !ok {
+		t.Fatal("sig infrastructure not found")
+	}
+	if infra.MailingList != "infra@openeuler.org" || len(infra.Maintainers) != 1 || infra.Maintainers[0].Name != "Alice" {
+		t.Errorf("sig-info.yaml not merged %+v", infra)
+	}
+	if strings.Join(infra.Repositories, ",") != "openeuler/infrastructure,openeuler/website,openeuler/mirrors" {
+		t.Errorf("unexpected repositories %v", infra.Repositories)
+	}
+	kernel, _ := directory.Get("Kernel")
+	if len(kernel.Maintainers) != 1 || kernel.Maintainers[0].GiteeID != "bob" || len(kernel.Committers) != 1 {
+		t.Errorf("OWNERS not merged %+v", kernel)
+	}
+	if sig, ok := directory.SigOfRepo("OpenEuler/Website"); !ok || sig != infra {
+		t.Errorf("sig of repo in sig-info.yaml not found")
+	}
+	if sigs := directory.SigsOfMaintainer("Alice"); len(sigs) != 2 {
+		t.Errorf("alice maintains %d sigs, expected 2", len(sigs))
+	}
+}
+
+func TestLoadSigDirectoryWithoutSigsFile(t *testing.T) {
+	root := writeSigFixture(t)
+	if _, _, err := loadSigDirectory(filepath.Join(root, "sig/missing.yaml"), filepath.Join(root, "sig")); err == nil {
+		t.Fatal("missing sigs file is accepted")
+	}
+}
+
+func TestCommunityEndpoints(t *testing.T) {
+	plugin := NewCommunityPlugin(CommunityConfig{Repo: "https://gitee.com/openeuler/community"}).(*CommunityPlugin)
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	plugin.RegisterEndpoints(engine.Group("/community"))
+	get := func(path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest("GET", "/community"+path, nil))
+		return recorder.Code, recorder.Body.String()
+	}
+	//empty list rather than null before sigs loaded
+	if code, body := get("/sigs"); code != 200 || body != "[]" {
+		t.Fatalf("sigs before load returns %d %s", code, body)
+	}
+
+	root := writeSigFixture(t)
+	if err := plugin.Load(map[string][]string{plugin.Config.Repo: {filepath.Join(root, "sig")}}); err != nil {
+		t.Fatal(err)
+	}
+	code, body := get("/sigs")
+	var sigs []Sig
+	if err := json.Unmarshal([]byte(body), &sigs); code != 200 || err != nil || len(sigs) != 3 {
+		t.Fatalf("sigs returns %d %s", code, body)
+	}
+	cases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/sigs/kernel/maintainers", 200, `[{"gitee_id":"bob"}]`},
+		{"/sigs/sig-broken", 404, ""},
+		{"/repos/openeuler/mirrors/sig", 200, ""},
+		{"/repos/openeuler/unknown/sig", 404, ""},
+		{"/maintainers/alice/sigs", 200, `["Infrastructure","sig-compliance"]`},
+	}
+	for _, c := range cases {
+		code, body := get(c.path)
+		if code != c.status || (c.body != "" && body != c.body) {
+			t.Errorf("%s returns %d %s, expected %d %s", c.path, code, body, c.status, c.body)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opensourceways/app-community-metadata/application/gitsync"
+	"sigs.k8s.io/yaml"
+)
+
+const PlaygroundImages = "https://github.com/opensourceways/playground-images"
+const PlaygroundCourses = "https://github.com/opensourceways/playground-courses"
+const OpenEulerMoocStudioCourses = "https://github.com/opensourceways/playground-courses"
+const OpenGaussMoocStudioCourses = "https://gitee.com/opengauss/playground-course"
+
+// CourseCatalogConfig describes one course catalog, it's decoded from [[plugins.instances]] of type coursecatalog
+type CourseCatalogConfig struct {
+	//Registration name
+	Name string `mapstructure:"name"`
+	//Catalog is served at /v1/metadata/<group>/<endpoint>, endpoint is name if empty
+	Group       string `mapstructure:"group"`
+	Endpoint    string `mapstructure:"endpoint"`
+	Description string `mapstructure:"description"`
+	//Courses repo and branch
+	Repo   string `mapstructure:"repo"`
+	Branch string `mapstructure:"branch"`
+	//Extension of template files in environments folder, .tmpl by default
+	TemplateExtension string `mapstructure:"templateExtension"`
+	//Folders of environment templates and courses in repo
+	Environments string `mapstructure:"environments"`
+	Courses      string `mapstructure:"courses"`
+	//Optional images yaml served as json at /images, in courses repo if images repo is empty
+	ImagesRepo   string `mapstructure:"imagesRepo"`
+	ImagesBranch string `mapstructure:"imagesBranch"`
+	ImagesFile   string `mapstructure:"imagesFile"`
+}
+
+func (c *CourseCatalogConfig) setDefaults() {
+	if c.Endpoint == "" {
+		c.Endpoint = c.Name
+	}
+	if c.Branch == "" {
+		c.Branch = "master"
+	}
+	if c.TemplateExtension == "" {
+		c.TemplateExtension = ".tmpl"
+	}
+	if c.Environments == "" {
+		c.Environments = "environments"
+	}
+	if c.Courses == "" {
+		c.Courses = "courses"
+	}
+	if c.ImagesFile != "" && c.ImagesRepo == "" {
+		c.ImagesRepo = c.Repo
+	}
+	if c.ImagesBranch == "" {
+		c.ImagesBranch = c.Branch
+		if c.ImagesRepo != c.Repo {
+			c.ImagesBranch = "master"
+		}
+	}
+	if c.Description == "" {
+		c.Description = fmt.Sprintf("get all courses information of %s", c.Group)
+	}
+}
+
+func (c *CourseCatalogConfig) validate() error {
+	if c.Name == "" || c.Group == "" || c.Repo == "" {
+		return errors.New(fmt.Sprintf("name, group and repo are required for course catalog '%s'", c.Name))
+	}
+	if gitsync.GetRepoLocalName(c.Repo) == "" {
+		return errors.New(fmt.Sprintf("invalid repo %s of course catalog %s", c.Repo, c.Name))
+	}
+	if c.ImagesRepo == c.Repo && c.ImagesBranch != c.Branch {
+		return errors.New(fmt.Sprintf("images of course catalog %s should be in branch %s of courses repo",
+			c.Name, c.Branch))
+	}
+	return nil
+}
+
+// CourseCatalogPlugin serves environment templates and course files of a courses repo, images are served if
+// configured
+type CourseCatalogPlugin struct {
+	Config    CourseCatalogConfig
+	Images    atomic.Value
+	Templates atomic.Value
+	//templates of extra refs
+	RefTemplates sync.Map
+	//folder of courses served
+	CoursesFolder atomic.Value
+}
+
+func NewCourseCatalogPlugin(conf CourseCatalogConfig) gitsync.Plugin {
+	conf.setDefaults()
+	return &CourseCatalogPlugin{Config: conf}
+}
+
+// NewCourseCatalogInstance creates course catalog of [[plugins.instances]] entry, settings are passed to Configure
+func NewCourseCatalogInstance(instance *gitsync.PluginInstance) (gitsync.Plugin, error) {
+	return &CourseCatalogPlugin{Config: CourseCatalogConfig{Name: instance.Name, Endpoint: instance.Endpoint}}, nil
+}
+
+// NewConfig returns current config, settings in config section override it
+func (h *CourseCatalogPlugin) NewConfig() interface{} {
+	conf := h.Config
+	return &conf
+}
+
+func (h *CourseCatalogPlugin) Configure(config interface{}) error {
+	conf := config.(*CourseCatalogConfig)
+	//registration name can't be changed
+	conf.Name = h.Config.Name
+	conf.setDefaults()
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	h.Config = *conf
+	return nil
+}
+
+func (h *CourseCatalogPlugin) GetMeta() *gitsync.PluginMeta {
+	courses := gitsync.GitMeta{
+		Repo:       h.Config.Repo,
+		Branch:     h.Config.Branch,
+		SubModules: "recursive",
+		Schema:     gitsync.Https,
+		WatchFiles: []string{
+			h.Config.Environments,
+			h.Config.Courses,
+		},
+	}
+	var repos []gitsync.GitMeta
+	if h.Config.ImagesFile != "" {
+		if h.Config.ImagesRepo == h.Config.Repo {
+			courses.WatchFiles = append(courses.WatchFiles, h.Config.ImagesFile)
+		} else {
+			repos = append(repos, gitsync.GitMeta{
+				Repo:       h.Config.ImagesRepo,
+				Branch:     h.Config.ImagesBranch,
+				SubModules: "recursive",
+				Schema:     gitsync.Https,
+				WatchFiles: []string{
+					h.Config.ImagesFile,
+				},
+			})
+		}
+	}
+	return &gitsync.PluginMeta{
+		Name:        h.Config.Endpoint,
+		Group:       h.Config.Group,
+		Description: h.Config.Description,
+		Repos:       append(repos, courses),
+	}
+}
+
+// isWatchFile returns true if file is the watch file in repo
+func isWatchFile(file, watchFile string) bool {
+	return strings.HasSuffix(filepath.ToSlash(file), "/"+strings.Trim(watchFile, "/"))
+}
+
+func (h *CourseCatalogPlugin) Load(files map[string][]string) error {
+	if h.Config.ImagesFile != "" {
+		for _, f := range files[h.Config.ImagesRepo] {
+			if !isWatchFile(f, h.Config.ImagesFile) {
+				continue
+			}
+			if err := h.loadImages(f); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range files[h.Config.Repo] {
+		if _, err := os.Lstat(f); err != nil {
+			fmt.Println(fmt.Sprintf("failed to get file %s in plugin.", err))
+			continue
+		}
+		if isWatchFile(f, h.Config.Environments) {
+			templates, err := h.loadTemplates(f)
+			if err != nil {
+				return err
+			}
+			h.Templates.Store(templates)
+		} else if isWatchFile(f, h.Config.Courses) {
+			h.CoursesFolder.Store(f)
+		} else if h.Config.ImagesFile == "" || !isWatchFile(f, h.Config.ImagesFile) {
+			return errors.New(fmt.Sprintf("unrecognized file %s", filepath.Base(f)))
+		}
+	}
+	return nil
+}
+
+func (h *CourseCatalogPlugin) loadImages(file string) error {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	images, err := yaml.YAMLToJSON(bytes)
+	if err != nil {
+		return err
+	}
+	h.Images.Store(images)
+	return nil
+}
+
+// LoadRef loads templates of extra refs, images and courses are only served from the default branch
+func (h *CourseCatalogPlugin) LoadRef(ref string, files map[string][]string) error {
+	for _, f := range files[h.Config.Repo] {
+		if !isWatchFile(f, h.Config.Environments) {
+			continue
+		}
+		templates, err := h.loadTemplates(f)
+		if err != nil {
+			return err
+		}
+		h.RefTemplates.Store(ref, templates)
+	}
+	return nil
+}
+
+// loadTemplates reads templates in environments folder, they are keyed by path relative to courses repo root
+func (h *CourseCatalogPlugin) loadTemplates(folder string) (*CourseTemplates, error) {
+	root := strings.TrimSuffix(filepath.ToSlash(folder), "/"+strings.Trim(h.Config.Environments, "/"))
+	return loadCourseTemplates(filepath.FromSlash(root), folder, h.Config.TemplateExtension)
+}
+
+func (h *CourseCatalogPlugin) RegisterEndpoints(group *gin.RouterGroup) {
+	if h.Config.ImagesFile != "" {
+		group.GET("/images", h.ReadImages)
+	}
+	group.GET("/templates", h.ReadTemplates)
+	group.POST("/templates/render", h.RenderTemplate)
+	group.GET("/courses/*filepath", h.ReadCourses)
+}
+
+func (h *CourseCatalogPlugin) ReadImages(c *gin.Context) {
+	images := h.Images.Load()
+	if images == nil {
+		c.Data(200, "application/json", []byte(""))
+	} else {
+		c.Data(200, "application/json", images.([]byte))
+	}
+}
+
+// ReadCourses serves files in courses folder, folder is switched when reloaded
+func (h *CourseCatalogPlugin) ReadCourses(c *gin.Context) {
+	folder := h.CoursesFolder.Load()
+	if folder == nil {
+		c.Data(404, "text/plain", []byte("404 page not found"))
+		return
+	}
+	c.FileFromFS(c.Param("filepath"), gin.Dir(folder.(string), false))
+}
+
+// getTemplates returns templates of ref, default branch if ref is empty, error is responded if not found
+func (h *CourseCatalogPlugin) getTemplates(c *gin.Context, ref string) (*CourseTemplates, bool) {
+	var loaded interface{}
+	if len(ref) != 0 {
+		loaded, _ = h.RefTemplates.Load(ref)
+		if loaded == nil {
+			c.Data(404, "text/html", []byte(fmt.Sprintf("ref %s not found", ref)))
+			return nil, false
+		}
+	} else {
+		loaded = h.Templates.Load()
+	}
+	if loaded == nil {
+		c.Data(500, "text/html", []byte("server not ready"))
+		return nil, false
+	}
+	return loaded.(*CourseTemplates), true
+}
+
+// ReadTemplates returns content of template with exact path in 'file', or index of templates matching 'prefix' and
+// 'glob', all templates are listed if none of them is specified
+func (h *CourseCatalogPlugin) ReadTemplates(c *gin.Context) {
+	templates, ok := h.getTemplates(c, c.Query("ref"))
+	if !ok {
+		return
+	}
+	if fileQuery := c.Query("file"); len(fileQuery) != 0 {
+		template, ok := templates.Get(fileQuery)
+		if !ok {
+			c.Data(404, "text/html", []byte(fmt.Sprintf("%s not found", fileQuery)))
+		} else {
+			c.Data(200, "application/json", template.Content)
+		}
+		return
+	}
+	index, err := templates.Search(c.Query("prefix"), c.Query("glob"))
+	if err != nil {
+		c.Data(400, "text/html", []byte(fmt.Sprintf("invalid glob %s", c.Query("glob"))))
+		return
+	}
+	c.JSON(200, index)
+}
+
+// RenderTemplate renders template with params in request body, required params are declared in front matter of
+// template
+func (h *CourseCatalogPlugin) RenderTemplate(c *gin.Context) {
+	var request RenderRequest
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxRenderRequestSize)
+	if err := c.ShouldBindJSON(&request); err != nil || len(request.File) == 0 {
+		c.Data(400, "text/html", []byte("invalid request, 'file' and optional 'ref' and 'params' are expected"))
+		return
+	}
+	templates, ok := h.getTemplates(c, request.Ref)
+	if !ok {
+		return
+	}
+	template, ok := templates.Get(request.File)
+	if !ok {
+		c.Data(404, "text/html", []byte(fmt.Sprintf("%s not found", request.File)))
+		return
+	}
+	result := RenderResult{
+		Path:   template.Path,
+		Ref:    request.Ref,
+		Commit: template.Commit,
+		Hash:   template.Hash,
+	}
+	result.Rendered, result.Errors = renderTemplate(c.Request.Context(), template, request.Params)
+	if len(result.Errors) != 0 {
+		c.JSON(422, result)
+		return
+	}
+	c.JSON(200, result)
+}
+
+func (h *CourseCatalogPlugin) GetEndpoints() []gitsync.Endpoint {
+	var endpoints []gitsync.Endpoint
+	if h.Config.ImagesFile != "" {
+		endpoints = append(endpoints, gitsync.Endpoint{
+			Path:        "/images",
+			Summary:     "get playground images",
+			Description: fmt.Sprintf("content of %s converted into json", h.Config.ImagesFile),
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "playground images",
+					Schema:      map[string]interface{}{"type": "object"},
+				},
+			},
+		})
+	}
+	return append(endpoints, []gitsync.Endpoint{
+		{
+			Path:    "/templates",
+			Summary: "get environment template or index of templates",
+			Description: "content of template is returned if file is specified, otherwise index of templates " +
+				"matching prefix and glob, all templates are listed if none of them is specified",
+			Parameters: []gitsync.EndpointParameter{
+				{
+					Name:        "file",
+					Description: "template path relative to courses repo root, or file name of unique template, e.g. a.tmpl",
+				},
+				{
+					Name:        "prefix",
+					Description: "path prefix of templates listed",
+				},
+				{
+					Name:        "glob",
+					Description: "glob pattern of templates listed, e.g. environments/*/*.tmpl",
+				},
+				{
+					Name:        "ref",
+					Description: "branch or tag of courses repo, default branch if empty",
+				},
+			},
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "template content, or index with path, size, hash and last commit of templates",
+					Schema:      map[string]interface{}{"type": "string"},
+				},
+				{
+					Status:      400,
+					Description: "invalid glob pattern",
+					ContentType: "text/html",
+				},
+				{
+					Status:      404,
+					Description: "template not found",
+					ContentType: "text/html",
+				},
+			},
+		},
+		{
+			Method:  "POST",
+			Path:    "/templates/render",
+			Summary: "render environment template",
+			Description: "render template with json body {\"file\": path, \"ref\": ref, \"params\": {}}, file is " +
+				"resolved the same as /templates, required parameters and defaults are declared in front matter of " +
+				"template",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "rendered template",
+					Schema:      map[string]interface{}{"type": "object"},
+				},
+				{
+					Status:      400,
+					Description: "invalid request",
+					ContentType: "text/html",
+				},
+				{
+					Status:      404,
+					Description: "template not found",
+					ContentType: "text/html",
+				},
+				{
+					Status:      422,
+					Description: "errors of front matter, parameters, parsing or execution",
+					Schema:      map[string]interface{}{"type": "object"},
+				},
+			},
+		},
+		{
+			Path:    "/courses/*filepath",
+			Summary: "get course files",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "course file",
+					ContentType: "application/octet-stream",
+				},
+			},
+		},
+	}...)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const TemplateCommitTimeout = 30
+
+// CourseTemplate is one environment template, path is relative to courses repo root
+type CourseTemplate struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	//sha256 of content
+	Hash string `json:"hash"`
+	//Last commit changed the template, empty if history of checkout is unavailable
+	Commit      string `json:"commit,omitempty"`
+	CommittedAt string `json:"committedAt,omitempty"`
+	Content     []byte `json:"-"`
+}
+
+// CourseTemplates are templates loaded from one checkout, paths are sorted
+type CourseTemplates struct {
+	Templates map[string]*CourseTemplate
+	Paths     []string
+}
+
+// Get returns template of exact path, a file name without folder matches the only template of that name, for
+// instance, a.tmpl matches environments/x/a.tmpl unless there are other a.tmpl in other folders
+func (t *CourseTemplates) Get(file string) (*CourseTemplate, bool) {
+	file = cleanTemplatePath(file)
+	if template, ok := t.Templates[file]; ok {
+		return template, true
+	}
+	if strings.Contains(file, "/") {
+		return nil, false
+	}
+	var matched *CourseTemplate
+	for _, p := range t.Paths {
+		if path.Base(p) != file {
+			continue
+		}
+		if matched != nil {
+			return nil, false
+		}
+		matched = t.Templates[p]
+	}
+	return matched, matched != nil
+}
+
+// Search returns templates whose path has prefix and matches glob pattern, empty prefix and pattern match all
+func (t *CourseTemplates) Search(prefix, pattern string) ([]*CourseTemplate, error) {
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	prefix = strings.TrimPrefix(prefix, "/")
+	result := make([]*CourseTemplate, 0)
+	for _, p := range t.Paths {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		if pattern != "" {
+			if matched, _ := path.Match(strings.TrimPrefix(pattern, "/"), p); !matched {
+				continue
+			}
+		}
+		result = append(result, t.Templates[p])
+	}
+	return result, nil
+}
+
+func cleanTemplatePath(file string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(file)), "/")
+}
+
+// loadCourseTemplates reads templates with extension in folder, root is the checkout folder contains it
+func loadCourseTemplates(root, folder, extension string) (*CourseTemplates, error) {
+	templates := &CourseTemplates{Templates: make(map[string]*CourseTemplate)}
+	err := filepath.Walk(folder, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(file, extension) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		template := &CourseTemplate{
+			Path:    filepath.ToSlash(relative),
+			Size:    int64(len(content)),
+			Hash:    hex.EncodeToString(sum[:]),
+			Content: content,
+		}
+		templates.Templates[template.Path] = template
+		templates.Paths = append(templates.Paths, template.Path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(templates.Paths)
+	relative, err := filepath.Rel(root, folder)
+	if err != nil {
+		return nil, err
+	}
+	for p, commit := range lastCommits(root, filepath.ToSlash(relative)) {
+		if template, ok := templates.Templates[p]; ok {
+			template.Commit, template.CommittedAt = commit[0], commit[1]
+		}
+	}
+	return templates, nil
+}
+
+// lastCommits returns hash and commit time of the last commit changed every file in folder of checkout, nothing
+// is returned if root is not a git checkout, for instance, an exported pin. The oldest commit of shallow clone
+// is reported for files not changed since then.
+func lastCommits(root, folder string) map[string][2]string {
+	commits := make(map[string][2]string)
+	if _, err := os.Stat(filepath.Join(root, ".git")); err != nil {
+		return commits
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*TemplateCommitTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "git", "-C", root, "-c", "core.quotepath=off", "log",
+		"--no-renames", "--name-only", "--format=%x00%H %cI", "--", folder).Output()
+	if err != nil {
+		return commits
+	}
+	var current [2]string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\x00") {
+			fields := strings.Fields(line[1:])
+			if len(fields) == 2 {
+				current = [2]string{fields[0], fields[1]}
+			}
+			continue
+		}
+		if _, ok := commits[line]; line != "" && !ok {
+			commits[line] = current
+		}
+	}
+	return commits
+}
@@ -17,10 +17,43 @@ import "github.com/opensourceways/app-community-metadata/application/gitsync"
 
 func init() {
 	gitsync.Register("helloworld", NewHelloWorldPlugin())
-	gitsync.Register("openeulercommunity", NewOpenEulerCommunityPlugin())
+	gitsync.Register("openeulercommunity", NewCommunityPlugin(CommunityConfig{
+		Name:        "openeulercommunity",
+		Group:       "openeuler",
+		Endpoint:    "community",
+		Description: "get openEuler community information",
+		Repo:        CommunityRepo,
+	}))
 	gitsync.Register("openeulermirrors", NewOpenEulerMirrorsPlugin())
-	gitsync.Register("playgroundmeta", NewPlaygoundMetaPlugin())
-	gitsync.Register("openeulermoocstudio", NewOpenEulerMoocStudioMetaPlugins())
-	gitsync.Register("opengaussmoocstudio", NewOpenGaussMoocStudioMetaPlugins())
+	gitsync.Register("playgroundmeta", NewCourseCatalogPlugin(CourseCatalogConfig{
+		Name:         "playgroundmeta",
+		Group:        "infrastructure",
+		Endpoint:     "playground-meta",
+		Description:  "get all playground meta information",
+		Repo:         PlaygroundCourses,
+		Branch:       "main",
+		ImagesRepo:   PlaygroundImages,
+		ImagesBranch: "main",
+		ImagesFile:   "deploy/lxd-images.yaml",
+	}))
+	gitsync.Register("openeulermoocstudio", NewCourseCatalogPlugin(CourseCatalogConfig{
+		Name:        "openeulermoocstudio",
+		Group:       "openeuler",
+		Endpoint:    "moocstudio",
+		Description: "get all mooc studio courses information for openEuler",
+		Repo:        OpenEulerMoocStudioCourses,
+		Branch:      "main",
+	}))
+	gitsync.Register("opengaussmoocstudio", NewCourseCatalogPlugin(CourseCatalogConfig{
+		Name:        "opengaussmoocstudio",
+		Group:       "opengauss",
+		Endpoint:    "moocstudio",
+		Description: "get all mooc studio courses information for openGauss",
+		Repo:        OpenGaussMoocStudioCourses,
+		Branch:      "master",
+	}))
 	gitsync.Register("openeuleropendesign", NewOpenDesignResourcesPlugins())
+	//plugin types instantiated with [[plugins.instances]]
+	gitsync.RegisterPluginFactory("community", NewCommunityInstance)
+	gitsync.RegisterPluginFactory("coursecatalog", NewCourseCatalogInstance)
 }
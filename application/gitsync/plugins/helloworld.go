@@ -86,3 +86,20 @@ func (h *HelloWorldPlugin) ReadmeContent(c *gin.Context) {
 		c.JSON(200, content.(string))
 	}
 }
+
+func (h *HelloWorldPlugin) GetEndpoints() []gitsync.Endpoint {
+	return []gitsync.Endpoint{
+		{
+			Path:    "/readme",
+			Summary: "get README content of sample repo",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "README content in string",
+					Schema:      map[string]interface{}{"type": "string"},
+					Example:     "# SampleApp",
+				},
+			},
+		},
+	}
+}
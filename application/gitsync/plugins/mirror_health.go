@@ -0,0 +1,401 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultProbeInterval = 300
+const DefaultProbeTimeout = 10
+const DefaultProbeConcurrency = 8
+const DefaultMaxLag = 86400
+const DefaultFailureThreshold = 2
+const DefaultProbeHistory = 20
+const MaxProbeFileSize = 1024 * 1024
+const RsyncPort = "873"
+
+// timestamp layouts of probe file besides unix seconds
+var timestampLayouts = []string{time.RFC3339, time.RFC1123, time.RFC1123Z, time.UnixDate, "2006-01-02 15:04:05"}
+
+// ProbeConfig is the health probe settings of mirrors
+type ProbeConfig struct {
+	//Seconds between probes, 300 by default, probing is disabled if negative
+	ProbeInterval    int `mapstructure:"probeInterval"`
+	ProbeTimeout     int `mapstructure:"probeTimeout"`
+	ProbeConcurrency int `mapstructure:"probeConcurrency"`
+	//File fetched relative to base url of mirrors and origin to compute lag, e.g. timestamp or repodata/repomd.xml,
+	//only availability is probed if empty
+	ProbeFile string `mapstructure:"probeFile"`
+	//Base url of origin, lag is relative to the freshest mirror if empty
+	Origin string `mapstructure:"origin"`
+	//Mirrors lagging behind origin more than seconds are stale
+	MaxLag int `mapstructure:"maxLag"`
+	//Consecutive failures before mirror is down
+	FailureThreshold int `mapstructure:"failureThreshold"`
+	//Probe results kept for every mirror
+	HistorySize int `mapstructure:"historySize"`
+}
+
+func (c *ProbeConfig) setDefaults() {
+	if c.ProbeInterval == 0 {
+		c.ProbeInterval = DefaultProbeInterval
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = DefaultProbeTimeout
+	}
+	if c.ProbeConcurrency <= 0 {
+		c.ProbeConcurrency = DefaultProbeConcurrency
+	}
+	if c.MaxLag <= 0 {
+		c.MaxLag = DefaultMaxLag
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = DefaultFailureThreshold
+	}
+	if c.HistorySize <= 0 {
+		c.HistorySize = DefaultProbeHistory
+	}
+}
+
+// ProbeResult is result of one probe of mirror
+type ProbeResult struct {
+	Time      time.Time `json:"time"`
+	Protocol  string    `json:"protocol"`
+	Up        bool      `json:"up"`
+	LatencyMs int64     `json:"latencyMs"`
+	//Timestamp in probe file, nil if unknown
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// MirrorStatus is health of mirror, mirrors not probed yet are regarded as healthy
+type MirrorStatus struct {
+	Name string `json:"name"`
+	Up   bool   `json:"up"`
+	//Lag exceeds max lag
+	Stale bool `json:"stale"`
+	//Seconds behind origin, nil if unknown
+	Lag       *int64    `json:"lag,omitempty"`
+	LatencyMs int64     `json:"latencyMs"`
+	CheckedAt time.Time `json:"checkedAt"`
+	//Consecutive failures of http or the only protocol probed
+	Failures int `json:"failures"`
+	//Ratio of successful probes in history
+	Availability float64 `json:"availability"`
+	//Rsync is probed besides http, nil if not probed
+	RsyncUp *bool         `json:"rsyncUp,omitempty"`
+	History []ProbeResult `json:"history"`
+}
+
+func (s *MirrorStatus) copy() *MirrorStatus {
+	c := *s
+	c.History = append([]ProbeResult(nil), s.History...)
+	return &c
+}
+
+// MirrorProber probes mirrors periodically with bounded concurrency
+type MirrorProber struct {
+	config   ProbeConfig
+	client   *http.Client
+	mutex    sync.RWMutex
+	statuses map[string]*MirrorStatus
+	origin   *ProbeResult
+}
+
+func NewMirrorProber(config ProbeConfig) *MirrorProber {
+	config.setDefaults()
+	return &MirrorProber{
+		config:   config,
+		client:   &http.Client{Timeout: time.Duration(config.ProbeTimeout) * time.Second},
+		statuses: make(map[string]*MirrorStatus),
+	}
+}
+
+// Run probes mirrors returned by mirrors every interval until ctx is done
+func (p *MirrorProber) Run(ctx context.Context, mirrors func() []*Mirror) {
+	if p.config.ProbeInterval < 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(p.config.ProbeInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		p.ProbeAll(ctx, mirrors())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProbeAll probes origin and all mirrors once and updates their status
+func (p *MirrorProber) ProbeAll(ctx context.Context, mirrors []*Mirror) {
+	var origin *ProbeResult
+	if p.config.Origin != "" {
+		origin = p.probeHTTP(ctx, strings.SplitN(p.config.Origin, "://", 2)[0], p.config.Origin)
+	}
+	type probes struct {
+		primary *ProbeResult
+		rsync   *ProbeResult
+	}
+	results := make([]probes, len(mirrors))
+	semaphore := make(chan struct{}, p.config.ProbeConcurrency)
+	var wg sync.WaitGroup
+	for i, m := range mirrors {
+		wg.Add(1)
+		go func(i int, m *Mirror) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			if u := m.HTTPS; u != "" {
+				results[i].primary = p.probeHTTP(ctx, "https", u)
+			} else if u = m.HTTP; u != "" {
+				results[i].primary = p.probeHTTP(ctx, "http", u)
+			}
+			if m.Rsync != "" {
+				results[i].rsync = p.probeRsync(ctx, m.Rsync)
+				if results[i].primary == nil {
+					results[i].primary, results[i].rsync = results[i].rsync, nil
+				}
+			}
+		}(i, m)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+	//lag is relative to origin, or the freshest mirror if origin is unknown
+	var reference *time.Time
+	if origin != nil {
+		reference = origin.Timestamp
+	} else {
+		for _, r := range results {
+			if r.primary != nil && r.primary.Timestamp != nil &&
+				(reference == nil || r.primary.Timestamp.After(*reference)) {
+				reference = r.primary.Timestamp
+			}
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.origin = origin
+	current := make(map[string]*MirrorStatus, len(mirrors))
+	for i, m := range mirrors {
+		status, ok := p.statuses[m.Name]
+		if !ok {
+			status = &MirrorStatus{Name: m.Name, Up: true}
+		}
+		current[m.Name] = status
+		if results[i].primary == nil {
+			continue
+		}
+		p.update(status, results[i].primary, results[i].rsync, reference)
+	}
+	//mirrors removed are forgotten
+	p.statuses = current
+}
+
+func (p *MirrorProber) update(status *MirrorStatus, primary, rsync *ProbeResult, reference *time.Time) {
+	status.CheckedAt = primary.Time
+	status.LatencyMs = primary.LatencyMs
+	if primary.Up {
+		status.Failures = 0
+	} else {
+		status.Failures += 1
+	}
+	status.Up = status.Failures < p.config.FailureThreshold
+	status.Lag, status.Stale = nil, false
+	if primary.Up && primary.Timestamp != nil && reference != nil {
+		lag := int64(reference.Sub(*primary.Timestamp).Seconds())
+		if lag < 0 {
+			lag = 0
+		}
+		status.Lag = &lag
+		status.Stale = lag > int64(p.config.MaxLag)
+	}
+	status.RsyncUp = nil
+	status.History = append(status.History, *primary)
+	if rsync != nil {
+		status.RsyncUp = &rsync.Up
+		status.History = append(status.History, *rsync)
+	}
+	if len(status.History) > p.config.HistorySize {
+		status.History = status.History[len(status.History)-p.config.HistorySize:]
+	}
+	up := 0
+	for _, r := range status.History {
+		if r.Up {
+			up += 1
+		}
+	}
+	status.Availability = float64(up) / float64(len(status.History))
+}
+
+// Available returns false if mirror is down or stale, or protocol is rsync and rsync is down
+func (p *MirrorProber) Available(m *Mirror, protocol string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	status, ok := p.statuses[m.Name]
+	if !ok {
+		return true
+	}
+	if protocol == "rsync" && status.RsyncUp != nil && !*status.RsyncUp {
+		return false
+	}
+	return status.Up && !status.Stale
+}
+
+// Statuses returns copy of origin probe and mirror statuses sorted by name
+func (p *MirrorProber) Statuses() (*ProbeResult, []*MirrorStatus) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	statuses := make([]*MirrorStatus, 0, len(p.statuses))
+	for _, s := range p.statuses {
+		statuses = append(statuses, s.copy())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return p.origin, statuses
+}
+
+// probeHTTP fetches probe file, or base url if probe file is empty, timestamp is read from content or Last-Modified
+func (p *MirrorProber) probeHTTP(ctx context.Context, protocol, base string) *ProbeResult {
+	result := &ProbeResult{Time: time.Now(), Protocol: protocol}
+	target := base
+	if p.config.ProbeFile != "" {
+		target = strings.TrimRight(base, "/") + "/" + strings.TrimLeft(p.config.ProbeFile, "/")
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, MaxProbeFileSize))
+	result.LatencyMs = time.Since(result.Time).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if response.StatusCode != http.StatusOK {
+		result.Error = fmt.Sprintf("unexpected status %d of %s", response.StatusCode, target)
+		return result
+	}
+	result.Up = true
+	if p.config.ProbeFile != "" {
+		if t, ok := parseProbeTimestamp(content); ok {
+			result.Timestamp = &t
+			return result
+		}
+	}
+	if t, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		result.Timestamp = &t
+	}
+	return result
+}
+
+// probeRsync connects rsync daemon and reads its greeting
+func (p *MirrorProber) probeRsync(ctx context.Context, base string) *ProbeResult {
+	result := &ProbeResult{Time: time.Now(), Protocol: "rsync"}
+	u, err := url.Parse(base)
+	if err != nil || u.Hostname() == "" {
+		result.Error = fmt.Sprintf("invalid rsync url %s", base)
+		return result
+	}
+	port := u.Port()
+	if port == "" {
+		port = RsyncPort
+	}
+	timeout := time.Duration(p.config.ProbeTimeout) * time.Second
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	result.LatencyMs = time.Since(result.Time).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if !strings.HasPrefix(greeting, "@RSYNCD:") {
+		result.Error = fmt.Sprintf("unexpected rsync greeting %q", strings.TrimSpace(greeting))
+		return result
+	}
+	result.Up = true
+	return result
+}
+
+// parseProbeTimestamp reads timestamp of repomd.xml, unix seconds or time in common layouts
+func parseProbeTimestamp(content []byte) (time.Time, bool) {
+	text := strings.TrimSpace(string(content))
+	if strings.Contains(text, "<repomd") {
+		var repomd struct {
+			Revision string `xml:"revision"`
+			Data     []struct {
+				Timestamp string `xml:"timestamp"`
+			} `xml:"data"`
+		}
+		if xml.Unmarshal(content, &repomd) != nil {
+			return time.Time{}, false
+		}
+		values := []string{repomd.Revision}
+		for _, d := range repomd.Data {
+			values = append(values, d.Timestamp)
+		}
+		var latest int64
+		for _, value := range values {
+			if seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && int64(seconds) > latest {
+				latest = int64(seconds)
+			}
+		}
+		return time.Unix(latest, 0), latest > 0
+	}
+	//first line only, for instance, output of date
+	if index := strings.IndexByte(text, '\n'); index >= 0 {
+		text = strings.TrimSpace(text[:index])
+	}
+	if seconds, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
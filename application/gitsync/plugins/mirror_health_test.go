@@ -0,0 +1,287 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mirrorServer serves probe file with configurable status and content
+type mirrorServer struct {
+	lock         sync.Mutex
+	status       int
+	content      string
+	lastModified time.Time
+}
+
+func (s *mirrorServer) set(status int, content string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status, s.content = status, content
+}
+
+func (s *mirrorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.lastModified.IsZero() {
+		w.Header().Set("Last-Modified", s.lastModified.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(s.status)
+	_, _ = w.Write([]byte(s.content))
+}
+
+func newTestMirrorServer(t *testing.T, status int, content string) (*mirrorServer, *httptest.Server) {
+	server := &mirrorServer{status: status, content: content}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+// newTestRsyncServer accepts connections and writes greeting, address of a closed port is returned if greeting
+// is empty
+func newTestRsyncServer(t *testing.T, greeting string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	if greeting == "" {
+		_ = listener.Close()
+		return "rsync://" + address + "/openeuler"
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(greeting))
+			_ = conn.Close()
+		}
+	}()
+	return "rsync://" + address + "/openeuler"
+}
+
+func TestParseProbeTimestamp(t *testing.T) {
+	expected := time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	cases := []struct {
+		content string
+		ok      bool
+	}{
+		{fmt.Sprintf("%d\n", expected.Unix()), true},
+		{fmt.Sprintf("%d\nsynced by mirror", expected.Unix()), true},
+		{expected.Format(time.RFC3339), true},
+		{expected.Format(time.RFC1123), true},
+		{expected.Format(time.UnixDate), true},
+		{expected.Format("2006-01-02 15:04:05"), true},
+		//the latest of revision and timestamps of data
+		{fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo">
+  <revision>%d</revision>
+  <data type="primary"><timestamp>%d</timestamp></data>
+  <data type="filelists"><timestamp>%d</timestamp></data>
+</repomd>`, expected.Unix()-100, expected.Unix(), expected.Unix()-10), true},
+		{"<repomd><revision>invalid</revision></repomd>", false},
+		{"<repomd>", false},
+		{"not a timestamp", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		timestamp, ok := parseProbeTimestamp([]byte(c.content))
+		if ok != c.ok {
+			t.Fatalf("timestamp of %q parsed %v, expected %v", c.content, ok, c.ok)
+		}
+		if ok && !timestamp.Equal(expected) {
+			t.Fatalf("timestamp of %q is %v, expected %v", c.content, timestamp, expected)
+		}
+	}
+}
+
+func TestProbeHTTP(t *testing.T) {
+	timestamp := time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	server, httpServer := newTestMirrorServer(t, 200, fmt.Sprintf("%d", timestamp.Unix()))
+	server.lastModified = timestamp.Add(-time.Hour)
+	prober := NewMirrorProber(ProbeConfig{ProbeFile: "/timestamp"})
+	result := prober.probeHTTP(context.Background(), "http", httpServer.URL+"/")
+	if !result.Up || result.Timestamp == nil || !result.Timestamp.Equal(timestamp) {
+		t.Fatalf("unexpected result %+v, timestamp should be read from probe file", result)
+	}
+
+	//Last-Modified is used if content is not a timestamp or probe file is not configured
+	server.set(200, "<html></html>")
+	result = prober.probeHTTP(context.Background(), "http", httpServer.URL)
+	if !result.Up || result.Timestamp == nil || !result.Timestamp.Equal(server.lastModified) {
+		t.Fatalf("unexpected result %+v, timestamp should be read from Last-Modified", result)
+	}
+	server.set(200, fmt.Sprintf("%d", timestamp.Unix()))
+	result = NewMirrorProber(ProbeConfig{}).probeHTTP(context.Background(), "http", httpServer.URL)
+	if !result.Up || result.Timestamp == nil || !result.Timestamp.Equal(server.lastModified) {
+		t.Fatalf("unexpected result %+v, content should be ignored without probe file", result)
+	}
+
+	server.set(404, "not found")
+	if result = prober.probeHTTP(context.Background(), "http", httpServer.URL); result.Up || result.Error == "" {
+		t.Fatalf("unexpected result %+v, mirror answering 404 is up", result)
+	}
+	httpServer.Close()
+	if result = prober.probeHTTP(context.Background(), "http", httpServer.URL); result.Up || result.Error == "" {
+		t.Fatalf("unexpected result %+v, unreachable mirror is up", result)
+	}
+}
+
+func TestProbeRsync(t *testing.T) {
+	prober := NewMirrorProber(ProbeConfig{ProbeTimeout: 1})
+	cases := []struct {
+		base string
+		up   bool
+	}{
+		{newTestRsyncServer(t, "@RSYNCD: 31.0\n"), true},
+		{newTestRsyncServer(t, "HTTP/1.1 400 Bad Request\r\n"), false},
+		//connection closed before greeting
+		{newTestRsyncServer(t, "@RSYNCD"), false},
+		{newTestRsyncServer(t, ""), false},
+		{"rsync:///openeuler", false},
+	}
+	for _, c := range cases {
+		result := prober.probeRsync(context.Background(), c.base)
+		if result.Up != c.up || result.Protocol != "rsync" || (!c.up && result.Error == "") {
+			t.Fatalf("unexpected result %+v of %s", result, c.base)
+		}
+	}
+}
+
+func TestProbeAllUpdatesStatus(t *testing.T) {
+	now := time.Now().Unix()
+	_, origin := newTestMirrorServer(t, 200, fmt.Sprintf("%d", now))
+	_, fresh := newTestMirrorServer(t, 200, fmt.Sprintf("%d", now-60))
+	_, stale := newTestMirrorServer(t, 200, fmt.Sprintf("%d", now-7200))
+	broken, down := newTestMirrorServer(t, 500, "")
+	mirrors := []*Mirror{
+		{Name: "fresh", HTTPS: fresh.URL},
+		{Name: "stale", HTTP: stale.URL},
+		{Name: "down", HTTPS: down.URL},
+		{Name: "rsync", Rsync: newTestRsyncServer(t, "@RSYNCD: 31.0\n")},
+	}
+	prober := NewMirrorProber(ProbeConfig{ProbeFile: "timestamp", Origin: origin.URL, MaxLag: 3600,
+		FailureThreshold: 2, HistorySize: 3})
+	statusOf := func() map[string]*MirrorStatus {
+		_, statuses := prober.Statuses()
+		result := make(map[string]*MirrorStatus)
+		for _, s := range statuses {
+			result[s.Name] = s
+		}
+		return result
+	}
+
+	prober.ProbeAll(context.Background(), mirrors)
+	statuses := statusOf()
+	if s := statuses["fresh"]; !s.Up || s.Stale || s.Lag == nil || *s.Lag < 60 || *s.Lag > 120 {
+		t.Fatalf("unexpected status %+v of fresh mirror", s)
+	}
+	if s := statuses["stale"]; !s.Up || !s.Stale || !prober.Available(mirrors[0], "") ||
+		prober.Available(mirrors[1], "") {
+		t.Fatalf("unexpected status %+v of stale mirror", s)
+	}
+	//one failure is below threshold
+	if s := statuses["down"]; !s.Up || s.Failures != 1 || s.Availability != 0 || !prober.Available(mirrors[2], "") {
+		t.Fatalf("unexpected status %+v of mirror failed once", s)
+	}
+	if s := statuses["rsync"]; !s.Up || s.History[0].Protocol != "rsync" || s.RsyncUp != nil {
+		t.Fatalf("unexpected status %+v of rsync only mirror", s)
+	}
+
+	prober.ProbeAll(context.Background(), mirrors)
+	if s := statusOf()["down"]; s.Up || s.Failures != 2 || prober.Available(mirrors[2], "") {
+		t.Fatalf("unexpected status %+v of mirror failed twice", s)
+	}
+	broken.set(200, fmt.Sprintf("%d", now))
+	prober.ProbeAll(context.Background(), mirrors)
+	prober.ProbeAll(context.Background(), mirrors)
+	statuses = statusOf()
+	if s := statuses["down"]; !s.Up || s.Failures != 0 || len(s.History) != 3 || s.Availability < 0.6 ||
+		s.Availability > 0.7 || !prober.Available(mirrors[2], "") {
+		t.Fatalf("unexpected status %+v of recovered mirror, history should be trimmed to 3", s)
+	}
+
+	//mirrors removed are forgotten, lag is relative to the freshest mirror without origin
+	prober = NewMirrorProber(ProbeConfig{ProbeFile: "timestamp", MaxLag: 3600})
+	prober.ProbeAll(context.Background(), mirrors[:2])
+	statuses = statusOf()
+	if len(statuses) != 2 || statuses["fresh"].Lag == nil || *statuses["fresh"].Lag != 0 ||
+		statuses["stale"].Lag == nil || *statuses["stale"].Lag != 7140 {
+		t.Fatalf("unexpected statuses %v, lag should be relative to the freshest mirror", statuses)
+	}
+}
+
+func TestUnavailableMirrorsNotSelected(t *testing.T) {
+	now := time.Now().Unix()
+	_, fresh := newTestMirrorServer(t, 200, fmt.Sprintf("%d", now))
+	_, stale := newTestMirrorServer(t, 200, fmt.Sprintf("%d", now-7200))
+	_, down := newTestMirrorServer(t, 500, "")
+	mirrors := []*Mirror{
+		{Name: "fresh", Bandwidth: 1, HTTPS: fresh.URL, Rsync: newTestRsyncServer(t, "")},
+		{Name: "stale", Bandwidth: 1000, HTTPS: stale.URL},
+		{Name: "down", Bandwidth: 1000, HTTPS: down.URL},
+		{Name: "rsync", Bandwidth: 1, HTTP: fresh.URL, Rsync: newTestRsyncServer(t, "@RSYNCD: 31.0\n")},
+	}
+	plugin := &OpenEulerMirrorsPlugin{prober: NewMirrorProber(ProbeConfig{ProbeFile: "timestamp", MaxLag: 3600,
+		FailureThreshold: 1})}
+	plugin.Mirrors.Store(mirrors)
+	plugin.prober.ProbeAll(context.Background(), mirrors)
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	plugin.RegisterEndpoints(engine.Group("/mirrors"))
+	nearest := func(query string) []string {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest("GET", "/mirrors/nearest?ip=1.2.3.4"+query, nil))
+		var result struct {
+			Mirrors []MirrorCandidate `json:"mirrors"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0)
+		for _, m := range result.Mirrors {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+
+	if names := nearest(""); len(names) != 2 || names[0] != "fresh" || names[1] != "rsync" {
+		t.Fatalf("unexpected mirrors %v, down and stale mirrors should be excluded", names)
+	}
+	//rsync of fresh mirror is down
+	if names := nearest("&protocol=rsync"); len(names) != 1 || names[0] != "rsync" {
+		t.Fatalf("unexpected rsync mirrors %v", names)
+	}
+	for i := 0; i < 10; i++ {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest("GET", "/mirrors/redirect/repo.txt?ip=1.2.3.4", nil))
+		if recorder.Code != 302 || (recorder.Header().Get("X-Mirror") != "fresh" &&
+			recorder.Header().Get("X-Mirror") != "rsync") {
+			t.Fatalf("redirected to %s with %d", recorder.Header().Get("X-Mirror"), recorder.Code)
+		}
+	}
+}
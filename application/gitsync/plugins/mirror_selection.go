@@ -0,0 +1,249 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// protocols of mirror in order of preference
+var mirrorProtocols = []string{"https", "http", "ftp", "rsync"}
+
+const (
+	//Mirror is in the same autonomous system with client
+	ASNMatch       = "asn"
+	CountryMatch   = "country"
+	ContinentMatch = "continent"
+	OtherMatch     = "other"
+)
+
+var mirrorMatches = []string{ASNMatch, CountryMatch, ContinentMatch, OtherMatch}
+
+// Mirror is one mirror site declared in yaml of mirrors folder
+type Mirror struct {
+	Name string `json:"name"`
+	//ISO 3166 country code and continent code, e.g. CN and AS
+	Country   string `json:"country"`
+	Continent string `json:"continent"`
+	//Autonomous system number of mirror network, optional
+	ASN uint `json:"asn,omitempty"`
+	//Bandwidth in Mbps, it's the weight of mirror in selection
+	Bandwidth int `json:"netband"`
+	//Base urls of protocols
+	HTTPS string `json:"https,omitempty"`
+	HTTP  string `json:"http,omitempty"`
+	FTP   string `json:"ftp,omitempty"`
+	Rsync string `json:"rsync,omitempty"`
+}
+
+// URL returns base url of protocol, empty if not supported
+func (m *Mirror) URL(protocol string) string {
+	switch protocol {
+	case "https":
+		return m.HTTPS
+	case "http":
+		return m.HTTP
+	case "ftp":
+		return m.FTP
+	case "rsync":
+		return m.Rsync
+	}
+	return ""
+}
+
+func (m *Mirror) Protocols() []string {
+	protocols := make([]string, 0)
+	for _, p := range mirrorProtocols {
+		if m.URL(p) != "" {
+			protocols = append(protocols, p)
+		}
+	}
+	return protocols
+}
+
+func (m *Mirror) validate() error {
+	if m.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(m.Protocols()) == 0 {
+		return errors.New(fmt.Sprintf("none of %s is declared", strings.Join(mirrorProtocols, ",")))
+	}
+	m.Country = strings.ToUpper(m.Country)
+	m.Continent = strings.ToUpper(m.Continent)
+	return nil
+}
+
+// ClientLocation is where client is located by MaxMind databases, fields are empty if unknown
+type ClientLocation struct {
+	IP        string `json:"ip"`
+	Country   string `json:"country,omitempty"`
+	Continent string `json:"continent,omitempty"`
+	ASN       uint   `json:"asn,omitempty"`
+}
+
+// MirrorLocator locates client with MaxMind country or city database and ASN database
+type MirrorLocator struct {
+	geoip *maxminddb.Reader
+	asn   *maxminddb.Reader
+}
+
+// NewMirrorLocator opens databases, empty path is skipped
+func NewMirrorLocator(geoipDatabase, asnDatabase string) (*MirrorLocator, error) {
+	locator := &MirrorLocator{}
+	var err error
+	if geoipDatabase != "" {
+		if locator.geoip, err = maxminddb.Open(geoipDatabase); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to open geoip database %s %v", geoipDatabase, err))
+		}
+	}
+	if asnDatabase != "" {
+		if locator.asn, err = maxminddb.Open(asnDatabase); err != nil {
+			locator.Close()
+			return nil, errors.New(fmt.Sprintf("failed to open asn database %s %v", asnDatabase, err))
+		}
+	}
+	return locator, nil
+}
+
+func (l *MirrorLocator) Locate(ip net.IP) *ClientLocation {
+	location := &ClientLocation{IP: ip.String()}
+	if l.geoip != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+			Continent struct {
+				Code string `maxminddb:"code"`
+			} `maxminddb:"continent"`
+		}
+		if l.geoip.Lookup(ip, &record) == nil {
+			location.Country = record.Country.ISOCode
+			location.Continent = record.Continent.Code
+		}
+	}
+	if l.asn != nil {
+		var record struct {
+			Number uint `maxminddb:"autonomous_system_number"`
+		}
+		if l.asn.Lookup(ip, &record) == nil {
+			location.ASN = record.Number
+		}
+	}
+	return location
+}
+
+func (l *MirrorLocator) Close() {
+	if l.geoip != nil {
+		l.geoip.Close()
+	}
+	if l.asn != nil {
+		l.asn.Close()
+	}
+}
+
+// MirrorCandidate is mirror ranked for client
+type MirrorCandidate struct {
+	*Mirror
+	//How mirror matches client, asn, country, continent or other
+	Match string `json:"match"`
+	//Base url of protocol selected
+	URL string `json:"url"`
+}
+
+func matchMirror(m *Mirror, location *ClientLocation) string {
+	if location.ASN != 0 && m.ASN == location.ASN {
+		return ASNMatch
+	}
+	if location.Country != "" && m.Country == location.Country {
+		return CountryMatch
+	}
+	if location.Continent != "" && m.Continent == location.Continent {
+		return ContinentMatch
+	}
+	return OtherMatch
+}
+
+func matchRank(match string) int {
+	for i, m := range mirrorMatches {
+		if m == match {
+			return i
+		}
+	}
+	return len(mirrorMatches)
+}
+
+// rankMirrors returns mirrors supporting protocol ordered by match and bandwidth, https or http is selected if
+// protocol is empty
+func rankMirrors(mirrors []*Mirror, location *ClientLocation, protocol string) []*MirrorCandidate {
+	candidates := make([]*MirrorCandidate, 0)
+	for _, m := range mirrors {
+		url := m.URL(protocol)
+		if protocol == "" {
+			if url = m.HTTPS; url == "" {
+				url = m.HTTP
+			}
+		}
+		if url == "" {
+			continue
+		}
+		candidates = append(candidates, &MirrorCandidate{Mirror: m, Match: matchMirror(m, location), URL: url})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if matchRank(candidates[i].Match) != matchRank(candidates[j].Match) {
+			return matchRank(candidates[i].Match) < matchRank(candidates[j].Match)
+		}
+		if candidates[i].Bandwidth != candidates[j].Bandwidth {
+			return candidates[i].Bandwidth > candidates[j].Bandwidth
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates
+}
+
+// pickMirror picks one of the best matched candidates randomly, weighted by bandwidth
+func pickMirror(candidates []*MirrorCandidate) *MirrorCandidate {
+	if len(candidates) == 0 {
+		return nil
+	}
+	var best []*MirrorCandidate
+	total := 0
+	for _, c := range candidates {
+		if c.Match != candidates[0].Match {
+			break
+		}
+		best = append(best, c)
+		total += mirrorWeight(c.Mirror)
+	}
+	n := rand.Intn(total)
+	for _, c := range best {
+		if n -= mirrorWeight(c.Mirror); n < 0 {
+			return c
+		}
+	}
+	return best[len(best)-1]
+}
+
+func mirrorWeight(m *Mirror) int {
+	if m.Bandwidth <= 0 {
+		return 1
+	}
+	return m.Bandwidth
+}
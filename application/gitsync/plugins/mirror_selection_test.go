@@ -0,0 +1,183 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opensourceways/app-community-metadata/application/middleware"
+)
+
+func testMirrors() []*Mirror {
+	return []*Mirror{
+		{Name: "other", Country: "DE", Continent: "EU", Bandwidth: 100000, HTTP: "http://other"},
+		{Name: "continent", Country: "JP", Continent: "AS", Bandwidth: 10000, HTTPS: "https://continent"},
+		{Name: "country-c", Country: "CN", Continent: "AS", Bandwidth: 100, HTTPS: "https://country-c"},
+		{Name: "country-a", Country: "CN", Continent: "AS", Bandwidth: 100, HTTPS: "https://country-a",
+			HTTP: "http://country-a"},
+		{Name: "country-b", Country: "CN", Continent: "AS", Bandwidth: 1000, HTTPS: "https://country-b"},
+		{Name: "asn", Country: "US", Continent: "NA", ASN: 4134, Bandwidth: 10, HTTPS: "https://asn"},
+		{Name: "rsync-only", Country: "CN", Continent: "AS", ASN: 4134, Bandwidth: 1, Rsync: "rsync://rsync-only"},
+	}
+}
+
+func TestRankMirrors(t *testing.T) {
+	client := &ClientLocation{IP: "1.2.3.4", ASN: 4134, Country: "CN", Continent: "AS"}
+	cases := []struct {
+		name     string
+		location *ClientLocation
+		protocol string
+		expected string
+	}{
+		{"asn then country then continent", client, "",
+			"asn:asn,country-b:country,country-a:country,country-c:country,continent:continent,other:other"},
+		{"unknown client by bandwidth", &ClientLocation{IP: "1.2.3.4"}, "",
+			"other:other,continent:other,country-b:other,country-a:other,country-c:other,asn:other"},
+		{"http only", client, "http", "country-a:country,other:other"},
+		{"rsync only", client, "rsync", "rsync-only:asn"},
+		{"ftp none", client, "ftp", ""},
+	}
+	for _, c := range cases {
+		var ranked []string
+		for _, candidate := range rankMirrors(testMirrors(), c.location, c.protocol) {
+			ranked = append(ranked, candidate.Name+":"+candidate.Match)
+			if c.protocol != "" && candidate.URL != candidate.Mirror.URL(c.protocol) {
+				t.Errorf("%s: url %s of %s is not %s", c.name, candidate.URL, candidate.Name, c.protocol)
+			}
+		}
+		if strings.Join(ranked, ",") != c.expected {
+			t.Errorf("%s: ranked %v, expected %s", c.name, ranked, c.expected)
+		}
+	}
+	//https is preferred when protocol not specified
+	for _, candidate := range rankMirrors(testMirrors(), client, "") {
+		if candidate.Name == "country-a" && candidate.URL != "https://country-a" {
+			t.Errorf("url of country-a is %s, expected https", candidate.URL)
+		}
+		if candidate.Name == "other" && candidate.URL != "http://other" {
+			t.Errorf("url of other is %s, expected http", candidate.URL)
+		}
+	}
+}
+
+func TestPickMirror(t *testing.T) {
+	if pickMirror(nil) != nil {
+		t.Fatal("mirror picked from empty candidates")
+	}
+	client := &ClientLocation{IP: "1.2.3.4", Country: "CN", Continent: "AS"}
+	cases := []struct {
+		name     string
+		mirrors  []*Mirror
+		expected map[string]float64
+	}{
+		{"weighted by bandwidth", []*Mirror{
+			{Name: "a", Country: "CN", Bandwidth: 300, HTTPS: "https://a"},
+			{Name: "b", Country: "CN", Bandwidth: 100, HTTPS: "https://b"},
+			{Name: "far", Country: "DE", Bandwidth: 100000, HTTPS: "https://far"},
+		}, map[string]float64{"a": 0.75, "b": 0.25}},
+		{"unknown bandwidth weighs one", []*Mirror{
+			{Name: "a", Country: "CN", Bandwidth: 1, HTTPS: "https://a"},
+			{Name: "b", Country: "CN", HTTPS: "https://b"},
+		}, map[string]float64{"a": 0.5, "b": 0.5}},
+		{"only best match", []*Mirror{
+			{Name: "near", Continent: "AS", Bandwidth: 1, HTTPS: "https://near"},
+			{Name: "far", Continent: "EU", Bandwidth: 100000, HTTPS: "https://far"},
+		}, map[string]float64{"near": 1}},
+	}
+	const picks = 10000
+	for _, c := range cases {
+		candidates := rankMirrors(c.mirrors, client, "")
+		picked := map[string]int{}
+		for i := 0; i < picks; i++ {
+			picked[pickMirror(candidates).Name]++
+		}
+		for name, count := range picked {
+			if _, ok := c.expected[name]; !ok {
+				t.Errorf("%s: %s picked %d times, expected never", c.name, name, count)
+			}
+		}
+		for name, ratio := range c.expected {
+			if actual := float64(picked[name]) / picks; math.Abs(actual-ratio) > 0.03 {
+				t.Errorf("%s: %s picked %.3f of times, expected %.3f", c.name, name, actual, ratio)
+			}
+		}
+	}
+}
+
+// newSelectionEngine serves mirrors plugin without prober, client ip is resolved with proxy 192.0.2.1 trusted
+func newSelectionEngine(t *testing.T, proxies []string) *gin.Engine {
+	plugin := &OpenEulerMirrorsPlugin{}
+	plugin.Mirrors.Store(testMirrors())
+	resolver, err := middleware.NewClientIPResolver(proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(middleware.ResolveClientIP(resolver))
+	plugin.RegisterEndpoints(engine.Group("/mirrors"))
+	return engine
+}
+
+func TestMirrorSelectionRequests(t *testing.T) {
+	cases := []struct {
+		name      string
+		proxies   []string
+		path      string
+		forwarded string
+		status    int
+		client    string
+	}{
+		{"invalid ip", nil, "/nearest?ip=1.2.3", "", 400, ""},
+		{"invalid ip of redirect", nil, "/redirect/repo.txt?ip=not-an-ip", "", 400, ""},
+		{"invalid protocol", nil, "/nearest?protocol=gopher", "", 400, ""},
+		{"invalid limit", nil, "/nearest?limit=0", "", 400, ""},
+		{"ip in query", nil, "/nearest?ip=1.2.3.4", "", 200, "1.2.3.4"},
+		{"peer address", nil, "/nearest", "", 200, "192.0.2.1"},
+		{"forwarded by untrusted peer", nil, "/nearest", "1.2.3.4", 200, "192.0.2.1"},
+		{"forwarded by trusted proxy", []string{"192.0.2.1"}, "/nearest", "5.6.7.8, 1.2.3.4", 200, "1.2.3.4"},
+		{"redirect", nil, "/redirect/repo.txt", "", 302, ""},
+	}
+	for _, c := range cases {
+		engine := newSelectionEngine(t, c.proxies)
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/mirrors"+c.path, nil)
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		engine.ServeHTTP(recorder, r)
+		if recorder.Code != c.status {
+			t.Errorf("%s: %s returns %d %s, expected %d", c.name, c.path, recorder.Code, recorder.Body.String(),
+				c.status)
+			continue
+		}
+		if c.client == "" {
+			continue
+		}
+		var result struct {
+			Client ClientLocation `json:"client"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Client.IP != c.client {
+			t.Errorf("%s: client ip %s, expected %s", c.name, result.Client.IP, c.client)
+		}
+	}
+}
@@ -76,4 +76,20 @@ func (h *OpenDesignResourcesPlugins) Load(files map[string][]string) error {
 
 func (h *OpenDesignResourcesPlugins) RegisterEndpoints(group *gin.RouterGroup) {
 	h.Group = group
-}
\ No newline at end of file
+}
+
+func (h *OpenDesignResourcesPlugins) GetEndpoints() []gitsync.Endpoint {
+	return []gitsync.Endpoint{
+		{
+			Path:    "/packages/*filepath",
+			Summary: "get open design resource packages",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "resource file",
+					ContentType: "application/octet-stream",
+				},
+			},
+		},
+	}
+}
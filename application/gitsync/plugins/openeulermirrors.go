@@ -14,27 +14,82 @@ limitations under the License.
 package plugins
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/opensourceways/app-community-metadata/application/gitsync"
+	"github.com/opensourceways/app-community-metadata/application/middleware"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"sigs.k8s.io/yaml"
+	"strconv"
 	"strings"
 	"sync/atomic"
 )
 
 const InfrastructureRepo = "https://gitee.com/openeuler/infrastructure"
+const DefaultNearestMirrors = 5
+
+type MirrorsConfig struct {
+	//MaxMind country or city database used to locate clients, mirrors are ranked by bandwidth only if empty
+	GeoIPDatabase string `mapstructure:"geoipDatabase"`
+	//MaxMind ASN database, optional
+	ASNDatabase string `mapstructure:"asnDatabase"`
+	//Mirrors down or stale are excluded from selection
+	Probe ProbeConfig `mapstructure:",squash"`
+}
 
 type OpenEulerMirrorsPlugin struct {
-	Repos atomic.Value
+	Config  MirrorsConfig
+	locator *MirrorLocator
+	prober  *MirrorProber
+	Repos   atomic.Value
+	//[]*Mirror, mirrors of invalid yaml are served in /all only
+	Mirrors atomic.Value
 }
 
 func NewOpenEulerMirrorsPlugin() gitsync.Plugin {
 	return &OpenEulerMirrorsPlugin{}
 }
 
+func (h *OpenEulerMirrorsPlugin) NewConfig() interface{} {
+	conf := h.Config
+	return &conf
+}
+
+func (h *OpenEulerMirrorsPlugin) Configure(config interface{}) error {
+	conf := config.(*MirrorsConfig)
+	locator, err := NewMirrorLocator(conf.GeoIPDatabase, conf.ASNDatabase)
+	if err != nil {
+		return err
+	}
+	if h.locator != nil {
+		h.locator.Close()
+	}
+	h.Config = *conf
+	h.locator = locator
+	h.prober = NewMirrorProber(conf.Probe)
+	return nil
+}
+
+// Start probes mirrors until ctx is done
+func (h *OpenEulerMirrorsPlugin) Start(ctx context.Context) {
+	if h.prober == nil {
+		return
+	}
+	h.prober.Run(ctx, h.loadedMirrors)
+}
+
+func (h *OpenEulerMirrorsPlugin) loadedMirrors() []*Mirror {
+	if loaded := h.Mirrors.Load(); loaded != nil {
+		return loaded.([]*Mirror)
+	}
+	return nil
+}
+
 func (h *OpenEulerMirrorsPlugin) GetMeta() *gitsync.PluginMeta {
 	return &gitsync.PluginMeta{
 		Name:        "mirrors",
@@ -46,6 +101,9 @@ func (h *OpenEulerMirrorsPlugin) GetMeta() *gitsync.PluginMeta {
 				Branch:     "master",
 				SubModules: "recursive",
 				Schema:     gitsync.Https,
+				//large repo, only the latest watch files are checked out
+				Depth:  1,
+				Sparse: true,
 				WatchFiles: []string{
 					"mirrors",
 				},
@@ -56,6 +114,7 @@ func (h *OpenEulerMirrorsPlugin) GetMeta() *gitsync.PluginMeta {
 
 func (h *OpenEulerMirrorsPlugin) Load(files map[string][]string) error {
 	mirrors := []string{}
+	typed := make([]*Mirror, 0)
 	if files, ok := files[InfrastructureRepo]; ok {
 		if len(files) > 0 {
 			//walk the yaml file to collect all mirror sites
@@ -82,6 +141,16 @@ func (h *OpenEulerMirrorsPlugin) Load(files map[string][]string) error {
 						return err
 					}
 					mirrors = append(mirrors, string(m))
+					var mirror Mirror
+					if err = json.Unmarshal(m, &mirror); err == nil {
+						err = mirror.validate()
+					}
+					if err != nil {
+						fmt.Println(fmt.Sprintf("mirror %s is not available for selection: %v", filepath.Base(path),
+							err))
+						return nil
+					}
+					typed = append(typed, &mirror)
 				}
 				return nil
 			})
@@ -89,6 +158,7 @@ func (h *OpenEulerMirrorsPlugin) Load(files map[string][]string) error {
 				return err
 			}
 			h.Repos.Store(mirrors)
+			h.Mirrors.Store(typed)
 		}
 	}
 	return nil
@@ -96,6 +166,90 @@ func (h *OpenEulerMirrorsPlugin) Load(files map[string][]string) error {
 
 func (h *OpenEulerMirrorsPlugin) RegisterEndpoints(group *gin.RouterGroup) {
 	group.GET("/all", h.ReadMirrorYamls)
+	group.GET("/nearest", h.ReadNearestMirrors)
+	group.GET("/redirect/*path", h.RedirectToMirror)
+	group.GET("/status", h.ReadMirrorStatus)
+}
+
+// ReadMirrorStatus returns probe status of origin and mirrors
+func (h *OpenEulerMirrorsPlugin) ReadMirrorStatus(c *gin.Context) {
+	if h.prober == nil || h.Config.Probe.ProbeInterval < 0 {
+		c.JSON(200, gin.H{"enabled": false, "mirrors": []*MirrorStatus{}})
+		return
+	}
+	origin, statuses := h.prober.Statuses()
+	c.JSON(200, gin.H{"enabled": true, "origin": origin, "mirrors": statuses})
+}
+
+// rankForClient ranks mirrors for client ip resolved with trusted proxies, or ip in query if specified
+func (h *OpenEulerMirrorsPlugin) rankForClient(c *gin.Context) (*ClientLocation, []*MirrorCandidate, bool) {
+	address := c.Query("ip")
+	if address == "" {
+		address = middleware.ClientIP(c)
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		c.Data(400, "text/html", []byte(fmt.Sprintf("invalid ip %s", address)))
+		return nil, nil, false
+	}
+	protocol := c.Query("protocol")
+	if protocol != "" && !gitsync.StringInclude(mirrorProtocols, protocol) {
+		c.Data(400, "text/html", []byte(fmt.Sprintf("protocol should be one of %s",
+			strings.Join(mirrorProtocols, ","))))
+		return nil, nil, false
+	}
+	location := &ClientLocation{IP: ip.String()}
+	if h.locator != nil {
+		location = h.locator.Locate(ip)
+	}
+	var mirrors []*Mirror
+	for _, m := range h.loadedMirrors() {
+		//mirrors down or stale are excluded
+		if h.prober == nil || h.prober.Available(m, protocol) {
+			mirrors = append(mirrors, m)
+		}
+	}
+	return location, rankMirrors(mirrors, location, protocol), true
+}
+
+// ReadNearestMirrors returns mirrors ranked by asn, country and continent of client, then bandwidth
+func (h *OpenEulerMirrorsPlugin) ReadNearestMirrors(c *gin.Context) {
+	limit := DefaultNearestMirrors
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			c.Data(400, "text/html", []byte(fmt.Sprintf("invalid limit %s", l)))
+			return
+		}
+	}
+	location, candidates, ok := h.rankForClient(c)
+	if !ok {
+		return
+	}
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	c.JSON(200, gin.H{
+		"client":  location,
+		"mirrors": candidates,
+	})
+}
+
+// RedirectToMirror redirects to path on one of the nearest mirrors, mirrors with the same match are picked
+// randomly weighted by bandwidth
+func (h *OpenEulerMirrorsPlugin) RedirectToMirror(c *gin.Context) {
+	_, candidates, ok := h.rankForClient(c)
+	if !ok {
+		return
+	}
+	mirror := pickMirror(candidates)
+	if mirror == nil {
+		c.Data(404, "text/html", []byte("no mirror available"))
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Mirror", mirror.Name)
+	c.Redirect(302, strings.TrimRight(mirror.URL, "/")+"/"+strings.TrimLeft(c.Param("path"), "/"))
 }
 
 func (h *OpenEulerMirrorsPlugin) ReadMirrorYamls(c *gin.Context) {
@@ -108,3 +262,87 @@ func (h *OpenEulerMirrorsPlugin) ReadMirrorYamls(c *gin.Context) {
 	}
 
 }
+
+func (h *OpenEulerMirrorsPlugin) GetEndpoints() []gitsync.Endpoint {
+	return []gitsync.Endpoint{
+		{
+			Path:        "/all",
+			Summary:     "get all openEuler mirrors",
+			Description: "all mirror yaml files under the mirrors folder converted into json",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "mirror list",
+					Schema: map[string]interface{}{
+						"type":  "array",
+						"items": map[string]interface{}{"type": "object"},
+					},
+				},
+			},
+		},
+		{
+			Path:    "/nearest",
+			Summary: "get mirrors nearest to client",
+			Description: "mirrors ranked by asn, country and continent of client located with MaxMind databases, " +
+				"then by bandwidth",
+			Parameters: []gitsync.EndpointParameter{
+				{
+					Name:        "ip",
+					Description: "ip located instead of client ip",
+				},
+				{
+					Name:        "protocol",
+					Description: "https, http, ftp or rsync, https or http if empty",
+				},
+				{
+					Name:        "limit",
+					Description: fmt.Sprintf("max mirrors returned, %d by default", DefaultNearestMirrors),
+					Type:        "integer",
+				},
+			},
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "client location and mirrors",
+					Schema:      map[string]interface{}{"type": "object"},
+				},
+				{
+					Status:      400,
+					Description: "invalid parameter",
+					ContentType: "text/html",
+				},
+			},
+		},
+		{
+			Path:    "/status",
+			Summary: "get health of mirrors",
+			Description: "availability, latency, lag behind origin and probe history of mirrors, mirrors down or " +
+				"stale are excluded from /nearest and /redirect",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      200,
+					Description: "origin and mirror status",
+					Schema:      map[string]interface{}{"type": "object"},
+				},
+			},
+		},
+		{
+			Path:    "/redirect/*path",
+			Summary: "redirect to file on the nearest mirror",
+			Description: "mirror is picked among the best matched mirrors randomly, weighted by bandwidth, " +
+				"ip and protocol are the same as /nearest",
+			Responses: []gitsync.EndpointResponse{
+				{
+					Status:      302,
+					Description: "redirect to mirror",
+					ContentType: "text/html",
+				},
+				{
+					Status:      404,
+					Description: "no mirror available",
+					ContentType: "text/html",
+				},
+			},
+		},
+	}
+}
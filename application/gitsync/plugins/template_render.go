@@ -0,0 +1,235 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const TemplateRenderTimeout = 5
+const MaxRenderedSize = 1024 * 1024
+const MaxRenderRequestSize = 1024 * 1024
+
+const frontMatterDelimiter = "---"
+const maxIndent = 256
+
+const (
+	//Front matter of template is invalid
+	FrontMatterError = "frontmatter"
+	//Required parameter is not specified
+	MissingParameterError = "missing_parameter"
+	//Template can't be parsed
+	ParseError = "parse"
+	//Template failed to execute, for instance, parameter referred is not declared nor specified
+	ExecuteError = "execute"
+)
+
+// TemplateParameter is the parameter declared in front matter of template
+type TemplateParameter struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+}
+
+// TemplateFrontMatter is the yaml block between '---' lines at the beginning of template, it's recognized only if
+// parameters are declared, since templates of yaml documents start with '---' as well
+type TemplateFrontMatter struct {
+	Parameters []TemplateParameter `json:"parameters"`
+}
+
+// RenderError is one error of rendering
+type RenderError struct {
+	Type      string `json:"type"`
+	Parameter string `json:"parameter,omitempty"`
+	Message   string `json:"message"`
+}
+
+// RenderRequest is the body of render endpoint
+type RenderRequest struct {
+	//Exact template path relative to courses repo root
+	File string `json:"file"`
+	//Branch or tag of courses repo, default branch if empty
+	Ref    string                 `json:"ref"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// RenderResult is the response of render endpoint
+type RenderResult struct {
+	Path     string        `json:"path"`
+	Ref      string        `json:"ref,omitempty"`
+	Commit   string        `json:"commit,omitempty"`
+	Hash     string        `json:"hash"`
+	Rendered string        `json:"rendered,omitempty"`
+	Errors   []RenderError `json:"errors,omitempty"`
+}
+
+// splitFrontMatter returns front matter and body of template, front matter is nil if absent
+func splitFrontMatter(content []byte) (*TemplateFrontMatter, []byte, error) {
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	if !strings.HasPrefix(text, frontMatterDelimiter+"\n") {
+		return nil, content, nil
+	}
+	end := strings.Index(text[len(frontMatterDelimiter)+1:], "\n"+frontMatterDelimiter+"\n")
+	if end < 0 {
+		return nil, content, nil
+	}
+	block := text[len(frontMatterDelimiter)+1 : len(frontMatterDelimiter)+1+end]
+	var keys map[string]interface{}
+	if yaml.Unmarshal([]byte(block), &keys) != nil {
+		return nil, content, nil
+	}
+	if _, ok := keys["parameters"]; !ok {
+		return nil, content, nil
+	}
+	var frontMatter TemplateFrontMatter
+	if err := yaml.Unmarshal([]byte(block), &frontMatter); err != nil {
+		return nil, nil, err
+	}
+	for _, p := range frontMatter.Parameters {
+		if p.Name == "" {
+			return nil, nil, errors.New("name of parameter is required")
+		}
+	}
+	start := len(frontMatterDelimiter) + 1 + end + len(frontMatterDelimiter) + 2
+	//front matter is replaced by comment to keep line numbers in errors
+	body := fmt.Sprintf("{{/*%s*/}}%s", strings.Repeat("\n", strings.Count(text[:start], "\n")), text[start:])
+	return &frontMatter, []byte(body), nil
+}
+
+// renderFuncs are the only functions available besides text/template builtins, none of them touches files, env or
+// network
+func renderFuncs() template.FuncMap {
+	return template.FuncMap{
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join": func(sep string, items []interface{}) string {
+			values := make([]string, len(items))
+			for i, item := range items {
+				values[i] = fmt.Sprint(item)
+			}
+			return strings.Join(values, sep)
+		},
+		"quote": func(v interface{}) string { return fmt.Sprintf("%q", fmt.Sprint(v)) },
+		"default": func(d, v interface{}) interface{} {
+			if v == nil || v == "" {
+				return d
+			}
+			return v
+		},
+		"indent": func(spaces int, s string) (string, error) {
+			if spaces < 0 || spaces > maxIndent {
+				return "", errors.New(fmt.Sprintf("indent should be between 0 and %d", maxIndent))
+			}
+			pad := strings.Repeat(" ", spaces)
+			return pad + strings.ReplaceAll(s, "\n", "\n"+pad), nil
+		},
+		"toJson": func(v interface{}) (string, error) {
+			content, err := json.Marshal(v)
+			return string(content), err
+		},
+		"toYaml": func(v interface{}) (string, error) {
+			content, err := yaml.Marshal(v)
+			return strings.TrimSuffix(string(content), "\n"), err
+		},
+		"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec": func(s string) (string, error) {
+			content, err := base64.StdEncoding.DecodeString(s)
+			return string(content), err
+		},
+	}
+}
+
+// renderWriter fails writing once content exceeds limit or rendering is cancelled, template execution stops at the
+// failed write rather than running in background
+type renderWriter struct {
+	bytes.Buffer
+	ctx   context.Context
+	limit int
+}
+
+func (w *renderWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		if err == context.DeadlineExceeded {
+			return 0, errors.New(fmt.Sprintf("rendering exceeds %d seconds", TemplateRenderTimeout))
+		}
+		return 0, errors.New(fmt.Sprintf("rendering cancelled %v", err))
+	}
+	if w.Len()+len(p) > w.limit {
+		return 0, errors.New(fmt.Sprintf("rendered content exceeds %d bytes", w.limit))
+	}
+	return w.Buffer.Write(p)
+}
+
+// renderTemplate validates params against front matter and renders template, params not specified get defaults.
+// Rendering stops when ctx is done or TemplateRenderTimeout passed.
+func renderTemplate(ctx context.Context, t *CourseTemplate, params map[string]interface{}) (string, []RenderError) {
+	frontMatter, body, err := splitFrontMatter(t.Content)
+	if err != nil {
+		return "", []RenderError{{Type: FrontMatterError, Message: err.Error()}}
+	}
+	values := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		values[k] = v
+	}
+	var renderErrors []RenderError
+	if frontMatter != nil {
+		for _, p := range frontMatter.Parameters {
+			if _, ok := values[p.Name]; ok {
+				continue
+			}
+			if p.Required {
+				renderErrors = append(renderErrors, RenderError{
+					Type:      MissingParameterError,
+					Parameter: p.Name,
+					Message:   fmt.Sprintf("parameter %s is required", p.Name),
+				})
+			} else {
+				values[p.Name] = p.Default
+			}
+		}
+	}
+	if len(renderErrors) != 0 {
+		return "", renderErrors
+	}
+	tmpl, err := template.New(t.Path).Option("missingkey=error").Funcs(renderFuncs()).Parse(string(body))
+	if err != nil {
+		return "", []RenderError{{Type: ParseError, Message: err.Error()}}
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*TemplateRenderTimeout)
+	defer cancel()
+	output := &renderWriter{ctx: ctx, limit: MaxRenderedSize}
+	if err = tmpl.Execute(output, values); err != nil {
+		return "", []RenderError{{Type: ExecuteError, Message: err.Error()}}
+	}
+	return output.String(), nil
+}
@@ -0,0 +1,327 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gookit/goutil/fsutil"
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+const RefSeparator = "@"
+const RefResolveTimeout = 60
+const DefaultMaxRefs = 20
+
+// RemoteRef is the branch or tag found in remote repo
+type RemoteRef struct {
+	Name string
+	Tag  bool
+}
+
+type RepoConfig struct {
+	//Repo url declared by plugin
+	Repo string `mapstructure:"repo"`
+	//Extra refs to watch
+	Refs []string `mapstructure:"refs"`
+	//Fallback remotes and consecutive failures before failing over
+	Mirrors           []string `mapstructure:"mirrors"`
+	FailoverThreshold *int     `mapstructure:"failoverThreshold"`
+	//Clone options, plugin defaults are used if not set
+	Depth       *int     `mapstructure:"depth"`
+	Sparse      *bool    `mapstructure:"sparse"`
+	SparsePaths []string `mapstructure:"sparsePaths"`
+	Filter      *string  `mapstructure:"filter"`
+	//Sync schedule, manager defaults are used if not set
+	SyncInterval *int    `mapstructure:"syncInterval"`
+	Schedule     *string `mapstructure:"schedule"`
+}
+
+// ApplyRepoConfig appends extra refs and mirrors, overrides clone options and schedule of repo according to [[repos]] config
+func ApplyRepoConfig(repo *GitMeta) {
+	var configs []RepoConfig
+	if !app.Config.Exists("repos") {
+		return
+	}
+	if err := app.Config.MapStruct("repos", &configs); err != nil {
+		app.Logger.Error(fmt.Sprintf("failed to decode repos config %v", err))
+		return
+	}
+	for _, c := range configs {
+		equal, _ := RepoEqualIgnoreSchemaAndLevel(c.Repo, repo.Repo)
+		if c.Repo == repo.Repo || equal {
+			repo.Refs = append(repo.Refs, c.Refs...)
+			repo.Mirrors = append(repo.Mirrors, c.Mirrors...)
+			if c.FailoverThreshold != nil {
+				repo.FailoverThreshold = *c.FailoverThreshold
+			}
+			if c.Depth != nil {
+				repo.Depth = *c.Depth
+			}
+			if c.Sparse != nil {
+				repo.Sparse = *c.Sparse
+			}
+			if len(c.SparsePaths) != 0 {
+				repo.SparsePaths = c.SparsePaths
+			}
+			if c.Filter != nil {
+				repo.Filter = *c.Filter
+			}
+			if c.SyncInterval != nil {
+				repo.SyncInterval = *c.SyncInterval
+			}
+			if c.Schedule != nil {
+				repo.Schedule = *c.Schedule
+			}
+		}
+	}
+}
+
+// RefLocalName returns the local name of extra ref checkout, slash in ref is replaced with tilde since it's used as
+// folder name, tilde is not allowed in git ref names, therefore, different refs never share the same folder
+func RefLocalName(localName, ref string) string {
+	return localName + RefSeparator + strings.Replace(ref, "/", "~", -1)
+}
+
+// LimitRefs returns at most max refs, watched refs are kept first so that they are never replaced by new refs
+func LimitRefs(refs []RemoteRef, max int, watched func(ref RemoteRef) bool) []RemoteRef {
+	if len(refs) <= max {
+		return refs
+	}
+	limited := make([]RemoteRef, 0, max)
+	for _, ref := range refs {
+		if len(limited) < max && watched(ref) {
+			limited = append(limited, ref)
+		}
+	}
+	for _, ref := range refs {
+		if len(limited) < max && !watched(ref) {
+			limited = append(limited, ref)
+		}
+	}
+	return limited
+}
+
+// MatchRefs returns refs matching any of patterns, patterns are shell glob such as v* and release-*
+func MatchRefs(patterns []string, refs []RemoteRef) []RemoteRef {
+	var matched []RemoteRef
+	found := make(map[string]bool)
+	for _, ref := range refs {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, ref.Name); (ok || p == ref.Name) && !found[ref.Name] {
+				matched = append(matched, ref)
+				found[ref.Name] = true
+			}
+		}
+	}
+	return matched
+}
+
+// ListRemoteRefs lists all branches and tags of repo with git ls-remote
+func ListRemoteRefs(ctx context.Context, repo string) ([]RemoteRef, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--heads", "--tags", repo)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to list refs of %s %v", repo, err))
+	}
+	var refs []RemoteRef
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasSuffix(fields[1], "^{}") {
+			continue
+		}
+		if strings.HasPrefix(fields[1], "refs/heads/") {
+			refs = append(refs, RemoteRef{Name: strings.TrimPrefix(fields[1], "refs/heads/")})
+		} else if strings.HasPrefix(fields[1], "refs/tags/") {
+			refs = append(refs, RemoteRef{Name: strings.TrimPrefix(fields[1], "refs/tags/"), Tag: true})
+		}
+	}
+	return refs, nil
+}
+
+// listPrimaryRefs lists refs of repo served by primary instance in follower mode
+func (s *SyncManager) listPrimaryRefs(ctx context.Context, repo string) ([]RemoteRef, error) {
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/snapshots", s.follower.Primary), nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	//snapshots endpoint of primary is guarded the same as snapshot downloads
+	for k, v := range s.follower.Headers {
+		request.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: time.Second * RefResolveTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("unexpected status code %d from primary", response.StatusCode))
+	}
+	var snapshots []map[string]string
+	if err = json.NewDecoder(response.Body).Decode(&snapshots); err != nil {
+		return nil, err
+	}
+	var refs []RemoteRef
+	for _, snapshot := range snapshots {
+		if snapshot["repo"] == repo && snapshot["ref"] != "" {
+			refs = append(refs, RemoteRef{Name: snapshot["ref"]})
+		}
+	}
+	return refs, nil
+}
+
+// resolveRefs returns extra refs of repo which currently exist
+func (s *SyncManager) resolveRefs(ctx context.Context, meta *GitMeta) ([]RemoteRef, error) {
+	var refs []RemoteRef
+	var err error
+	if s.follower != nil {
+		refs, err = s.listPrimaryRefs(ctx, meta.Repo)
+	} else {
+		switch meta.Source {
+		case "", GitSyncSource:
+			//mirrors are tried in order if repo unavailable
+			for _, remote := range append([]string{meta.RemoteURL()}, meta.Mirrors...) {
+				if refs, err = ListRemoteRefs(ctx, remote); err == nil {
+					break
+				}
+			}
+		case LocalGitSource:
+			refs, err = ListRemoteRefs(ctx, meta.Path)
+		default:
+			err = errors.New(fmt.Sprintf("refs are not supported by source %s", meta.Source))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return MatchRefs(meta.Refs, refs), nil
+}
+
+// syncRefs creates runners for extra refs which are not watched yet and removes runners of refs which are gone,
+// runners are started if start is true
+func (s *SyncManager) syncRefs(ctx context.Context, start bool) {
+	for group, metas := range repoContainer {
+		for localName, container := range metas {
+			meta := container.Meta
+			if len(meta.Refs) == 0 {
+				continue
+			}
+			refs, err := s.resolveRefs(ctx, meta)
+			if err != nil {
+				s.logger.Error(fmt.Sprintf("failed to resolve refs %v of repo %s %v", meta.Refs, meta.Repo, err))
+				continue
+			}
+			s.syncRepoRefs(group, localName, meta, refs, start)
+		}
+	}
+}
+
+// syncRepoRefs watches refs of repo, runners of refs not found any more are closed and their checkouts removed
+func (s *SyncManager) syncRepoRefs(group, localName string, meta *GitMeta, refs []RemoteRef, start bool) {
+	var extraRefs []RemoteRef
+	for _, ref := range refs {
+		if ref.Name != meta.Branch {
+			extraRefs = append(extraRefs, ref)
+		}
+	}
+	refKey := func(ref RemoteRef) string {
+		return fmt.Sprintf("%s/%s", group, RefLocalName(localName, ref.Name))
+	}
+	limited := LimitRefs(extraRefs, s.maxRefs, func(ref RemoteRef) bool {
+		_, ok := s.getRunner(refKey(ref))
+		return ok
+	})
+	if len(limited) < len(extraRefs) {
+		s.logger.Warn(fmt.Sprintf("%d refs of repo %s matched, only %d are watched", len(extraRefs), meta.Repo,
+			s.maxRefs))
+	}
+	watched := make(map[string]bool, len(limited))
+	for _, ref := range limited {
+		key := refKey(ref)
+		watched[key] = true
+		if _, ok := s.getRunner(key); ok {
+			continue
+		}
+		refName := RefLocalName(localName, ref.Name)
+		refMeta := *meta
+		refMeta.Refs = nil
+		refMeta.Ref = ref.Name
+		if ref.Tag {
+			refMeta.Rev = ref.Name
+		} else {
+			refMeta.Branch = ref.Name
+		}
+		localPath := filepath.Join(s.baseFolder, group, refName)
+		if err := fsutil.Mkdir(localPath, os.FileMode(0755)); err != nil {
+			s.logger.Error(fmt.Sprintf("failed to create folder for ref %s of repo %s", ref.Name, meta.Repo))
+			continue
+		}
+		r, err := s.newRunner(group, refName, localPath, &refMeta)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("failed to create runner for ref %s of repo %s, err: %v", ref.Name,
+				meta.Repo, err))
+			continue
+		}
+		if s.addRunner(key, r, start) {
+			s.logger.Info(fmt.Sprintf("ref %s of repo %s added", ref.Name, meta.Repo))
+		}
+	}
+	prefix := fmt.Sprintf("%s/%s%s", group, localName, RefSeparator)
+	for key := range s.listRunners() {
+		if !strings.HasPrefix(key, prefix) || watched[key] {
+			continue
+		}
+		r, ok := s.removeRunner(key)
+		if !ok {
+			continue
+		}
+		if err := r.Close(); err != nil {
+			s.logger.Error(fmt.Sprintf("failed to close runner of %s %v", key, err))
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.baseFolder, key)); err != nil {
+			s.logger.Warn(fmt.Sprintf("failed to remove checkout of %s %v", key, err))
+		}
+		s.logger.Info(fmt.Sprintf("ref %s of repo %s removed", r.GetRepo().Ref, meta.Repo))
+	}
+}
+
+// watchRefs checks new refs periodically until context done
+func (s *SyncManager) watchRefs(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.SyncInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refCtx, cancel := context.WithTimeout(ctx, time.Second*RefResolveTimeout)
+			s.syncRefs(refCtx, true)
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestRefLocalNameIsUnique(t *testing.T) {
+	names := make(map[string]string)
+	for _, ref := range []string{"feature/x", "feature_x", "feature-x", "feature/x/y", "feature/x_y", "feature_x/y"} {
+		name := RefLocalName("repo", ref)
+		if other, ok := names[name]; ok {
+			t.Fatalf("refs %s and %s share the same folder %s", ref, other, name)
+		}
+		names[name] = ref
+	}
+}
+
+func TestLimitRefs(t *testing.T) {
+	refs := []RemoteRef{{Name: "v1"}, {Name: "v2"}, {Name: "v3"}, {Name: "v4"}}
+	limited := LimitRefs(refs, 2, func(ref RemoteRef) bool {
+		return ref.Name == "v3"
+	})
+	if len(limited) != 2 || limited[0].Name != "v3" || limited[1].Name != "v1" {
+		t.Fatalf("unexpected refs %v, watched ref should be kept", limited)
+	}
+	if limited = LimitRefs(refs, 10, nil); len(limited) != len(refs) {
+		t.Fatalf("unexpected refs %v", limited)
+	}
+}
+
+func TestSyncRepoRefs(t *testing.T) {
+	baseFolder, err := ioutil.TempDir("", "refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseFolder)
+	gin.SetMode(gin.TestMode)
+	s := &SyncManager{
+		SyncInterval:    30,
+		minSyncInterval: 10,
+		maxSyncInterval: 86400,
+		baseFolder:      baseFolder,
+		eventCh:         make(chan *GitEvent, 10),
+		logger:          zap.NewNop(),
+		Runners:         make(map[string]Runner),
+		routerGroup:     gin.New().Group("/v1"),
+		maxRefs:         2,
+	}
+	meta := &GitMeta{Repo: "https://gitee.com/test/repo", Branch: "master", Source: LocalGitSource,
+		Path: baseFolder, Refs: []string{"*"}}
+	refs := []RemoteRef{{Name: "master"}, {Name: "feature/x"}, {Name: "feature_x"}, {Name: "v1", Tag: true}}
+	s.syncRepoRefs("group", "repo", meta, refs, false)
+	if len(s.Runners) != 2 {
+		t.Fatalf("%d refs watched, expected %d", len(s.Runners), s.maxRefs)
+	}
+	for _, ref := range []string{"feature/x", "feature_x"} {
+		r, ok := s.getRunner("group/" + RefLocalName("repo", ref))
+		if !ok || r.GetRepo().Ref != ref {
+			t.Fatalf("ref %s not watched", ref)
+		}
+	}
+
+	//deleted ref is removed, its slot is taken by ref ignored before
+	refs = []RemoteRef{{Name: "master"}, {Name: "feature_x"}, {Name: "v1", Tag: true}}
+	s.syncRepoRefs("group", "repo", meta, refs, false)
+	if _, ok := s.getRunner("group/" + RefLocalName("repo", "feature/x")); ok {
+		t.Fatal("runner of deleted ref not removed")
+	}
+	if _, err = os.Stat(filepath.Join(baseFolder, "group", RefLocalName("repo", "feature/x"))); !os.IsNotExist(err) {
+		t.Fatal("checkout of deleted ref not removed")
+	}
+	for _, ref := range []string{"feature_x", "v1"} {
+		if _, ok := s.getRunner("group/" + RefLocalName("repo", ref)); !ok {
+			t.Fatalf("ref %s not watched", ref)
+		}
+	}
+}
+
+func TestListPrimaryRefsWithHeaders(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metadata/snapshots" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"repo":"https://gitee.com/test/repo","ref":"v1"},` +
+			`{"repo":"https://gitee.com/test/repo","ref":""},{"repo":"https://gitee.com/test/other","ref":"v2"}]`))
+	}))
+	defer primary.Close()
+	s := &SyncManager{follower: &FollowerConfig{Primary: primary.URL + "/v1/metadata",
+		Headers: map[string]string{"X-API-Key": "secret"}}}
+	refs, err := s.listPrimaryRefs(context.Background(), "https://gitee.com/test/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].Name != "v1" {
+		t.Fatalf("unexpected refs %v", refs)
+	}
+	s.follower.Headers = nil
+	if _, err = s.listPrimaryRefs(context.Background(), "https://gitee.com/test/repo"); err == nil {
+		t.Fatal("refs listed without api key")
+	}
+}
+
+type panicRefLoader struct{}
+
+func (p *panicRefLoader) LoadRef(ref string, files map[string][]string) error {
+	panic("bad files of " + ref)
+}
+
+func TestLoadRefRecoversPanic(t *testing.T) {
+	container := &PluginContainer{}
+	err := container.loadRef(&panicRefLoader{}, "v1", map[string][]string{})
+	if err == nil || !strings.Contains(err.Error(), "bad files of v1") {
+		t.Fatalf("panic of LoadRef not recovered as error, %v", err)
+	}
+}
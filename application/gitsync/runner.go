@@ -0,0 +1,452 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gookit/goutil/fsutil"
+	"go.uber.org/zap"
+)
+
+const DirectoryWalkTimeout = 30
+const DefaultSHA256 = "0000000000000000000000000000000000000000000000000000000000000000"
+const MaxCalculateFiles = 100
+const ProcessTerminateTimeout = 10
+
+type HashResult struct {
+	path string
+	hash string
+	err  error
+}
+
+// BaseRunner holds the watch files of repo checkout and notifies changes, it's shared by all runners
+type BaseRunner struct {
+	ParentFolder string
+	Meta         *GitMeta
+	EventChannel chan<- *GitEvent
+	CloseChannel chan bool
+	SyncInterval int
+	logger       *zap.Logger
+	watchFiles   map[string]string
+	group        string
+	closed       int32
+	closeOnce    sync.Once
+	started      int32
+	doneChannel  chan struct{}
+	revision     atomic.Value
+	schedule     *SyncSchedule
+}
+
+func NewBaseRunner(group, parentFolder string, repo *GitMeta, eventChannel chan<- *GitEvent, interval int, logger *zap.Logger) (*BaseRunner, error) {
+	if !fsutil.DirExist(parentFolder) {
+		return nil, errors.New(fmt.Sprintf("parent folder %s doesn't exist", parentFolder))
+	}
+	//convert relative path into abs
+	watchFiles := make(map[string]string)
+	for _, r := range repo.WatchFiles {
+		//NOTE:
+		//git sync will create a nested folder inside and perform file link switch when updated, therefore, the full
+		//file path would be like:
+		//repo: https://github.com/repo.git
+		//watch file: README.md
+		//group name: group1
+		//local repo path: /developing
+		//full file path: /developing/group1/repo/repo/README.md
+		path := filepath.Join(parentFolder, GetRepoLocalName(repo.Repo), r)
+		watchFiles[path] = DefaultSHA256
+	}
+	return &BaseRunner{
+		ParentFolder: parentFolder,
+		Meta:         repo,
+		EventChannel: eventChannel,
+		SyncInterval: interval,
+		logger:       logger,
+		watchFiles:   watchFiles,
+		group:        group,
+		CloseChannel: make(chan bool, 1),
+		doneChannel:  make(chan struct{}),
+		schedule:     &SyncSchedule{Interval: interval},
+	}, nil
+}
+
+func cmdForLog(command string, args ...string) string {
+	if strings.ContainsAny(command, " \t\n") {
+		command = fmt.Sprintf("%q", command)
+	}
+	argsCopy := make([]string, len(args))
+	copy(argsCopy, args)
+	for i := range args {
+		if strings.ContainsAny(args[i], " \t\n") {
+			argsCopy[i] = fmt.Sprintf("%q", args[i])
+		}
+	}
+	return command + " " + strings.Join(argsCopy, " ")
+}
+
+func (b *BaseRunner) runCommand(ctx context.Context, cwd, command string, args ...string) (string, error) {
+	return b.runCommandWithStdin(ctx, cwd, "", command, args...)
+}
+
+func (b *BaseRunner) runCommandWithStdin(ctx context.Context, cwd, stdin, command string, args ...string) (string, error) {
+	cmdStr := cmdForLog(command, args...)
+	b.logger.Info(fmt.Sprintf("running command cwd %s cmd %s", cwd, cmdStr))
+
+	cmd := exec.Command(command, args...)
+	if cwd != "" {
+		cmd.Dir = cwd
+	}
+	//run command in its own process group, so that all of its children can be terminated together
+	setProcessGroup(cmd)
+	outbuf := bytes.NewBuffer(nil)
+	errbuf := bytes.NewBuffer(nil)
+	cmd.Stdout = outbuf
+	cmd.Stderr = errbuf
+	cmd.Stdin = bytes.NewBufferString(stdin)
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("run(%s): %w", cmdStr, err)
+	}
+	waitChannel := make(chan error, 1)
+	go func() {
+		waitChannel <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-waitChannel:
+	case <-ctx.Done():
+		b.logger.Info(fmt.Sprintf("terminating command %s, reason %v", cmdStr, ctx.Err()))
+		if termErr := terminateProcessGroup(cmd); termErr != nil {
+			b.logger.Warn(fmt.Sprintf("failed to terminate command %s %v", cmdStr, termErr))
+		}
+		select {
+		case err = <-waitChannel:
+		case <-time.After(time.Duration(ProcessTerminateTimeout) * time.Second):
+			b.logger.Warn(fmt.Sprintf("command %s not terminated in %d seconds, killing", cmdStr,
+				ProcessTerminateTimeout))
+			_ = killProcessGroup(cmd)
+			err = <-waitChannel
+		}
+	}
+	stdout := outbuf.String()
+	stderr := errbuf.String()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("run(%s): %w: { stdout: %q, stderr: %q }", cmdStr, ctx.Err(), stdout, stderr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("run(%s): %w: { stdout: %q, stderr: %q }", cmdStr, err, stdout, stderr)
+	}
+	b.logger.Info(fmt.Sprintf("command result stdout %q, stderr %q", stdout, stderr))
+
+	return stdout, nil
+}
+
+func (b *BaseRunner) CompareDigestAndNotify() {
+	b.compareDigestAndNotify(b.RepoPath())
+}
+
+// compareDigestAndNotify compares digests of watch files in root, which is the repo path or a snapshot folder with
+// the same layout, files in root are notified if changed
+func (b *BaseRunner) compareDigestAndNotify(root string) {
+	var changedFiles []string
+	var newDigest string
+	var err error
+	for k := range b.watchFiles {
+		path := k
+		if root != b.RepoPath() {
+			if relative, err := filepath.Rel(b.RepoPath(), k); err == nil {
+				path = filepath.Join(root, relative)
+			}
+		}
+		if fsutil.IsDir(path) {
+			newDigest = b.CalculateDigestForDirectory(path)
+			if newDigest == "" {
+				b.logger.Error(fmt.Sprintf("directory %s skipping watch", path))
+				continue
+			}
+		}
+		if fsutil.FileExist(path) {
+			newDigest, err = b.CalculateDigestForSingleFile(path)
+			if err != nil {
+				b.logger.Error(fmt.Sprintf("failed to calculate file digest, error %v. skipping watch", err))
+				continue
+			}
+		}
+		if newDigest != b.watchFiles[k] {
+			b.watchFiles[k] = newDigest
+			changedFiles = append(changedFiles, path)
+		}
+	}
+	if len(changedFiles) != 0 {
+		event := GitEvent{
+			RepoName:  b.Meta.Repo,
+			GroupName: b.group,
+			Files:     changedFiles,
+			Ref:       b.Meta.Ref,
+		}
+		if atomic.LoadInt32(&b.closed) == 1 {
+			b.logger.Info(fmt.Sprintf("runner for repo %s closed, changes discarded", b.Meta.Repo))
+			return
+		}
+		b.logger.Info(fmt.Sprintf("new changes detected for repo %s, files %v", b.Meta.Repo, changedFiles))
+		select {
+		case b.EventChannel <- &event:
+		case <-b.CloseChannel:
+			b.logger.Info(fmt.Sprintf("runner for repo %s closed, changes discarded", b.Meta.Repo))
+		}
+	}
+}
+
+func (b *BaseRunner) CalculateDigestForSingleFile(filepath string) (string, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return string(h.Sum(nil)), nil
+}
+
+func (b *BaseRunner) processFileHash(filePath string, done chan struct{}) (<-chan HashResult, <-chan error) {
+	resultChannel := make(chan HashResult, 20)
+	errorChannel := make(chan error, 1)
+	go func() {
+		var wg sync.WaitGroup
+		var files = 0
+		//NOTE: Improve the performance by calculating top N files only.
+		err := filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			files += 1
+			if files > MaxCalculateFiles {
+				b.logger.Warn(fmt.Sprintf("only %d files will be calculated for directiry digest,"+
+					"rest will be skipped", MaxCalculateFiles))
+				return nil
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f, err := os.Open(path)
+				if err != nil {
+					resultChannel <- HashResult{path, "", err}
+					return
+				}
+				defer f.Close()
+				h := sha256.New()
+				if _, err := io.Copy(h, f); err != nil {
+					resultChannel <- HashResult{path, "", err}
+					return
+				}
+				resultChannel <- HashResult{path, string(h.Sum(nil)), nil}
+			}()
+			select {
+			case <-done: // HL
+				return errors.New(fmt.Sprintf("walk directory %s canceled", filePath))
+			default:
+				return nil
+			}
+		})
+		go func() {
+			wg.Wait()
+			close(resultChannel)
+			close(errorChannel)
+		}()
+		if err != nil {
+			errorChannel <- err
+		}
+	}()
+	return resultChannel, errorChannel
+}
+
+func (b *BaseRunner) CalculateDigestForDirectory(filepath string) string {
+	var hashes []string
+	doneChannel := make(chan struct{})
+	resultChannel, errorChannel := b.processFileHash(filepath, doneChannel)
+	ticker := time.NewTimer(time.Duration(DirectoryWalkTimeout) * time.Second)
+	for {
+		select {
+		case <-ticker.C:
+			b.logger.Error(fmt.Sprintf("calculate directory %s hashes timed out",
+				filepath))
+			close(doneChannel)
+
+			return ""
+		case e, ok := <-errorChannel:
+			if ok {
+				b.logger.Error(fmt.Sprintf("failed to calculate %s hashes, error %v",
+					filepath, e))
+				close(doneChannel)
+				return ""
+			}
+		case result, ok := <-resultChannel:
+			if ok {
+				if result.err != nil {
+					b.logger.Warn(fmt.Sprintf("failed to calculate file digest %s due to error %v",
+						result.path, result.err))
+				} else {
+					//we only care about hash currently
+					hashes = append(hashes, result.hash)
+				}
+			} else {
+				//calculate result
+				sort.Strings(hashes)
+				b.logger.Info(fmt.Sprintf("%d files calculated for digesting directory %s", len(hashes),
+					filepath))
+				h := sha256.New()
+				for _, c := range hashes {
+					h.Write([]byte(c))
+				}
+				return string(h.Sum(nil))
+			}
+		}
+	}
+}
+
+// RepoPath returns the local path of repo checkout
+func (b *BaseRunner) RepoPath() string {
+	return filepath.Join(b.ParentFolder, GetRepoLocalName(b.Meta.Repo))
+}
+
+// Revision returns the commit id which is currently served
+func (b *BaseRunner) Revision() string {
+	revision := b.revision.Load()
+	if revision == nil {
+		return ""
+	}
+	return revision.(string)
+}
+
+// closeContext returns a context which is canceled when runner closed
+func (b *BaseRunner) closeContext() (context.Context, context.CancelFunc) {
+	//cancel all running git sync processes when closed
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-b.CloseChannel:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// markStarted marks loop started, false is returned if runner is closed before, the loop should quit immediately.
+// started is 0 before loop started, 1 after loop started and 2 if closed before loop started.
+func (b *BaseRunner) markStarted() bool {
+	return atomic.CompareAndSwapInt32(&b.started, 0, 1)
+}
+
+// Close terminates the git sync process and waits for the runner to quit, the runner won't send events once
+// Close returned without error
+func (b *BaseRunner) Close() error {
+	b.closeOnce.Do(func() {
+		atomic.StoreInt32(&b.closed, 1)
+		close(b.CloseChannel)
+	})
+	//loop is never started
+	if atomic.CompareAndSwapInt32(&b.started, 0, 2) || atomic.LoadInt32(&b.started) == 2 {
+		return nil
+	}
+	select {
+	case <-b.doneChannel:
+		return nil
+	case <-time.After(time.Duration(ProcessTerminateTimeout*2) * time.Second):
+		return errors.New(fmt.Sprintf("runner for repo %s not quit in %d seconds", b.Meta.Repo,
+			ProcessTerminateTimeout*2))
+	}
+}
+
+// Schedule returns the effective sync schedule
+func (b *BaseRunner) Schedule() *SyncSchedule {
+	return b.schedule
+}
+
+// SetSchedule replaces the sync schedule, it should be called before loop started
+func (b *BaseRunner) SetSchedule(schedule *SyncSchedule) {
+	b.schedule = schedule
+	b.SyncInterval = schedule.Interval
+}
+
+func (b *BaseRunner) GetRepo() *GitMeta {
+	return b.Meta
+}
+
+// newSnapshotFolder creates an empty folder for new content of repo, it's published by switchLink when filled
+func (b *BaseRunner) newSnapshotFolder(revision string) (string, error) {
+	snapshotsPath := filepath.Join(b.ParentFolder, SnapshotFolder)
+	if err := os.MkdirAll(snapshotsPath, 0755); err != nil {
+		return "", err
+	}
+	target, err := ioutil.TempDir(snapshotsPath, fmt.Sprintf("%s-", revision))
+	if err != nil {
+		return "", err
+	}
+	if err = os.Chmod(target, 0755); err != nil {
+		_ = os.RemoveAll(target)
+		return "", err
+	}
+	return target, nil
+}
+
+// switchLink points repo path to the new snapshot folder atomically
+func (b *BaseRunner) switchLink(target string) error {
+	if info, err := os.Lstat(b.RepoPath()); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return errors.New(fmt.Sprintf("repo path %s exists and is not a symlink", b.RepoPath()))
+	}
+	tmpLink := fmt.Sprintf("%s.tmp", b.RepoPath())
+	_ = os.Remove(tmpLink)
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return err
+	}
+	return os.Rename(tmpLink, b.RepoPath())
+}
+
+// cleanSnapshots removes all snapshots except the current one
+func (b *BaseRunner) cleanSnapshots(current string) {
+	snapshotsPath := filepath.Join(b.ParentFolder, SnapshotFolder)
+	entries, err := ioutil.ReadDir(snapshotsPath)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		path := filepath.Join(snapshotsPath, e.Name())
+		if path == current {
+			continue
+		}
+		if err = os.RemoveAll(path); err != nil {
+			b.logger.Warn(fmt.Sprintf("failed to remove outdated snapshot %s %v", path, err))
+		}
+	}
+}
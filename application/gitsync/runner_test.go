@@ -0,0 +1,90 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestBaseRunner(t *testing.T, eventChannel chan<- *GitEvent) *BaseRunner {
+	parent, err := ioutil.TempDir("", "runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(parent) })
+	repo := &GitMeta{Repo: "https://gitee.com/test/repo", WatchFiles: []string{"README.md"}}
+	if err = os.MkdirAll(filepath.Join(parent, "repo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(parent, "repo", "README.md"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runner, err := NewBaseRunner("group", parent, repo, eventChannel, 10, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runner
+}
+
+func TestCompareDigestAndNotifyAfterClose(t *testing.T) {
+	events := make(chan *GitEvent)
+	runner := newTestBaseRunner(t, events)
+	if err := runner.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//nobody receives events, notify must not block once closed
+	done := make(chan struct{})
+	go func() {
+		runner.CompareDigestAndNotify()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notify blocked after runner closed")
+	}
+	if runner.markStarted() {
+		t.Fatal("loop started after runner closed")
+	}
+}
+
+func TestCloseWaitsForLoop(t *testing.T) {
+	events := make(chan *GitEvent, 1)
+	runner := newTestBaseRunner(t, events)
+	if !runner.markStarted() {
+		t.Fatal("loop not started")
+	}
+	go func() {
+		defer close(runner.doneChannel)
+		<-runner.CloseChannel
+		runner.CompareDigestAndNotify()
+	}()
+	if err := runner.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-runner.doneChannel:
+	default:
+		t.Fatal("close returned before loop quit")
+	}
+	if len(events) != 0 {
+		t.Fatal("event sent after runner closed")
+	}
+}
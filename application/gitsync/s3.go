@@ -0,0 +1,203 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Object is the object listed in bucket
+type S3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+type listBucketResult struct {
+	Contents              []S3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// S3Client is a minimal client of s3 compatible object storage, only listing and downloading objects are supported.
+// Requests are signed with signature version 4, anonymous access is used when access key is empty.
+type S3Client struct {
+	Endpoint  *url.URL
+	Region    string
+	AccessKey string
+	SecretKey string
+	//bucket in path instead of host, which is required by most self-hosted storage
+	PathStyle bool
+	client    *http.Client
+}
+
+func NewS3Client(endpoint, region, accessKey, secretKey string, pathStyle bool, timeout time.Duration) (*S3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("invalid s3 endpoint %s", endpoint))
+	}
+	return &S3Client{
+		Endpoint:  u,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PathStyle: pathStyle,
+		client:    &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// ListObjects lists all objects under prefix
+func (s *S3Client) ListObjects(ctx context.Context, bucket, prefix string) ([]S3Object, error) {
+	var objects []S3Object
+	token := ""
+	for {
+		query := map[string]string{"list-type": "2", "prefix": prefix}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+		response, err := s.do(ctx, bucket, "", query)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		if err = xml.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// GetObject writes the content of object into w
+func (s *S3Client) GetObject(ctx context.Context, bucket, key string, w io.Writer) error {
+	response, err := s.do(ctx, bucket, key, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+func (s *S3Client) do(ctx context.Context, bucket, key string, query map[string]string) (*http.Response, error) {
+	host := s.Endpoint.Host
+	path := strings.TrimSuffix(s.Endpoint.Path, "/")
+	if s.PathStyle {
+		path = fmt.Sprintf("%s/%s", path, bucket)
+	} else {
+		host = fmt.Sprintf("%s.%s", bucket, host)
+	}
+	path = fmt.Sprintf("%s/%s", path, key)
+	canonicalURI := s3Escape(path, false)
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, fmt.Sprintf("%s=%s", s3Escape(k, true), s3Escape(query[k], true)))
+	}
+	canonicalQuery := strings.Join(params, "&")
+	rawURL := fmt.Sprintf("%s://%s%s", s.Endpoint.Scheme, host, canonicalURI)
+	if canonicalQuery != "" {
+		rawURL = fmt.Sprintf("%s?%s", rawURL, canonicalQuery)
+	}
+	request, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	if s.AccessKey != "" {
+		s.sign(request, host, canonicalURI, canonicalQuery, time.Now().UTC())
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, errors.New(fmt.Sprintf("unexpected status code %d from s3 %s: %s", response.StatusCode, rawURL,
+			strings.TrimSpace(string(body))))
+	}
+	return response, nil
+}
+
+// sign adds the authorization header of signature version 4
+func (s *S3Client) sign(request *http.Request, host, canonicalURI, canonicalQuery string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", emptyPayloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", host, emptyPayloadHash,
+		amzDate)
+	canonicalRequest := strings.Join([]string{request.Method, canonicalURI, canonicalQuery, canonicalHeaders,
+		signedHeaders, emptyPayloadHash}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%x", amzDate, scope, sha256.Sum256([]byte(canonicalRequest)))
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x", s.AccessKey, scope, signedHeaders,
+		hmacSHA256(key, stringToSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes all characters except unreserved ones, slash is kept in path
+func s3Escape(value string, escapeSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !escapeSlash) {
+			builder.WriteByte(b)
+		} else {
+			builder.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return builder.String()
+}
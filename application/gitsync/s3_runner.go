@@ -0,0 +1,202 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const DefaultS3Endpoint = "https://s3.amazonaws.com"
+const DefaultS3Region = "us-east-1"
+
+// S3Runner polls objects under a prefix of s3 compatible bucket, objects are downloaded into the same folder layout
+// as git sync does with the prefix removed. Unchanged objects are linked from previous snapshot.
+//
+// options:
+//
+//	endpoint: endpoint of object storage, default https://s3.amazonaws.com
+//	region: default us-east-1
+//	accessKey, secretKey: credentials, read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY if empty
+//	pathStyle: whether bucket is in path, default true
+type S3Runner struct {
+	*BaseRunner
+	Bucket  string
+	Prefix  string
+	client  *S3Client
+	objects map[string]string
+}
+
+func NewS3Runner(group, parentFolder string, repo *GitMeta, eventChannel chan<- *GitEvent, interval int, logger *zap.Logger) (*S3Runner, error) {
+	if !strings.HasPrefix(repo.Path, "s3://") {
+		return nil, errors.New(fmt.Sprintf("s3://bucket/prefix is required for s3 source of repo %s, got '%s'",
+			repo.Repo, repo.Path))
+	}
+	location := strings.SplitN(strings.TrimPrefix(repo.Path, "s3://"), "/", 2)
+	if location[0] == "" {
+		return nil, errors.New(fmt.Sprintf("bucket is required for s3 source of repo %s", repo.Repo))
+	}
+	prefix := ""
+	if len(location) == 2 {
+		prefix = location[1]
+	}
+	endpoint := repo.Options["endpoint"]
+	if endpoint == "" {
+		endpoint = DefaultS3Endpoint
+	}
+	region := repo.Options["region"]
+	if region == "" {
+		region = DefaultS3Region
+	}
+	accessKey := repo.Options["accessKey"]
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	secretKey := repo.Options["secretKey"]
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	pathStyle := true
+	if value, ok := repo.Options["pathStyle"]; ok {
+		var err error
+		if pathStyle, err = strconv.ParseBool(value); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid pathStyle '%s' of repo %s", value, repo.Repo))
+		}
+	}
+	client, err := NewS3Client(endpoint, region, accessKey, secretKey, pathStyle,
+		time.Second*ArchiveDownloadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	base, err := NewBaseRunner(group, parentFolder, repo, eventChannel, interval, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Runner{
+		BaseRunner: base,
+		Bucket:     location[0],
+		Prefix:     prefix,
+		client:     client,
+		objects:    make(map[string]string),
+	}, nil
+}
+
+// Pull downloads objects if any object is added, removed or changed
+func (s *S3Runner) Pull(ctx context.Context) error {
+	objects, err := s.client.ListObjects(ctx, s.Bucket, s.Prefix)
+	if err != nil {
+		return err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	hash := sha256.New()
+	for _, o := range objects {
+		hash.Write([]byte(o.Key + o.ETag))
+	}
+	revision := fmt.Sprintf("%x", hash.Sum(nil))[:12]
+	if revision == s.Revision() {
+		return nil
+	}
+	target, err := s.newSnapshotFolder(revision)
+	if err != nil {
+		return err
+	}
+	current, _ := os.Readlink(s.RepoPath())
+	latest := make(map[string]string, len(objects))
+	for _, o := range objects {
+		//folder placeholder
+		if strings.HasSuffix(o.Key, "/") {
+			continue
+		}
+		relative := strings.TrimPrefix(strings.TrimPrefix(o.Key, s.Prefix), "/")
+		path, err := archiveTarget(target, relative, 0)
+		if err != nil || path == "" {
+			s.logger.Warn(fmt.Sprintf("object %s of bucket %s skipped %v", o.Key, s.Bucket, err))
+			continue
+		}
+		if err = s.download(ctx, o, current, relative, path); err != nil {
+			_ = os.RemoveAll(target)
+			return err
+		}
+		latest[o.Key] = o.ETag
+	}
+	if err = s.switchLink(target); err != nil {
+		_ = os.RemoveAll(target)
+		return err
+	}
+	s.objects = latest
+	s.revision.Store(revision)
+	s.logger.Info(fmt.Sprintf("objects of repo %s updated to revision %s", s.Meta.Repo, revision))
+	s.CompareDigestAndNotify()
+	s.cleanSnapshots(target)
+	return nil
+}
+
+// download links object from current snapshot if not changed, otherwise, gets it from bucket
+func (s *S3Runner) download(ctx context.Context, object S3Object, current, relative, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if etag, ok := s.objects[object.Key]; ok && etag == object.ETag && current != "" {
+		if err := os.Link(filepath.Join(current, filepath.FromSlash(relative)), path); err == nil {
+			return nil
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = s.client.GetObject(ctx, s.Bucket, object.Key, f)
+	f.Close()
+	return err
+}
+
+func (s *S3Runner) StartLoop() {
+	defer close(s.doneChannel)
+	if !s.markStarted() {
+		return
+	}
+	ctx, cancel := s.closeContext()
+	defer cancel()
+	for {
+		if err := s.Pull(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error(fmt.Sprintf("failed to pull objects of repo %s from s3://%s/%s %v", s.Meta.Repo,
+				s.Bucket, s.Prefix, err))
+		}
+		if !s.schedule.Wait(ctx) {
+			s.logger.Info(fmt.Sprintf("s3 runner for repo [%s] received close event, quiting..", s.Meta.Repo))
+			return
+		}
+	}
+}
+
+// RepoUpdated pulls objects immediately
+func (s *S3Runner) RepoUpdated() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*ArchiveDownloadTimeout)
+	defer cancel()
+	if err := s.Pull(ctx); err != nil {
+		s.logger.Error(fmt.Sprintf("failed to pull objects of repo %s %v", s.Meta.Repo, err))
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/opensourceways/app-community-metadata/app"
+	"github.com/robfig/cron/v3"
+)
+
+// SyncSchedule decides when repo is synced, either at fixed interval or by cron expression. In cron mode, syncs are
+// kept at least MinInterval apart and at most MaxInterval apart.
+type SyncSchedule struct {
+	//Seconds between syncs, used when cron is empty
+	Interval int
+	//Cron expression, for instance, "0 2 * * *" or "@daily"
+	Cron        string
+	MinInterval int
+	MaxInterval int
+	cron        cron.Schedule
+	lastSync    time.Time
+	nextSync    atomic.Value
+}
+
+func NewSyncSchedule(interval int, expression string, minInterval, maxInterval int) (*SyncSchedule, error) {
+	s := &SyncSchedule{
+		Interval:    ClampInterval(interval, minInterval, maxInterval),
+		Cron:        expression,
+		MinInterval: minInterval,
+		MaxInterval: maxInterval,
+	}
+	if expression != "" {
+		schedule, err := cron.ParseStandard(expression)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid schedule '%s' %v", expression, err))
+		}
+		s.cron = schedule
+	}
+	return s, nil
+}
+
+// ClampInterval keeps interval within [min, max], bounds are ignored if not positive
+func ClampInterval(interval, min, max int) int {
+	if min > 0 && interval < min {
+		return min
+	}
+	if max > 0 && interval > max {
+		return max
+	}
+	return interval
+}
+
+// Next returns the time of next sync
+func (s *SyncSchedule) Next(now time.Time) time.Time {
+	if s.cron == nil {
+		return now.Add(time.Duration(s.Interval) * time.Second)
+	}
+	from := now
+	if !s.lastSync.IsZero() && s.MinInterval > 0 {
+		if earliest := s.lastSync.Add(time.Duration(s.MinInterval) * time.Second); earliest.After(from) {
+			from = earliest
+		}
+	}
+	next := s.cron.Next(from)
+	if !s.lastSync.IsZero() && s.MaxInterval > 0 {
+		if latest := s.lastSync.Add(time.Duration(s.MaxInterval) * time.Second); latest.Before(next) {
+			next = latest
+		}
+	}
+	return next
+}
+
+// Wait blocks until next sync, false is returned if context done
+func (s *SyncSchedule) Wait(ctx context.Context) bool {
+	if s.lastSync.IsZero() {
+		s.lastSync = time.Now()
+	}
+	next := s.Next(time.Now())
+	s.nextSync.Store(next)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		s.lastSync = time.Now()
+		return true
+	}
+}
+
+// NextSync returns the time of next scheduled sync, zero if not scheduled yet
+func (s *SyncSchedule) NextSync() time.Time {
+	next := s.nextSync.Load()
+	if next == nil {
+		return time.Time{}
+	}
+	return next.(time.Time)
+}
+
+func (s *SyncSchedule) String() string {
+	if s.Cron != "" {
+		return fmt.Sprintf("cron %s", s.Cron)
+	}
+	return fmt.Sprintf("every %ds", s.Interval)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// syncIntervalBounds reads minimum and maximum sync interval from manager config
+func syncIntervalBounds(conf map[string]string) (int, int, error) {
+	minInterval, maxInterval := app.DefaultMinSyncInterval, app.DefaultMaxSyncInterval
+	var err error
+	if value, ok := conf["minSyncInterval"]; ok && value != "" {
+		if minInterval, err = strconv.Atoi(value); err != nil {
+			return 0, 0, errors.New(fmt.Sprintf("manager.minSyncInterval should be integer, got '%s'", value))
+		}
+	}
+	if value, ok := conf["maxSyncInterval"]; ok && value != "" {
+		if maxInterval, err = strconv.Atoi(value); err != nil {
+			return 0, 0, errors.New(fmt.Sprintf("manager.maxSyncInterval should be integer, got '%s'", value))
+		}
+	}
+	if minInterval <= 0 || maxInterval < minInterval {
+		return 0, 0, errors.New(fmt.Sprintf("invalid sync interval bounds [%d, %d]", minInterval, maxInterval))
+	}
+	return minInterval, maxInterval, nil
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gookit/goutil/fsutil"
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+const SnapshotRevisionHeader = "X-Snapshot-Revision"
+
+// SnapshotsConfig is the access policy of snapshot endpoints, they export all watch files of repos including the ones
+// protected by plugin auth policies, therefore they're internal by default
+type SnapshotsConfig struct {
+	//internal(internal listener or loopback only), apikey or jwt, credentials are configured in [auth]
+	Policy string            `mapstructure:"policy"`
+	Keys   []string          `mapstructure:"keys"`
+	Claims map[string]string `mapstructure:"claims"`
+}
+
+// registerSnapshotEndpoints registers snapshot endpoints guarded by the policy in [snapshots]
+func (s *SyncManager) registerSnapshotEndpoints() error {
+	conf := SnapshotsConfig{Policy: "internal"}
+	if app.Config.Exists("snapshots") {
+		if err := app.Config.MapStruct("snapshots", &conf); err != nil {
+			return errors.New(fmt.Sprintf("failed to decode snapshots config %v", err))
+		}
+	}
+	guard, err := s.accessGuard("snapshots", conf.Policy, conf.Keys, conf.Claims)
+	if err != nil {
+		return err
+	}
+	group := s.routerGroup.Group("/snapshots", guard)
+	group.GET("", s.ListSnapshots)
+	group.GET("/:group/:localname", s.ExportSnapshot)
+	return nil
+}
+
+// resolveCheckout resolves repo path of runner once, revision is read from the resolved folder rather than the
+// runner, so that it always matches the files in the folder even if the link is switched meanwhile
+func resolveCheckout(ctx context.Context, r Runner) (string, string, error) {
+	root, err := filepath.EvalSymlinks(r.RepoPath())
+	if err != nil {
+		return "", "", err
+	}
+	//snapshot folders are named after revision
+	if filepath.Base(filepath.Dir(root)) == SnapshotFolder {
+		name := filepath.Base(root)
+		if i := strings.LastIndex(name, "-"); i > 0 {
+			return root, name[:i], nil
+		}
+	}
+	if fsutil.PathExists(filepath.Join(root, ".git")) {
+		revision, err := checkoutRevision(ctx, root)
+		return root, revision, err
+	}
+	//directory source is served in place
+	return root, r.Revision(), nil
+}
+
+// WriteSnapshotBundle writes the watch files of repo checkout into a tar.gz bundle,
+// file names in bundle are relative to the repo checkout.
+func WriteSnapshotBundle(w io.Writer, repoPath string, watchFiles []string) error {
+	root, err := filepath.EvalSymlinks(repoPath)
+	if err != nil {
+		return err
+	}
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, watchFile := range watchFiles {
+		err = filepath.Walk(filepath.Join(root, watchFile), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				//watch file may not exist in this revision
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() && !info.IsDir() {
+				return nil
+			}
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(name)
+			if err = tarWriter.WriteHeader(header); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tarWriter, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err = tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// ExtractSnapshotBundle extracts tar.gz bundle into dest folder
+func ExtractSnapshotBundle(r io.Reader, dest string) error {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+	return extractTar(tar.NewReader(gzipReader), dest, 0)
+}
+
+// ListSnapshots lists the revision of all repos served by this instance
+func (s *SyncManager) ListSnapshots(c *gin.Context) {
+	snapshots := make([]map[string]string, 0)
+	for key, r := range s.listRunners() {
+		snapshots = append(snapshots, map[string]string{
+			"name":     key,
+			"repo":     r.GetRepo().Repo,
+			"ref":      r.GetRepo().Ref,
+			"revision": r.Revision(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i]["name"] < snapshots[j]["name"]
+	})
+	c.JSON(200, snapshots)
+}
+
+// ExportSnapshot exports the watch files of repo at the revision currently served as tar.gz bundle,
+// revision is used as ETag so that followers can skip unchanged snapshots.
+func (s *SyncManager) ExportSnapshot(c *gin.Context) {
+	r, ok := s.getRunner(fmt.Sprintf("%s/%s", c.Param("group"), c.Param("localname")))
+	if !ok {
+		c.JSON(404, nil)
+		return
+	}
+	if r.Revision() == "" {
+		c.Data(503, "text/plain", []byte("snapshot not ready"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Second*DirectoryWalkTimeout)
+	defer cancel()
+	root, revision, err := resolveCheckout(ctx, r)
+	if err != nil || revision == "" {
+		s.logger.Error(fmt.Sprintf("failed to resolve checkout of repo %s %v", r.GetRepo().Repo, err))
+		c.Data(503, "text/plain", []byte("snapshot not ready"))
+		return
+	}
+	etag := fmt.Sprintf("\"%s\"", revision)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(304)
+		return
+	}
+	c.Header("ETag", etag)
+	c.Header(SnapshotRevisionHeader, revision)
+	c.Header("Content-Type", "application/gzip")
+	c.Status(200)
+	if err = WriteSnapshotBundle(c.Writer, root, r.GetRepo().WatchFiles); err != nil {
+		s.logger.Error(fmt.Sprintf("failed to export snapshot of repo %s %v", r.GetRepo().Repo, err))
+	}
+}
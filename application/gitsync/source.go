@@ -0,0 +1,155 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/opensourceways/app-community-metadata/app"
+	"go.uber.org/zap"
+)
+
+const (
+	//Remote git repo synced by git sync
+	GitSyncSource SourceType = "git"
+	//Local git repo or file:// bare repo
+	LocalGitSource SourceType = "localgit"
+	//Plain directory
+	DirectorySource SourceType = "dir"
+	//Archive published over http
+	ArchiveSource SourceType = "archive"
+	//Objects in s3 compatible bucket
+	S3Source SourceType = "s3"
+)
+
+// SourceOptions are used by source to create runner for one repo
+type SourceOptions struct {
+	Group           string
+	LocalName       string
+	ParentFolder    string
+	Meta            *GitMeta
+	EventChannel    chan<- *GitEvent
+	Interval        int
+	Logger          *zap.Logger
+	GitSyncPath     string
+	WebhookEndpoint string
+}
+
+// Source creates runner which keeps repo checkout updated and produces GitEvent for changed files
+type Source interface {
+	NewRunner(options *SourceOptions) (Runner, error)
+}
+
+type gitSyncSource struct{}
+
+func (g *gitSyncSource) NewRunner(options *SourceOptions) (Runner, error) {
+	if options.GitSyncPath == "" {
+		return nil, errors.New(fmt.Sprintf("git sync binary is required for repo %s", options.Meta.Repo))
+	}
+	return NewGitSyncRunner(options.Group, options.ParentFolder, options.Meta, options.EventChannel, options.Interval,
+		options.Logger, options.GitSyncPath, options.WebhookEndpoint)
+}
+
+type localGitSource struct{}
+
+func (l *localGitSource) NewRunner(options *SourceOptions) (Runner, error) {
+	return NewLocalGitRunner(options.Group, options.ParentFolder, options.Meta, options.EventChannel, options.Interval,
+		options.Logger)
+}
+
+type directorySource struct{}
+
+func (d *directorySource) NewRunner(options *SourceOptions) (Runner, error) {
+	return NewDirectoryRunner(options.Group, options.ParentFolder, options.Meta, options.EventChannel, options.Logger)
+}
+
+type archiveSource struct{}
+
+func (a *archiveSource) NewRunner(options *SourceOptions) (Runner, error) {
+	return NewArchiveRunner(options.Group, options.ParentFolder, options.Meta, options.EventChannel, options.Interval,
+		options.Logger)
+}
+
+type s3Source struct{}
+
+func (s *s3Source) NewRunner(options *SourceOptions) (Runner, error) {
+	return NewS3Runner(options.Group, options.ParentFolder, options.Meta, options.EventChannel, options.Interval,
+		options.Logger)
+}
+
+var (
+	sourceMutex sync.RWMutex
+	sources     = map[SourceType]Source{
+		GitSyncSource:   &gitSyncSource{},
+		LocalGitSource:  &localGitSource{},
+		DirectorySource: &directorySource{},
+		ArchiveSource:   &archiveSource{},
+		S3Source:        &s3Source{},
+	}
+)
+
+// RegisterSource used to for source registration
+func RegisterSource(name SourceType, source Source) {
+	sourceMutex.Lock()
+	defer sourceMutex.Unlock()
+	sources[name] = source
+}
+
+func GetSource(name SourceType) (Source, error) {
+	sourceMutex.RLock()
+	defer sourceMutex.RUnlock()
+	if name == "" {
+		name = GitSyncSource
+	}
+	source, ok := sources[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("source %s not registered", name))
+	}
+	return source, nil
+}
+
+type SourceConfig struct {
+	//Repo url declared by plugin
+	Repo string `mapstructure:"repo"`
+	//Source type
+	Type string `mapstructure:"type"`
+	//Local path or file:// url of repo, url of archive or s3://bucket/prefix
+	Path string `mapstructure:"path"`
+	//Extra options of source
+	Options map[string]string `mapstructure:"options"`
+}
+
+// ApplySourceConfig updates the source of repo according to [[sources]] config
+func ApplySourceConfig(repo *GitMeta) {
+	var configs []SourceConfig
+	if !app.Config.Exists("sources") {
+		return
+	}
+	if err := app.Config.MapStruct("sources", &configs); err != nil {
+		app.Logger.Error(fmt.Sprintf("failed to decode sources config %v", err))
+		return
+	}
+	for _, c := range configs {
+		equal, _ := RepoEqualIgnoreSchemaAndLevel(c.Repo, repo.Repo)
+		if c.Repo == repo.Repo || equal {
+			repo.Source = SourceType(c.Type)
+			repo.Path = strings.TrimPrefix(c.Path, "file://")
+			repo.Options = c.Options
+			return
+		}
+	}
+}
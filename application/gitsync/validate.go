@@ -0,0 +1,174 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitsync
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gookit/goutil/fsutil"
+	"github.com/opensourceways/app-community-metadata/app"
+	"github.com/opensourceways/app-community-metadata/application/middleware"
+)
+
+// RegisteredPlugins returns all registered plugins sorted by registration name
+func RegisteredPlugins() ([]string, map[string]Plugin) {
+	pluginMutex.RLock()
+	defer pluginMutex.RUnlock()
+	names := make([]string, 0, len(pluginsContainer))
+	plugins := make(map[string]Plugin, len(pluginsContainer))
+	for name, container := range pluginsContainer {
+		names = append(names, name)
+		plugins[name] = container.Plugin
+	}
+	sort.Strings(names)
+	return names, plugins
+}
+
+func pluginNameRegistered(registered map[string]Plugin, name string) bool {
+	for _, p := range registered {
+		if strings.EqualFold(p.GetMeta().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateConfig checks the loaded config, all problems found are returned
+func ValidateConfig() []error {
+	var problems []error
+	//manager
+	conf := app.Config.StringMap("manager")
+	for _, key := range []string{"syncInterval", "notifyInterval"} {
+		if _, err := strconv.Atoi(conf[key]); err != nil {
+			problems = append(problems, errors.New(fmt.Sprintf("manager.%s should be integer, got '%s'", key, conf[key])))
+		}
+	}
+	if _, _, err := syncIntervalBounds(conf); err != nil {
+		problems = append(problems, err)
+	}
+	if !fsutil.DirExist(conf["baseFolder"]) {
+		problems = append(problems, errors.New(fmt.Sprintf("manager.baseFolder %s not existed", conf["baseFolder"])))
+	}
+	//plugins
+	_, registered := RegisteredPlugins()
+	enabledPlugins := 0
+	configured, _ := app.Config.Get("plugins").(map[string]interface{})
+	for name := range configured {
+		if name == "instances" {
+			continue
+		}
+		if _, ok := registered[name]; !ok {
+			problems = append(problems, errors.New(fmt.Sprintf("plugin %s configured but never registered", name)))
+			continue
+		}
+		value := app.Config.StringMap(fmt.Sprintf("plugins.%s", name))["enabled"]
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, errors.New(fmt.Sprintf("plugins.%s.enabled should be boolean, got '%s'", name, value)))
+		}
+		if enabled {
+			enabledPlugins += 1
+		}
+	}
+	if instances, err := LoadPluginInstances(); err != nil {
+		problems = append(problems, err)
+	} else {
+		for _, instance := range instances {
+			if instance.Enabled == nil || *instance.Enabled {
+				enabledPlugins += 1
+			}
+		}
+	}
+	if enabledPlugins == 0 {
+		problems = append(problems, errors.New("no plugin enabled"))
+	}
+	//follower and ha
+	if _, err := newFollowerConfig(); err != nil {
+		problems = append(problems, err)
+	}
+	ha := app.Config.StringMap("ha")
+	if enabled, _ := strconv.ParseBool(ha["enabled"]); enabled && ha["leaseStore"] != "" {
+		leaseStoreMutex.RLock()
+		if _, ok := leaseStores[ha["leaseStore"]]; !ok {
+			problems = append(problems, errors.New(fmt.Sprintf("lease store %s not registered", ha["leaseStore"])))
+		}
+		leaseStoreMutex.RUnlock()
+	}
+	//auth
+	if authenticator, err := middleware.NewAuthenticator(); err != nil {
+		problems = append(problems, err)
+	} else if authenticator != nil {
+		for _, p := range authenticator.Config.Policies {
+			name := p.Plugin
+			if index := strings.LastIndex(name, "/"); index >= 0 {
+				name = name[index+1:]
+			}
+			if !pluginNameRegistered(registered, name) {
+				problems = append(problems, errors.New(fmt.Sprintf("auth policy of unknown plugin %s", p.Plugin)))
+			}
+		}
+	}
+	if _, err := LoadRepoOverrides(); err != nil {
+		problems = append(problems, err)
+	}
+	//repos
+	if app.Config.Exists("repos") {
+		var repoConfigs []RepoConfig
+		if err := app.Config.MapStruct("repos", &repoConfigs); err != nil {
+			problems = append(problems, errors.New(fmt.Sprintf("failed to decode repos %v", err)))
+		}
+		for _, c := range repoConfigs {
+			for _, ref := range c.Refs {
+				if _, err := path.Match(ref, ""); err != nil {
+					problems = append(problems, errors.New(fmt.Sprintf("invalid ref pattern %s of repo %s", ref, c.Repo)))
+				}
+			}
+			for _, mirror := range c.Mirrors {
+				if GetRepoLocalName(mirror) == "" {
+					problems = append(problems, errors.New(fmt.Sprintf("invalid mirror %s of repo %s", mirror, c.Repo)))
+				}
+			}
+			if c.FailoverThreshold != nil && *c.FailoverThreshold <= 0 {
+				problems = append(problems, errors.New(fmt.Sprintf("failoverThreshold of repo %s should be positive",
+					c.Repo)))
+			}
+			if c.Schedule != nil {
+				if _, err := NewSyncSchedule(0, *c.Schedule, 0, 0); err != nil {
+					problems = append(problems, errors.New(fmt.Sprintf("repo %s: %v", c.Repo, err)))
+				}
+			}
+		}
+	}
+	//sources
+	if app.Config.Exists("sources") {
+		var sourceConfigs []SourceConfig
+		if err := app.Config.MapStruct("sources", &sourceConfigs); err != nil {
+			problems = append(problems, errors.New(fmt.Sprintf("failed to decode sources %v", err)))
+		}
+		for _, c := range sourceConfigs {
+			if _, err := GetSource(SourceType(c.Type)); err != nil {
+				problems = append(problems, errors.New(fmt.Sprintf("sources of repo %s: %v", c.Repo, err)))
+			}
+			if SourceType(c.Type) != GitSyncSource && c.Type != "" && c.Path == "" {
+				problems = append(problems, errors.New(fmt.Sprintf("sources of repo %s: path is required", c.Repo)))
+			}
+		}
+	}
+	return problems
+}
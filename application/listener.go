@@ -0,0 +1,160 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package application
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+// CertReloadInterval is the seconds between checks of certificate files
+const CertReloadInterval = 10
+
+type ListenerConfig struct {
+	//Address to listen, for instance, 0.0.0.0:443
+	Address string `mapstructure:"address"`
+	//Serve https with certificate and key files, files are reloaded when changed
+	TLS      bool   `mapstructure:"tls"`
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+	//Internal listener is plain http, it serves git sync triggers and admin endpoints
+	Internal bool `mapstructure:"internal"`
+}
+
+// LoadListenerConfigs reads [[listeners]] config, plain http on httpPort is used if not configured
+func LoadListenerConfigs() ([]ListenerConfig, error) {
+	if !app.Config.Exists("listeners") {
+		return []ListenerConfig{{Address: fmt.Sprintf("0.0.0.0:%d", app.HttpPort)}}, nil
+	}
+	var listeners []ListenerConfig
+	if err := app.Config.MapStruct("listeners", &listeners); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode listeners config %v", err))
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("at least one listener is required")
+	}
+	for _, l := range listeners {
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid listener address '%s' %v", l.Address, err))
+		}
+		if l.TLS && (l.CertFile == "" || l.KeyFile == "") {
+			return nil, errors.New(fmt.Sprintf("certFile and keyFile are required for tls listener %s", l.Address))
+		}
+		if l.TLS && l.Internal {
+			return nil, errors.New(fmt.Sprintf("internal listener %s should be plain http", l.Address))
+		}
+	}
+	return listeners, nil
+}
+
+// triggerPort returns the port of internal listener, or the first plain listener reachable from loopback
+func triggerPort(listeners []ListenerConfig) int {
+	var candidates []ListenerConfig
+	for _, l := range listeners {
+		if l.Internal {
+			candidates = append(candidates, l)
+		}
+	}
+	for _, l := range listeners {
+		if !l.TLS && !l.Internal {
+			candidates = append(candidates, l)
+		}
+	}
+	for _, l := range candidates {
+		host, port, _ := net.SplitHostPort(l.Address)
+		ip := net.ParseIP(host)
+		if host == "" || host == "localhost" || (ip != nil && (ip.IsLoopback() || ip.IsUnspecified())) {
+			value, _ := strconv.Atoi(port)
+			return value
+		}
+	}
+	return 0
+}
+
+// CertReloader serves the certificate from files, files are checked for changes at most every CertReloadInterval
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *CertReloader) load() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to load certificate %s %v", r.CertFile, err))
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// GetCertificate reloads certificate if files changed, previous certificate is kept if reload fails
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checked) < time.Second*CertReloadInterval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	modTime, err := r.latestModTime()
+	if err != nil || !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	if err = r.load(); err != nil {
+		color.Error.Printf("certificate not reloaded %v\n", err)
+		app.Logger.Error(fmt.Sprintf("certificate not reloaded %v", err))
+		return r.cert, nil
+	}
+	app.Logger.Info(fmt.Sprintf("certificate %s reloaded", r.CertFile))
+	return r.cert, nil
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+const (
+	PublicPolicy = "public"
+	APIKeyPolicy = "apikey"
+	JWTPolicy    = "jwt"
+)
+
+// CallerKey is the context key of authenticated caller, for instance, apikey:ci or jwt:alice
+const CallerKey = "caller"
+
+type AuthPolicy struct {
+	//Plugin the policy applies to, in the form of group/name or name
+	Plugin string `mapstructure:"plugin"`
+	//Path prefix relative to plugin endpoints, for instance, /templates, the whole plugin if empty
+	Path string `mapstructure:"path"`
+	//public, apikey or jwt
+	Policy string `mapstructure:"policy"`
+	//Names of api keys allowed, all keys if empty
+	Keys []string `mapstructure:"keys"`
+	//Claims required besides the global ones, arrays in token match if any element equals
+	Claims map[string]string `mapstructure:"claims"`
+}
+
+type JWTConfig struct {
+	//JWKS url of identity provider
+	JWKSUrl string `mapstructure:"jwksUrl"`
+	//PEM public key file of RSA or ECDSA, used if JWKS url is empty
+	KeyFile string `mapstructure:"keyFile"`
+	//HMAC secret, used if neither JWKS url nor key file configured
+	Secret   string            `mapstructure:"secret"`
+	Issuer   string            `mapstructure:"issuer"`
+	Audience string            `mapstructure:"audience"`
+	Claims   map[string]string `mapstructure:"claims"`
+}
+
+type AuthConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	//Policy of plugins not matching any policy
+	Default      string `mapstructure:"default"`
+	APIKeyHeader string `mapstructure:"apiKeyHeader"`
+	//Name to api key, the name is logged as caller
+	APIKeys  map[string]string `mapstructure:"apikeys"`
+	JWT      JWTConfig         `mapstructure:"jwt"`
+	Policies []AuthPolicy      `mapstructure:"policies"`
+}
+
+// Authenticator checks requests of plugin endpoints against the policies in [auth] config
+type Authenticator struct {
+	Config   *AuthConfig
+	verifier *JWTVerifier
+}
+
+// NewAuthenticator reads [auth] config, nil is returned if authentication disabled
+func NewAuthenticator() (*Authenticator, error) {
+	if !app.Config.Exists("auth") {
+		return nil, nil
+	}
+	conf := AuthConfig{
+		Default:      PublicPolicy,
+		APIKeyHeader: DefaultAPIKeyHeader,
+	}
+	if err := app.Config.MapStruct("auth", &conf); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode auth config %v", err))
+	}
+	if !conf.Enabled {
+		return nil, nil
+	}
+	usingJWT := conf.Default == JWTPolicy
+	policies := append([]AuthPolicy{{Policy: conf.Default}}, conf.Policies...)
+	for _, p := range policies {
+		switch p.Policy {
+		case PublicPolicy:
+		case APIKeyPolicy:
+			for _, k := range p.Keys {
+				if _, ok := conf.APIKeys[k]; !ok {
+					return nil, errors.New(fmt.Sprintf("api key %s of plugin %s not configured", k, p.Plugin))
+				}
+			}
+		case JWTPolicy:
+			usingJWT = true
+		default:
+			return nil, errors.New(fmt.Sprintf("unknown auth policy '%s' of plugin %s", p.Policy, p.Plugin))
+		}
+	}
+	a := &Authenticator{Config: &conf}
+	jwtConfigured := conf.JWT.JWKSUrl != "" || conf.JWT.KeyFile != "" || conf.JWT.Secret != ""
+	if usingJWT || jwtConfigured {
+		verifier, err := NewJWTVerifier(&conf.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.verifier = verifier
+	}
+	return a, nil
+}
+
+// pluginPolicies returns the policies of plugin, the longest path first
+func (a *Authenticator) pluginPolicies(group, name string) []AuthPolicy {
+	var policies []AuthPolicy
+	for _, p := range a.Config.Policies {
+		if strings.EqualFold(p.Plugin, name) || strings.EqualFold(p.Plugin, fmt.Sprintf("%s/%s", group, name)) {
+			policies = append(policies, p)
+		}
+	}
+	sort.SliceStable(policies, func(i, j int) bool {
+		return len(policies[i].Path) > len(policies[j].Path)
+	})
+	return policies
+}
+
+// Middleware returns the handler attached to router group of plugin, basePath is the path of the group
+func (a *Authenticator) Middleware(group, name, basePath string) gin.HandlerFunc {
+	policies := a.pluginPolicies(group, name)
+	return func(c *gin.Context) {
+		policy := &AuthPolicy{Policy: a.Config.Default}
+		relative := strings.TrimPrefix(c.Request.URL.Path, basePath)
+		for i := range policies {
+			if strings.HasPrefix(relative, policies[i].Path) {
+				policy = &policies[i]
+				break
+			}
+		}
+		a.Check(c, policy)
+		if !c.IsAborted() {
+			c.Next()
+		}
+	}
+}
+
+// Check authenticates request with policy, request is aborted if not allowed
+func (a *Authenticator) Check(c *gin.Context, policy *AuthPolicy) {
+	switch policy.Policy {
+	case APIKeyPolicy:
+		a.checkAPIKey(c, policy)
+	case JWTPolicy:
+		if a.verifier == nil {
+			unauthorized(c, "jwt not configured")
+			return
+		}
+		a.checkJWT(c, policy)
+	}
+}
+
+func (a *Authenticator) checkAPIKey(c *gin.Context, policy *AuthPolicy) {
+	key := c.GetHeader(a.Config.APIKeyHeader)
+	if key == "" {
+		unauthorized(c, fmt.Sprintf("api key required in header %s", a.Config.APIKeyHeader))
+		return
+	}
+	for name, value := range a.Config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(value)) == 1 {
+			if len(policy.Keys) != 0 && !containsString(policy.Keys, name) {
+				forbidden(c, fmt.Sprintf("api key %s not allowed", name))
+				return
+			}
+			c.Set(CallerKey, fmt.Sprintf("apikey:%s", name))
+			return
+		}
+	}
+	unauthorized(c, "invalid api key")
+}
+
+func (a *Authenticator) checkJWT(c *gin.Context, policy *AuthPolicy) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		unauthorized(c, "bearer token required")
+		return
+	}
+	claims, err := a.verifier.Verify(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		unauthorized(c, fmt.Sprintf("invalid token %v", err))
+		return
+	}
+	if err = RequireClaims(claims, policy.Claims); err != nil {
+		forbidden(c, err.Error())
+		return
+	}
+	subject, _ := claims["sub"].(string)
+	c.Set(CallerKey, fmt.Sprintf("jwt:%s", subject))
+}
+
+func unauthorized(c *gin.Context, message string) {
+	c.Header("WWW-Authenticate", "Bearer")
+	c.Data(401, "text/plain", []byte(message))
+	c.Abort()
+}
+
+func forbidden(c *gin.Context, message string) {
+	c.Data(403, "text/plain", []byte(message))
+	c.Abort()
+}
+
+func containsString(s []string, name string) bool {
+	for _, v := range s {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
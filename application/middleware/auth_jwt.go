@@ -0,0 +1,266 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const JWKSRefreshInterval = 3600
+const JWKSMinRefreshInterval = 60
+const JWKSFetchTimeout = 10
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWTVerifier verifies tokens with keys from JWKS url, local key file or HMAC secret
+type JWTVerifier struct {
+	config    *JWTConfig
+	key       interface{}
+	mutex     sync.RWMutex
+	keys      map[string]interface{}
+	refreshed time.Time
+	//Last fetch of JWKS whether succeeded or not
+	attempted time.Time
+	//Only one fetch of JWKS at a time, 1 if background refresh is running
+	refreshMutex sync.Mutex
+	refreshing   int32
+}
+
+func NewJWTVerifier(config *JWTConfig) (*JWTVerifier, error) {
+	v := &JWTVerifier{config: config}
+	switch {
+	case config.JWKSUrl != "":
+		if err := v.refreshKeys(); err != nil {
+			return nil, err
+		}
+	case config.KeyFile != "":
+		content, err := ioutil.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to read jwt key file %v", err))
+		}
+		if v.key, err = jwt.ParseRSAPublicKeyFromPEM(content); err != nil {
+			if v.key, err = jwt.ParseECPublicKeyFromPEM(content); err != nil {
+				return nil, errors.New(fmt.Sprintf("jwt key file %s is neither rsa nor ecdsa public key",
+					config.KeyFile))
+			}
+		}
+	case config.Secret != "":
+		v.key = []byte(config.Secret)
+	default:
+		return nil, errors.New("jwksUrl, keyFile or secret is required for jwt policy")
+	}
+	return v, nil
+}
+
+// Verify checks signature, expiry, issuer, audience and global required claims of token
+func (v *JWTVerifier) Verify(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, v.keyFunc); err != nil {
+		return nil, err
+	}
+	if v.config.Issuer != "" && !claims.VerifyIssuer(v.config.Issuer, true) {
+		return nil, errors.New("issuer mismatch")
+	}
+	if v.config.Audience != "" && !claims.VerifyAudience(v.config.Audience, true) {
+		return nil, errors.New("audience mismatch")
+	}
+	if err := RequireClaims(claims, v.config.Claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	if v.config.JWKSUrl == "" {
+		return v.key, checkSigningMethod(token, v.key)
+	}
+	kid, _ := token.Header["kid"].(string)
+	key := v.lookupKey(kid)
+	if key == nil {
+		//keys may be rotated, refresh at most once a minute
+		if err := v.refreshKeysOnce(time.Second * JWKSMinRefreshInterval); err != nil {
+			return nil, err
+		}
+		if key = v.lookupKey(kid); key == nil {
+			return nil, errors.New(fmt.Sprintf("key %s not found in jwks", kid))
+		}
+	}
+	return key, checkSigningMethod(token, key)
+}
+
+// checkSigningMethod returns error if algorithm of token doesn't belong to the family of key, for instance, HMAC
+// token signed with RSA public key as secret
+func checkSigningMethod(token *jwt.Token, key interface{}) error {
+	ok := false
+	switch key.(type) {
+	case []byte:
+		_, ok = token.Method.(*jwt.SigningMethodHMAC)
+	case *rsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	}
+	if !ok {
+		return errors.New(fmt.Sprintf("unexpected signing method %s", token.Method.Alg()))
+	}
+	return nil
+}
+
+func (v *JWTVerifier) lookupKey(kid string) interface{} {
+	v.mutex.RLock()
+	expired := time.Since(v.refreshed) > time.Second*JWKSRefreshInterval
+	key := v.keys[kid]
+	v.mutex.RUnlock()
+	//cached keys are still used while refreshing, only one refresh runs in background
+	if expired && atomic.CompareAndSwapInt32(&v.refreshing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&v.refreshing, 0)
+			_ = v.refreshKeysOnce(time.Second * JWKSMinRefreshInterval)
+		}()
+	}
+	return key
+}
+
+// refreshKeysOnce fetches JWKS unless it's fetched within interval, concurrent callers wait for the running fetch
+// instead of fetching again
+func (v *JWTVerifier) refreshKeysOnce(interval time.Duration) error {
+	v.refreshMutex.Lock()
+	defer v.refreshMutex.Unlock()
+	v.mutex.RLock()
+	recent := time.Since(v.attempted) < interval
+	v.mutex.RUnlock()
+	if recent {
+		return nil
+	}
+	return v.refreshKeys()
+}
+
+func (v *JWTVerifier) refreshKeys() error {
+	v.mutex.Lock()
+	v.attempted = time.Now()
+	v.mutex.Unlock()
+	client := http.Client{Timeout: time.Second * JWKSFetchTimeout}
+	response, err := client.Get(v.config.JWKSUrl)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to fetch jwks %v", err))
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("unexpected status code %d from jwks url", response.StatusCode))
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&jwks); err != nil {
+		return errors.New(fmt.Sprintf("failed to decode jwks %v", err))
+	}
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	v.mutex.Lock()
+	v.keys = keys
+	v.refreshed = time.Now()
+	v.mutex.Unlock()
+	return nil
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New(fmt.Sprintf("unsupported curve %s", k.Crv))
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported key type %s", k.Kty))
+}
+
+// RequireClaims checks that every required claim equals the value in token, or contains it if claim is an array
+func RequireClaims(claims jwt.MapClaims, required map[string]string) error {
+	for name, value := range required {
+		switch actual := claims[name].(type) {
+		case string:
+			if actual == value {
+				continue
+			}
+		case []interface{}:
+			found := false
+			for _, a := range actual {
+				if fmt.Sprintf("%v", a) == value {
+					found = true
+				}
+			}
+			if found {
+				continue
+			}
+		default:
+			if actual != nil && fmt.Sprintf("%v", actual) == value {
+				continue
+			}
+		}
+		return errors.New(fmt.Sprintf("claim %s should be %s", name, value))
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testSecret = "secret"
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims, kid string) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "alice", "iss": "https://id.example.com", "aud": "metadata", "tenant": "openeuler",
+		"groups": []string{"infra", "dev"}, "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+// newAuthEngine serves /v1/metadata/infrastructure/test with authenticator, /admin of plugin requires keys or claims
+// of policies
+func newAuthEngine(a *Authenticator) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	group := engine.Group("/v1/metadata/infrastructure/test")
+	group.Use(a.Middleware("infrastructure", "test", group.BasePath()))
+	handler := func(c *gin.Context) {
+		c.Data(200, "text/plain", []byte(c.GetString(CallerKey)))
+	}
+	group.GET("/public", handler)
+	group.GET("/admin", handler)
+	return engine
+}
+
+func request(engine *gin.Engine, path string, headers map[string]string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/metadata/infrastructure/test"+path, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	engine.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func TestAPIKeyPolicy(t *testing.T) {
+	a := &Authenticator{Config: &AuthConfig{Default: APIKeyPolicy, APIKeyHeader: DefaultAPIKeyHeader,
+		APIKeys: map[string]string{"ci": "ci-key", "ops": "ops-key"},
+		Policies: []AuthPolicy{{Plugin: "infrastructure/test", Path: "/admin", Policy: APIKeyPolicy,
+			Keys: []string{"ops"}}}}}
+	engine := newAuthEngine(a)
+	cases := []struct {
+		path   string
+		key    string
+		status int
+		caller string
+	}{
+		{"/public", "", 401, ""},
+		{"/public", "random", 401, ""},
+		{"/public", "ci-key", 200, "apikey:ci"},
+		{"/admin", "ci-key", 403, ""},
+		{"/admin", "ops-key", 200, "apikey:ops"},
+	}
+	for _, c := range cases {
+		headers := map[string]string{}
+		if c.key != "" {
+			headers[DefaultAPIKeyHeader] = c.key
+		}
+		recorder := request(engine, c.path, headers)
+		if recorder.Code != c.status || (c.status == 200 && recorder.Body.String() != c.caller) {
+			t.Errorf("%s with key %q returns %d %s, expected %d %s", c.path, c.key, recorder.Code,
+				recorder.Body.String(), c.status, c.caller)
+		}
+	}
+}
+
+func TestJWTPolicy(t *testing.T) {
+	conf := &JWTConfig{Secret: testSecret, Issuer: "https://id.example.com", Audience: "metadata",
+		Claims: map[string]string{"tenant": "openeuler"}}
+	verifier, err := NewJWTVerifier(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Authenticator{Config: &AuthConfig{Default: JWTPolicy, JWT: *conf,
+		Policies: []AuthPolicy{{Plugin: "test", Path: "/admin", Policy: JWTPolicy,
+			Claims: map[string]string{"groups": "infra", "role": "admin"}}}}, verifier: verifier}
+	engine := newAuthEngine(a)
+	with := func(update func(claims jwt.MapClaims)) string {
+		claims := validClaims()
+		update(claims)
+		return signToken(t, jwt.SigningMethodHS256, []byte(testSecret), claims, "")
+	}
+	cases := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"valid", "/public", with(func(claims jwt.MapClaims) {}), 200},
+		{"missing", "/public", "", 401},
+		{"expired", "/public", with(func(claims jwt.MapClaims) {
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+		}), 401},
+		{"wrong issuer", "/public", with(func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" }), 401},
+		{"wrong audience", "/public", with(func(claims jwt.MapClaims) { claims["aud"] = "other" }), 401},
+		{"missing global claim", "/public", with(func(claims jwt.MapClaims) { delete(claims, "tenant") }), 401},
+		{"wrong global claim", "/public", with(func(claims jwt.MapClaims) { claims["tenant"] = "opengauss" }), 401},
+		{"wrong secret", "/public", signToken(t, jwt.SigningMethodHS256, []byte("other"), validClaims(), ""), 401},
+		{"missing policy claim", "/admin", with(func(claims jwt.MapClaims) {}), 403},
+		{"policy claims", "/admin", with(func(claims jwt.MapClaims) { claims["role"] = "admin" }), 200},
+	}
+	for _, c := range cases {
+		headers := map[string]string{}
+		if c.token != "" {
+			headers["Authorization"] = "Bearer " + c.token
+		}
+		recorder := request(engine, c.path, headers)
+		if recorder.Code != c.status || (c.status == 200 && recorder.Body.String() != "jwt:alice") {
+			t.Errorf("token %s returns %d %s, expected %d", c.name, recorder.Code, recorder.Body.String(), c.status)
+		}
+	}
+}
+
+func newRSAKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+}
+
+func TestJWTRejectsHMACWithRSAKey(t *testing.T) {
+	key, publicPEM := newRSAKey(t)
+	folder, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	keyFile := filepath.Join(folder, "key.pem")
+	if err = ioutil.WriteFile(keyFile, publicPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewJWTVerifier(&JWTConfig{KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifier.Verify(signToken(t, jwt.SigningMethodRS256, key, validClaims(), "")); err != nil {
+		t.Fatalf("token signed with rsa key is rejected %v", err)
+	}
+	//public key is known by everyone, it must never be accepted as HMAC secret
+	if _, err = verifier.Verify(signToken(t, jwt.SigningMethodHS256, publicPEM, validClaims(), "")); err == nil {
+		t.Fatal("HMAC token signed with rsa public key is accepted")
+	}
+}
+
+// jwksServer serves JWKS of one RSA key, fetches are counted
+type jwksServer struct {
+	key     *rsa.PrivateKey
+	fetched int32
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&s.fetched, 1)
+	//slow identity provider, refreshes overlap if not limited
+	time.Sleep(50 * time.Millisecond)
+	content, _ := json.Marshal(map[string]interface{}{"keys": []jsonWebKey{{
+		Kid: "rsa",
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}}})
+	_, _ = w.Write(content)
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	key, publicPEM := newRSAKey(t)
+	server := &jwksServer{key: key}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	verifier, err := NewJWTVerifier(&JWTConfig{JWKSUrl: httpServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifier.Verify(signToken(t, jwt.SigningMethodRS256, key, validClaims(), "rsa")); err != nil {
+		t.Fatalf("token signed with jwks key is rejected %v", err)
+	}
+	if _, err = verifier.Verify(signToken(t, jwt.SigningMethodHS256, publicPEM, validClaims(), "rsa")); err == nil {
+		t.Fatal("HMAC token is accepted with RSA key of jwks")
+	}
+	//unknown kid refreshes jwks at most once a minute
+	for i := 0; i < 3; i++ {
+		if _, err = verifier.Verify(signToken(t, jwt.SigningMethodRS256, key, validClaims(), "unknown")); err == nil {
+			t.Fatal("token with unknown kid is accepted")
+		}
+	}
+	if fetched := atomic.LoadInt32(&server.fetched); fetched != 1 {
+		t.Fatalf("jwks fetched %d times, expected once", fetched)
+	}
+
+	//expired cache is refreshed once in background while cached keys are still used
+	verifier.mutex.Lock()
+	verifier.refreshed = time.Now().Add(-2 * time.Second * JWKSRefreshInterval)
+	verifier.attempted = verifier.refreshed
+	verifier.mutex.Unlock()
+	token := signToken(t, jwt.SigningMethodRS256, key, validClaims(), "rsa")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := verifier.Verify(token); err != nil {
+				t.Errorf("token rejected while refreshing %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 100 && atomic.LoadInt32(&verifier.refreshing) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fetched := atomic.LoadInt32(&server.fetched); fetched != 2 {
+		t.Fatalf("jwks fetched %d times after cache expired, expected one refresh", fetched)
+	}
+}
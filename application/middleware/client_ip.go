@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+const clientIPKey = "client_ip"
+
+// ClientIPResolver resolves client ip with X-Forwarded-For or X-Real-Ip only when peer is one of trusted proxies
+type ClientIPResolver struct {
+	proxies []*net.IPNet
+}
+
+// LoadClientIPResolver reads trustedProxies config, forwarded headers are never used if it's empty
+func LoadClientIPResolver() (*ClientIPResolver, error) {
+	return NewClientIPResolver(app.Config.Strings("trustedProxies"))
+}
+
+func NewClientIPResolver(proxies []string) (*ClientIPResolver, error) {
+	cidrs, err := ParseTrustedProxies(proxies)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientIPResolver{proxies: cidrs}, nil
+}
+
+// ParseTrustedProxies parses IPs or CIDRs of proxies
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p = p + "/32"
+			} else {
+				p = p + "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid trusted proxy %s %v", p, err))
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// ResolveClientIP resolves client ip of every request, handlers read it with ClientIP
+func ResolveClientIP(r *ClientIPResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(clientIPKey, r.Resolve(c))
+		c.Next()
+	}
+}
+
+// ClientIP returns client ip resolved by ResolveClientIP, or the peer address if not resolved
+func ClientIP(c *gin.Context) string {
+	if ip := c.GetString(clientIPKey); ip != "" {
+		return ip
+	}
+	return peerHost(c)
+}
+
+func peerHost(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// Resolve returns the peer address unless it's a trusted proxy, in which case the X-Forwarded-For is walked from the
+// right, the first address not trusted is the client, addresses added by client itself are never used
+func (r *ClientIPResolver) Resolve(c *gin.Context) string {
+	host := peerHost(c)
+	ip := net.ParseIP(host)
+	if ip == nil || !r.trusted(ip) {
+		return host
+	}
+	var hops []string
+	for _, h := range c.Request.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	if len(hops) == 0 && c.GetHeader("X-Real-Ip") != "" {
+		hops = []string{c.GetHeader("X-Real-Ip")}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return ip.String()
+		}
+		ip = hop
+		if !r.trusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func (r *ClientIPResolver) trusted(ip net.IP) bool {
+	for _, cidr := range r.proxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
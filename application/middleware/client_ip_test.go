@@ -0,0 +1,56 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remoteAddr string
+		headers    map[string]string
+		ip         string
+	}{
+		{"1.2.3.4:1000", nil, "1.2.3.4"},
+		//forwarded headers from untrusted peer are ignored
+		{"1.2.3.4:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4"},
+		{"1.2.3.4:1000", map[string]string{"X-Real-Ip": "5.6.7.8"}, "1.2.3.4"},
+		{"10.1.1.1:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"192.168.1.1:1000", map[string]string{"X-Real-Ip": "5.6.7.8"}, "5.6.7.8"},
+		//addresses prepended by client are never used
+		{"10.1.1.1:1000", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.2.2.2"}, "5.6.7.8"},
+		{"10.1.1.1:1000", map[string]string{"X-Forwarded-For": "5.6.7.8, invalid"}, "10.1.1.1"},
+		{"192.168.1.2:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "192.168.1.2"},
+	}
+	for _, c := range cases {
+		context := newTestContext(c.remoteAddr, c.headers)
+		ResolveClientIP(resolver)(context)
+		if ip := ClientIP(context); ip != c.ip {
+			t.Errorf("client ip of %s with %v is %s, expected %s", c.remoteAddr, c.headers, ip, c.ip)
+		}
+	}
+	//peer address is used if not resolved
+	context := newTestContext("10.1.1.1:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"})
+	if ip := ClientIP(context); ip != "10.1.1.1" {
+		t.Errorf("client ip is %s without resolver, expected peer address", ip)
+	}
+	if _, err = NewClientIPResolver([]string{"invalid"}); err == nil {
+		t.Fatal("invalid proxy is accepted")
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+type CORSRule struct {
+	//Path prefix of route group, the longest matched prefix wins
+	Prefix string `mapstructure:"prefix"`
+	//Allowed origins, * for any origin, glob patterns such as https://*.osinfra.cn are supported
+	Origins []string `mapstructure:"origins"`
+	Methods []string `mapstructure:"methods"`
+	Headers []string `mapstructure:"headers"`
+	//Response headers exposed to browser
+	ExposeHeaders    []string `mapstructure:"exposeHeaders"`
+	AllowCredentials bool     `mapstructure:"allowCredentials"`
+	//Seconds preflight result can be cached
+	MaxAge int `mapstructure:"maxAge"`
+}
+
+type CORSConfig struct {
+	Enabled bool       `mapstructure:"enabled"`
+	Rules   []CORSRule `mapstructure:"rules"`
+}
+
+// LoadCORSConfig reads [cors] config, nil is returned if cors disabled
+func LoadCORSConfig() (*CORSConfig, error) {
+	if !app.Config.Exists("cors") {
+		return nil, nil
+	}
+	var conf CORSConfig
+	if err := app.Config.MapStruct("cors", &conf); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode cors config %v", err))
+	}
+	if !conf.Enabled {
+		return nil, nil
+	}
+	for i, r := range conf.Rules {
+		if r.Prefix == "" {
+			conf.Rules[i].Prefix = "/"
+		}
+		for _, o := range r.Origins {
+			if _, err := path.Match(o, ""); err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid cors origin %s of %s", o, r.Prefix))
+			}
+			if o == "*" && r.AllowCredentials {
+				return nil, errors.New(fmt.Sprintf("credentials can't be allowed for any origin of %s", r.Prefix))
+			}
+		}
+		if len(r.Methods) == 0 {
+			conf.Rules[i].Methods = []string{"GET", "HEAD", "OPTIONS"}
+		}
+	}
+	sort.SliceStable(conf.Rules, func(i, j int) bool {
+		return len(conf.Rules[i].Prefix) > len(conf.Rules[j].Prefix)
+	})
+	return &conf, nil
+}
+
+// CORS adds cross origin headers to requests from allowed origins, preflight requests are answered directly
+func CORS(conf *CORSConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		var rule *CORSRule
+		for i := range conf.Rules {
+			if strings.HasPrefix(c.Request.URL.Path, conf.Rules[i].Prefix) {
+				rule = &conf.Rules[i]
+				break
+			}
+		}
+		preflight := c.Request.Method == "OPTIONS" && c.GetHeader("Access-Control-Request-Method") != ""
+		if rule == nil || !originAllowed(rule.Origins, origin) {
+			if preflight {
+				c.AbortWithStatus(403)
+				return
+			}
+			c.Next()
+			return
+		}
+		c.Header("Vary", "Origin")
+		if containsString(rule.Origins, "*") {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		if rule.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if len(rule.ExposeHeaders) != 0 {
+				c.Header("Access-Control-Expose-Headers", strings.Join(rule.ExposeHeaders, ", "))
+			}
+			c.Next()
+			return
+		}
+		c.Header("Access-Control-Allow-Methods", strings.Join(rule.Methods, ", "))
+		if len(rule.Headers) != 0 {
+			c.Header("Access-Control-Allow-Headers", strings.Join(rule.Headers, ", "))
+		}
+		if rule.MaxAge > 0 {
+			c.Header("Access-Control-Max-Age", strconv.Itoa(rule.MaxAge))
+		}
+		c.AbortWithStatus(204)
+	}
+}
+
+func originAllowed(origins []string, origin string) bool {
+	for _, o := range origins {
+		if ok, _ := path.Match(o, origin); ok || o == origin {
+			return true
+		}
+	}
+	return false
+}
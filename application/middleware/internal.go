@@ -0,0 +1,36 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type internalListenerKey struct{}
+
+// MarkInternal marks requests served by internal listener
+func MarkInternal(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), internalListenerKey{}, true)))
+	})
+}
+
+// IsInternalRequest returns true if request is served by internal listener
+func IsInternalRequest(c *gin.Context) bool {
+	internal, _ := c.Request.Context().Value(internalListenerKey{}).(bool)
+	return internal
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+const MemoryLimiterStoreName = "memory"
+const DefaultAPIKeyHeader = "X-API-Key"
+
+// LimiterStore keeps the token buckets of clients, buckets should be shared among replicas by stores other than memory
+type LimiterStore interface {
+	//Take one token from bucket of key, return whether it's allowed, tokens remained and time to wait if not allowed
+	Take(key string, rate float64, burst int) (bool, int, time.Duration, error)
+}
+
+type LimiterStoreFactory func(options map[string]string) (LimiterStore, error)
+
+var (
+	limiterStoreMutex sync.RWMutex
+	limiterStores     = map[string]LimiterStoreFactory{
+		MemoryLimiterStoreName: NewMemoryLimiterStore,
+		RedisLimiterStoreName:  NewRedisLimiterStore,
+	}
+)
+
+// RegisterLimiterStore used to for limiter store registration
+func RegisterLimiterStore(name string, factory LimiterStoreFactory) {
+	limiterStoreMutex.Lock()
+	defer limiterStoreMutex.Unlock()
+	limiterStores[name] = factory
+}
+
+func NewLimiterStore(name string, options map[string]string) (LimiterStore, error) {
+	limiterStoreMutex.RLock()
+	defer limiterStoreMutex.RUnlock()
+	factory, ok := limiterStores[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("limiter store %s not registered", name))
+	}
+	return factory(options)
+}
+
+type RateLimitRule struct {
+	//Path prefix of route group, for instance, /v1/metadata/infrastructure, the longest matched prefix wins
+	Prefix string `mapstructure:"prefix"`
+	//Tokens added to bucket per second, requests are not limited if 0
+	Rate float64 `mapstructure:"rate"`
+	//Bucket size, the max requests in burst
+	Burst int `mapstructure:"burst"`
+}
+
+type RateLimitConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	//Limiter store, memory or redis
+	Store string `mapstructure:"store"`
+	//Header of API key, clients are identified by ip if header is absent
+	KeyHeader string `mapstructure:"keyHeader"`
+	//Default limit of all paths
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+	//Path prefixes never limited
+	Exempt []string `mapstructure:"exempt"`
+	//Limits of route groups
+	Rules []RateLimitRule `mapstructure:"rules"`
+	//Options of limiter store, for instance, address of redis
+	Options map[string]string `mapstructure:"options"`
+	//Name to api key of [auth], other keys in header are ignored
+	apiKeys map[string]string
+}
+
+// LoadRateLimitConfig reads [ratelimit] config, nil is returned if rate limiting disabled
+func LoadRateLimitConfig() (*RateLimitConfig, error) {
+	if !app.Config.Exists("ratelimit") {
+		return nil, nil
+	}
+	conf := RateLimitConfig{
+		Store:     MemoryLimiterStoreName,
+		KeyHeader: DefaultAPIKeyHeader,
+		Exempt:    []string{"/health", "/ready", "/ping"},
+	}
+	if err := app.Config.MapStruct("ratelimit", &conf); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode ratelimit config %v", err))
+	}
+	if !conf.Enabled {
+		return nil, nil
+	}
+	rules := append([]RateLimitRule{{Prefix: "/", Rate: conf.Rate, Burst: conf.Burst}}, conf.Rules...)
+	for _, r := range rules {
+		if r.Rate < 0 || (r.Rate > 0 && r.Burst <= 0) {
+			return nil, errors.New(fmt.Sprintf("invalid rate limit of %s, rate %v burst %d", r.Prefix, r.Rate,
+				r.Burst))
+		}
+	}
+	//longest prefix first
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+	conf.Rules = rules
+	//only keys configured in [auth] identify clients, otherwise a random key gets a new bucket
+	if app.Config.Exists("auth.apikeys") {
+		if err := app.Config.MapStruct("auth.apikeys", &conf.apiKeys); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to decode api keys of auth config %v", err))
+		}
+	}
+	return &conf, nil
+}
+
+// RateLimit limits requests of every client with token bucket, 429 is returned with Retry-After header when bucket is
+// empty. Requests are allowed if limiter store is unavailable.
+func RateLimit(conf *RateLimitConfig) (gin.HandlerFunc, error) {
+	store, err := NewLimiterStore(conf.Store, conf.Options)
+	if err != nil {
+		return nil, err
+	}
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		for _, e := range conf.Exempt {
+			if strings.HasPrefix(path, e) {
+				c.Next()
+				return
+			}
+		}
+		//internal requests such as git sync webhook
+		if IsLoopbackPeer(c) {
+			c.Next()
+			return
+		}
+		rule := matchRule(conf.Rules, path)
+		if rule == nil || rule.Rate == 0 {
+			c.Next()
+			return
+		}
+		client := conf.client(c)
+		allowed, remaining, wait, err := store.Take(fmt.Sprintf("%s|%s", rule.Prefix, client), rule.Rate,
+			rule.Burst)
+		if err != nil {
+			app.Logger.Error(fmt.Sprintf("failed to take token of %s from limiter store %v", client, err))
+			c.Next()
+			return
+		}
+		c.Header("X-RateLimit-Limit", strconv.Itoa(rule.Burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.Data(429, "text/plain", []byte("rate limit exceeded"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}, nil
+}
+
+// client returns the name of api key if it's configured, otherwise, the ip of client resolved with trusted proxies
+func (r *RateLimitConfig) client(c *gin.Context) string {
+	if key := c.GetHeader(r.KeyHeader); key != "" {
+		for name, value := range r.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(value)) == 1 {
+				return fmt.Sprintf("key:%s", name)
+			}
+		}
+	}
+	return fmt.Sprintf("ip:%s", ClientIP(c))
+}
+
+func matchRule(rules []RateLimitRule, path string) *RateLimitRule {
+	for i := range rules {
+		if strings.HasPrefix(path, rules[i].Prefix) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// IsLoopbackPeer returns true if request is sent from local without proxy
+func IsLoopbackPeer(c *gin.Context) bool {
+	if c.GetHeader("X-Forwarded-For") != "" || c.GetHeader("X-Real-Ip") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryLimiterStore keeps buckets in process, limits are applied to every replica separately
+type MemoryLimiterStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func NewMemoryLimiterStore(options map[string]string) (LimiterStore, error) {
+	return &MemoryLimiterStore{
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}, nil
+}
+
+func (m *MemoryLimiterStore) Take(key string, rate float64, burst int) (bool, int, time.Duration, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.sweep(now)
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), updated: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, 0, time.Duration((1 - b.tokens) / rate * float64(time.Second)), nil
+	}
+	b.tokens -= 1
+	return true, int(b.tokens), 0, nil
+}
+
+// sweep removes buckets idle for a minute, they are full again anyway unless rate is extremely low
+func (m *MemoryLimiterStore) sweep(now time.Time) {
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) > time.Minute {
+			delete(m.buckets, key)
+		}
+	}
+	m.swept = now
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const RedisLimiterStoreName = "redis"
+const RedisKeyPrefix = "community-metadata:ratelimit:"
+
+// takeTokenScript refills and takes one token atomically, time comes from caller since replicas share the bucket
+var takeTokenScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, math.floor(tokens), wait}
+`)
+
+// RedisLimiterStore keeps buckets in redis so that limits are shared among replicas
+//
+// options:
+//
+//	address: redis address, default 127.0.0.1:6379
+//	password: redis password
+//	db: redis database, default 0
+type RedisLimiterStore struct {
+	pool *redis.Pool
+}
+
+func NewRedisLimiterStore(options map[string]string) (LimiterStore, error) {
+	address := options["address"]
+	if address == "" {
+		address = "127.0.0.1:6379"
+	}
+	db := 0
+	if value, ok := options["db"]; ok && value != "" {
+		var err error
+		if db, err = strconv.Atoi(value); err != nil {
+			return nil, errors.New(fmt.Sprintf("redis db should be integer, got '%s'", value))
+		}
+	}
+	dialOptions := []redis.DialOption{
+		redis.DialDatabase(db),
+		redis.DialConnectTimeout(time.Second),
+		redis.DialReadTimeout(time.Second),
+		redis.DialWriteTimeout(time.Second),
+	}
+	if options["password"] != "" {
+		dialOptions = append(dialOptions, redis.DialPassword(options["password"]))
+	}
+	return &RedisLimiterStore{
+		pool: &redis.Pool{
+			MaxIdle:     10,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", address, dialOptions...)
+			},
+		},
+	}, nil
+}
+
+func (r *RedisLimiterStore) Take(key string, rate float64, burst int) (bool, int, time.Duration, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	values, err := redis.Int64s(takeTokenScript.Do(conn, RedisKeyPrefix+key, rate, burst,
+		time.Now().UnixNano()/int64(time.Millisecond)))
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if len(values) != 3 {
+		return false, 0, 0, errors.New(fmt.Sprintf("unexpected result %v of token script", values))
+	}
+	return values[0] == 1, int(values[1]), time.Duration(values[2]) * time.Millisecond, nil
+}
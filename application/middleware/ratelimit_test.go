@@ -0,0 +1,59 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestContext(remoteAddr string, headers map[string]string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/v1/metadata", nil)
+	c.Request.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		c.Request.Header.Set(k, v)
+	}
+	return c
+}
+
+func TestRateLimitClient(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &RateLimitConfig{KeyHeader: DefaultAPIKeyHeader, apiKeys: map[string]string{"ci": "secret"}}
+	cases := []struct {
+		remoteAddr string
+		headers    map[string]string
+		client     string
+	}{
+		{"1.2.3.4:1000", nil, "ip:1.2.3.4"},
+		{"1.2.3.4:1000", map[string]string{"X-API-Key": "secret"}, "key:ci"},
+		//keys not configured don't get their own buckets
+		{"1.2.3.4:1000", map[string]string{"X-API-Key": "random"}, "ip:1.2.3.4"},
+		//ip is resolved with trusted proxies
+		{"1.2.3.4:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "ip:1.2.3.4"},
+		{"10.1.1.1:1000", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "ip:5.6.7.8"},
+	}
+	for _, c := range cases {
+		context := newTestContext(c.remoteAddr, c.headers)
+		ResolveClientIP(resolver)(context)
+		if client := conf.client(context); client != c.client {
+			t.Errorf("client of %s with %v is %s, expected %s", c.remoteAddr, c.headers, client, c.client)
+		}
+	}
+}
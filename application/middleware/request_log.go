@@ -64,7 +64,8 @@ func RequestLog() gin.HandlerFunc {
 			zap.String("req_date", start.Format("2006-01-02 15:04:05")),
 			zap.String("method", c.Request.Method),
 			zap.String("uri", c.Request.URL.String()),
-			zap.String("client_ip", c.ClientIP()),
+			zap.String("client_ip", ClientIP(c)),
+			zap.String("caller", c.GetString(CallerKey)),
 			zap.Int("http_status", c.Writer.Status()),
 			zap.String("elapsed_time", mathutil.ElapsedTime(start)),
 			zap.String("post_data", postData),
@@ -0,0 +1,72 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opensourceways/app-community-metadata/app"
+)
+
+type SecurityConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	//X-Frame-Options, DENY by default
+	FrameOptions string `mapstructure:"frameOptions"`
+	//Referrer-Policy, no-referrer by default
+	ReferrerPolicy string `mapstructure:"referrerPolicy"`
+	//Content-Security-Policy, not sent if empty
+	ContentSecurityPolicy string `mapstructure:"contentSecurityPolicy"`
+	//max-age of Strict-Transport-Security in seconds, only sent over tls, disabled if 0
+	HSTSMaxAge int `mapstructure:"hstsMaxAge"`
+}
+
+// LoadSecurityConfig reads [security] config, nil is returned if security headers disabled
+func LoadSecurityConfig() (*SecurityConfig, error) {
+	if !app.Config.Exists("security") {
+		return nil, nil
+	}
+	conf := SecurityConfig{
+		FrameOptions:   "DENY",
+		ReferrerPolicy: "no-referrer",
+	}
+	if err := app.Config.MapStruct("security", &conf); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode security config %v", err))
+	}
+	if !conf.Enabled {
+		return nil, nil
+	}
+	return &conf, nil
+}
+
+// SecurityHeaders adds standard security headers to every response
+func SecurityHeaders(conf *SecurityConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("X-Content-Type-Options", "nosniff")
+		if conf.FrameOptions != "" {
+			c.Header("X-Frame-Options", conf.FrameOptions)
+		}
+		if conf.ReferrerPolicy != "" {
+			c.Header("Referrer-Policy", conf.ReferrerPolicy)
+		}
+		if conf.ContentSecurityPolicy != "" {
+			c.Header("Content-Security-Policy", conf.ContentSecurityPolicy)
+		}
+		if conf.HSTSMaxAge > 0 && c.Request.TLS != nil {
+			c.Header("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", conf.HSTSMaxAge))
+		}
+		c.Next()
+	}
+}
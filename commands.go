@@ -0,0 +1,286 @@
+/*
+Copyright 2021 The Opensourceways Group.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gookit/color"
+	"github.com/opensourceways/app-community-metadata/app"
+	"github.com/opensourceways/app-community-metadata/application"
+	"github.com/opensourceways/app-community-metadata/application/gitsync"
+	"github.com/opensourceways/app-community-metadata/application/middleware"
+)
+
+const DefaultConfigDir = "./config"
+
+const usage = `Usage: %s <command> [options]
+
+Commands:
+  serve                           start the server (default)
+  validate                        validate the config
+  plugins list                    list all registered plugins and their meta
+  dry-run <plugin> --dir <path>   load plugin with local checkout and print the content it would serve
+
+Run '%s <command> --help' for the options of each command.
+`
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, usage, filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
+}
+
+// runCommand dispatches sub command and returns the exit code
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		serve(DefaultConfigDir)
+		return 0
+	}
+	switch args[0] {
+	case "serve":
+		return serveCommand(args[1:])
+	case "validate":
+		return validateCommand(args[1:])
+	case "plugins":
+		if len(args) < 2 || args[1] != "list" {
+			printUsage()
+			return 2
+		}
+		return listPluginsCommand(args[2:])
+	case "dry-run":
+		return dryRunCommand(args[1:])
+	case "help", "-h", "--help":
+		printUsage()
+		return 0
+	default:
+		color.Error.Printf("unknown command %s\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+func serveCommand(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	configDir := flags.String("config", DefaultConfigDir, "config folder")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	serve(*configDir)
+	return 0
+}
+
+// bootstrapConfig bootstraps app with config in folder, failure in bootstrap, for instance, log folder missing, is
+// reported instead of panic
+func bootstrapConfig(configDir string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("failed to bootstrap with config in %s: %v", configDir, r))
+		}
+	}()
+	app.Bootstrap(configDir)
+	return nil
+}
+
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configDir := flags.String("config", DefaultConfigDir, "config folder")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := bootstrapConfig(*configDir); err != nil {
+		color.Error.Printf("%v\n", err)
+		return 1
+	}
+	if err := gitsync.LoadConfiguredPlugins(); err != nil {
+		color.Error.Printf("%v\n", err)
+		return 1
+	}
+	problems := gitsync.ValidateConfig()
+	if _, err := application.LoadListenerConfigs(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := middleware.LoadCORSConfig(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := middleware.LoadSecurityConfig(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := middleware.LoadClientIPResolver(); err != nil {
+		problems = append(problems, err)
+	}
+	if conf, err := middleware.LoadRateLimitConfig(); err != nil {
+		problems = append(problems, err)
+	} else if conf != nil {
+		if _, err = middleware.NewLimiterStore(conf.Store, conf.Options); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if len(problems) == 0 {
+		color.Info.Printf("config in %s is valid\n", *configDir)
+		return 0
+	}
+	for _, p := range problems {
+		color.Error.Printf("%v\n", p)
+	}
+	return 1
+}
+
+func listPluginsCommand(args []string) int {
+	flags := flag.NewFlagSet("plugins list", flag.ContinueOnError)
+	configDir := flags.String("config", "", "config folder, plugins configured in it are listed as well")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configDir != "" {
+		if err := bootstrapConfig(*configDir); err != nil {
+			color.Error.Printf("%v\n", err)
+			return 1
+		}
+		if err := gitsync.LoadConfiguredPlugins(); err != nil {
+			color.Error.Printf("%v\n", err)
+			return 1
+		}
+	}
+	names, plugins := gitsync.RegisteredPlugins()
+	for _, name := range names {
+		meta := plugins[name].GetMeta()
+		color.Info.Printf("%s\n", name)
+		fmt.Printf("  endpoint:    /v1/metadata/%s/%s\n", meta.Group, meta.Name)
+		fmt.Printf("  description: %s\n", meta.Description)
+		for _, r := range meta.Repos {
+			fmt.Printf("  repo:        %s (branch: %s, watch: %s)\n", r.Repo, r.Branch, strings.Join(r.WatchFiles, ","))
+		}
+	}
+	return 0
+}
+
+func dryRunCommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		color.Error.Println("plugin name is required")
+		printUsage()
+		return 2
+	}
+	name := args[0]
+	flags := flag.NewFlagSet("dry-run", flag.ContinueOnError)
+	var dirs stringsFlag
+	flags.Var(&dirs, "dir", "local checkout of plugin repo, specify multiple times in the order of plugin repos")
+	configDir := flags.String("config", DefaultConfigDir, "config folder")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if len(dirs) == 0 {
+		color.Error.Println("--dir is required")
+		return 2
+	}
+	if err := bootstrapConfig(*configDir); err != nil {
+		color.Error.Printf("%v\n", err)
+		return 1
+	}
+	if err := gitsync.LoadConfiguredPlugins(); err != nil {
+		color.Error.Printf("%v\n", err)
+		return 1
+	}
+	_, plugins := gitsync.RegisteredPlugins()
+	plugin, ok := plugins[name]
+	if !ok {
+		color.Error.Printf("plugin %s not registered\n", name)
+		return 1
+	}
+	gin.SetMode(gin.ReleaseMode)
+	//collect watch files from local checkout
+	meta := plugin.GetMeta()
+	files := make(map[string][]string)
+	for i, r := range meta.Repos {
+		dir := dirs[0]
+		if i < len(dirs) {
+			dir = dirs[i]
+		}
+		dir, _ = filepath.Abs(dir)
+		for _, w := range r.WatchFiles {
+			path := filepath.Join(dir, w)
+			if _, err := os.Stat(path); err != nil {
+				color.Warn.Printf("watch file %s not found in %s, skipped\n", w, dir)
+				continue
+			}
+			files[r.Repo] = append(files[r.Repo], path)
+		}
+	}
+	//register endpoints before loading, plugins may mount static folders when loading
+	engine := gin.New()
+	group := engine.Group(fmt.Sprintf("/v1/metadata/%s/%s", meta.Group, meta.Name))
+	plugin.RegisterEndpoints(group)
+	if err := plugin.Load(files); err != nil {
+		color.Error.Printf("plugin %s failed to load %v\n", name, err)
+		return 1
+	}
+	documented, ok := plugin.(gitsync.Documented)
+	if !ok {
+		color.Info.Printf("plugin %s loaded, endpoints are not documented, nothing to print\n", name)
+		return 0
+	}
+	results := make(map[string]interface{})
+	for _, endpoint := range documented.GetEndpoints() {
+		//endpoints with path or required parameters can't be requested without arguments
+		if strings.ContainsAny(endpoint.Path, ":*") || (endpoint.Method != "" && endpoint.Method != "GET") {
+			continue
+		}
+		if requiresParameter(endpoint) {
+			continue
+		}
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, httptest.NewRequest("GET", group.BasePath()+endpoint.Path, nil))
+		var body interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			body = recorder.Body.String()
+		}
+		results[endpoint.Path] = map[string]interface{}{
+			"status": recorder.Code,
+			"body":   body,
+		}
+	}
+	output, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		color.Error.Printf("failed to encode results %v\n", err)
+		return 1
+	}
+	fmt.Println(string(output))
+	return 0
+}
+
+func requiresParameter(endpoint gitsync.Endpoint) bool {
+	for _, p := range endpoint.Parameters {
+		if p.Required {
+			return true
+		}
+	}
+	return false
+}
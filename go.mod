@@ -3,12 +3,18 @@ module github.com/opensourceways/app-community-metadata
 go 1.15
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gin-gonic/gin v1.7.1
-	github.com/gomodule/redigo v1.8.4 // indirect
+	github.com/golang-jwt/jwt/v4 v4.3.0
+	github.com/gomodule/redigo v1.8.4
 	github.com/gookit/color v1.3.8
 	github.com/gookit/config/v2 v2.0.23
 	github.com/gookit/goutil v0.3.12
 	github.com/json-iterator/go v1.1.11
+	github.com/mitchellh/mapstructure v1.4.1
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/oschwald/maxminddb-golang v1.8.0
+	github.com/robfig/cron/v3 v3.0.1
 	go.uber.org/zap v1.13.0
 	sigs.k8s.io/yaml v1.2.0
 )
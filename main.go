@@ -14,6 +14,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
 	"github.com/gookit/color"
 	"github.com/opensourceways/app-community-metadata/app"
@@ -28,13 +29,25 @@ import (
 
 var (
 	manager *gitsync.SyncManager
+	//closed when shutdown procedure finished
+	shutdownDone = make(chan struct{})
 )
 
-func init() {
-	app.Bootstrap("./config")
-	application.InitServer()
-}
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// serve starts the server and blocks until shutdown
+func serve(configDir string) {
+	app.Bootstrap(configDir)
+	if err := gitsync.LoadConfiguredPlugins(); err != nil {
+		color.Error.Printf("failed to configure plugins %v\n", err)
+		os.Exit(1)
+	}
+	if err := application.InitServer(); err != nil {
+		color.Error.Printf("failed to initialize server %v\n", err)
+		os.Exit(1)
+	}
 	listenSignals()
 	//init manager
 	var err error
@@ -48,16 +61,29 @@ func main() {
 		color.Error.Printf("failed to start manager %v\n ", err)
 		os.Exit(1)
 	}
+	//register endpoints for plugin administration
+	if err = manager.RegisterAdminEndpoints(application.Server().Group("/v1/admin")); err != nil {
+		color.Error.Printf("failed to register admin endpoints %v\n", err)
+		os.Exit(1)
+	}
 	manager.StartLoop()
 	//register endpoint for readiness check
 	application.Server().GET("/ready", ReadinessHandler)
+	//register endpoints for api document
+	application.Server().GET("/v1/openapi.json", manager.OpenAPIHandler)
+	application.Server().GET("/v1/docs", manager.APIDocsHandler("/v1/openapi.json", "/v1/docs/redoc.standalone.js"))
+	application.Server().StaticFile("/v1/docs/redoc.standalone.js", gitsync.RedocBundle)
 	// init services
 	color.Info.Printf("============  Begin Running(PID: %d) ============\n", os.Getpid())
-	application.Run()
+	if err := application.Run(); err != nil {
+		os.Exit(1)
+	}
+	//wait for shutdown procedure
+	<-shutdownDone
 }
 
 func ReadinessHandler(c *gin.Context) {
-	if manager.OnePluginInitialized() {
+	if manager.IsReady() {
 		c.JSON(200, gin.H{
 			"ready": true,
 		})
@@ -80,6 +106,7 @@ func listenSignals() {
 func handleSignals(c chan os.Signal) {
 	color.Info.Printf("Notice: System signal monitoring is enabled(watch: SIGINT,SIGTERM,SIGQUIT)\n")
 
+	graceful := false
 	switch <-c {
 	case syscall.SIGINT:
 		color.Info.Printf("\nShutdown by Ctrl+C")
@@ -87,17 +114,39 @@ func handleSignals(c chan os.Signal) {
 		color.Info.Printf("\nShutdown quickly")
 	case syscall.SIGQUIT:
 		color.Info.Printf("\nShutdown gracefully")
-		// do graceful shutdown
+		graceful = true
+	}
+
+	if graceful {
+		//drain in-flight requests, then wait for git sync processes and plugin loads
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(app.ShutdownTimeout)*time.Second)
+		defer cancel()
+		if err := application.Shutdown(ctx); err != nil {
+			color.Error.Printf("\nfailed to shutdown http server gracefully %v", err)
+		}
+		shutdownManager(ctx)
+	} else {
+		//close connections immediately, git sync processes are still terminated
+		if err := application.Close(); err != nil {
+			color.Error.Printf("\nfailed to close http server %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(app.QuickShutdownTimeout)*time.Second)
+		defer cancel()
+		shutdownManager(ctx)
 	}
 
 	// sync logs
 	_ = app.Logger.Sync()
-	if manager != nil {
-		manager.Close()
-	}
-	//sleep and exit
-	time.Sleep(time.Second * 3)
 	color.Info.Println("\nGoodBye...")
-
+	close(shutdownDone)
 	os.Exit(0)
 }
+
+func shutdownManager(ctx context.Context) {
+	if manager == nil {
+		return
+	}
+	if err := manager.Shutdown(ctx); err != nil {
+		color.Error.Printf("\nfailed to shutdown sync manager %v", err)
+	}
+}